@@ -0,0 +1,347 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/hlog"
+)
+
+// adminRealm is the HTTP basic authentication realm of the admin routes.
+const adminRealm = "kuberton-demo admin"
+
+// adminAuth requires the admin credentials with HTTP basic authentication.
+func adminAuth(user, password string) func(http.Handler) http.Handler {
+	wantUser, wantPassword := sha256.Sum256([]byte(user)), sha256.Sum256([]byte(password))
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			u, p, ok := r.BasicAuth()
+			// the hashes are compared so that the time does not depend on
+			// the length of the credentials
+			gotUser, gotPassword := sha256.Sum256([]byte(u)), sha256.Sum256([]byte(p))
+			if !ok || subtle.ConstantTimeCompare(gotUser[:], wantUser[:])&
+				subtle.ConstantTimeCompare(gotPassword[:], wantPassword[:]) != 1 {
+				if ok {
+					hlog.FromRequest(r).Warn().Str("user", u).Msg("admin authentication failed")
+				}
+				w.Header().Set("WWW-Authenticate", `Basic realm="`+adminRealm+`", charset="UTF-8"`)
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// sameOrigin rejects the requests changing data which other sites send:
+// the browser adds the basic authentication credentials to them.
+func sameOrigin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			if origin := r.Header.Get("Origin"); origin != "" {
+				if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+					hlog.FromRequest(r).Warn().Str("origin", origin).Msg("cross-origin admin request rejected")
+					http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+					return
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// catalogAdmin manages the products of the catalog, pictures can be
+// uploaded when the static files are served from a directory.
+type catalogAdmin struct {
+	uploads bool
+}
+
+// listProductsHandler shows the catalog with a form to add a product.
+func (a catalogAdmin) listProductsHandler(w http.ResponseWriter, r *http.Request) {
+	l := hlog.FromRequest(r)
+	products := ListProducts(r.Context())
+	if wantsJSON(r) {
+		render.JSON(w, r, products)
+		return
+	}
+	a.render(w, r, "admin", map[string]interface{}{
+		"products": products,
+	})
+	l.Debug().Int("products", len(products)).Msg("admin catalog")
+}
+
+// productHandler shows the form to edit or delete the product.
+func (a catalogAdmin) productHandler(w http.ResponseWriter, r *http.Request) {
+	l := hlog.FromRequest(r)
+	p, err := GetProduct(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		renderError(l, r, w, err, http.StatusNotFound)
+		return
+	}
+	if wantsJSON(r) {
+		render.JSON(w, r, p)
+		return
+	}
+	a.render(w, r, "admin_product", map[string]interface{}{
+		"product": p,
+	})
+}
+
+// createProductHandler adds the product given as JSON or with the form, a
+// random ID is given to a product without one.
+func (a catalogAdmin) createProductHandler(w http.ResponseWriter, r *http.Request) {
+	l := hlog.FromRequest(r)
+	p, err := decodeProduct(r)
+	if err != nil {
+		renderError(l, r, w, err, http.StatusBadRequest)
+		return
+	}
+	if p.Id == "" {
+		p.Id = newProductID()
+	}
+	if err := validateProduct(p); err != nil {
+		renderError(l, r, w, err, http.StatusBadRequest)
+		return
+	}
+	if err := CreateProduct(r.Context(), p); err != nil {
+		renderError(l, r, w, err, catalogErrorCode(err))
+		return
+	}
+	l.Info().Str("product", p.Id).Str("admin", adminUser(r)).Msg("product created")
+	if wantsJSON(r) {
+		render.Status(r, http.StatusCreated)
+		render.JSON(w, r, p)
+		return
+	}
+	http.Redirect(w, r, "/admin/products", http.StatusSeeOther)
+}
+
+// updateProductHandler replaces the product with the one given as JSON or
+// with the form, the ID can not be changed. The form keeps the variants and
+// the price list.
+func (a catalogAdmin) updateProductHandler(w http.ResponseWriter, r *http.Request) {
+	l := hlog.FromRequest(r)
+	p, err := decodeProduct(r)
+	if err != nil {
+		renderError(l, r, w, err, http.StatusBadRequest)
+		return
+	}
+	p.Id = chi.URLParam(r, "id")
+	if !isJSONBody(r) {
+		if old, err := GetProduct(r.Context(), p.Id); err == nil {
+			p.Variants, p.Prices = old.Variants, old.Prices
+		}
+	}
+	if err := validateProduct(p); err != nil {
+		renderError(l, r, w, err, http.StatusBadRequest)
+		return
+	}
+	if err := UpdateProduct(r.Context(), p); err != nil {
+		renderError(l, r, w, err, catalogErrorCode(err))
+		return
+	}
+	l.Info().Str("product", p.Id).Str("admin", adminUser(r)).Msg("product updated")
+	if wantsJSON(r) {
+		render.JSON(w, r, p)
+		return
+	}
+	http.Redirect(w, r, "/admin/products", http.StatusSeeOther)
+}
+
+func (a catalogAdmin) deleteProductHandler(w http.ResponseWriter, r *http.Request) {
+	l := hlog.FromRequest(r)
+	id := chi.URLParam(r, "id")
+	if err := DeleteProduct(r.Context(), id); err != nil {
+		renderError(l, r, w, err, catalogErrorCode(err))
+		return
+	}
+	l.Info().Str("product", id).Str("admin", adminUser(r)).Msg("product deleted")
+	if wantsJSON(r) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	http.Redirect(w, r, "/admin/products", http.StatusSeeOther)
+}
+
+func (a catalogAdmin) render(w http.ResponseWriter, r *http.Request, name string, data map[string]interface{}) {
+	rid, _ := hlog.IDFromRequest(r)
+	data["request_id"] = rid.String()
+	data["pictures"] = a.pictures()
+	data["uploads"] = a.uploads
+	if err := executeTemplate(r.Context(), w, name, data); err != nil {
+		hlog.FromRequest(r).Info().Err(err).Msgf("unable to parse %s template", name)
+	}
+}
+
+// pictures lists the product pictures to choose from.
+func (a catalogAdmin) pictures() []string {
+	files, _ := fs.Glob(assets.fsys, picturesDir+"/*")
+	var pictures []string
+	for _, f := range files {
+		switch strings.ToLower(path.Ext(f)) {
+		case ".jpg", ".jpeg", ".png", ".gif", ".webp":
+			pictures = append(pictures, assetsPrefix+f)
+		}
+	}
+	return pictures
+}
+
+// uploadImageHandler saves the picture uploaded in the image field of a
+// multipart form, under the name field or the name of the file.
+func (a catalogAdmin) uploadImageHandler(w http.ResponseWriter, r *http.Request) {
+	l := hlog.FromRequest(r)
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes+1<<20)
+	f, hdr, err := r.FormFile("image")
+	if err != nil {
+		renderError(l, r, w, errors.Wrap(err, "could not read the uploaded picture"), http.StatusBadRequest)
+		return
+	}
+	defer f.Close()
+	name := r.FormValue("name")
+	if name == "" {
+		name = strings.TrimSuffix(hdr.Filename, filepath.Ext(hdr.Filename))
+	}
+
+	picture, err := images.Save(r.Context(), pictureName(name), f)
+	if err != nil {
+		renderError(l, r, w, err, catalogErrorCode(err))
+		return
+	}
+	l.Info().Str("picture", picture).Str("admin", adminUser(r)).Msg("picture uploaded")
+	if wantsJSON(r) {
+		render.Status(r, http.StatusCreated)
+		// the picture is what the product refers to, the set how to show it
+		render.JSON(w, r, struct {
+			Picture string `json:"picture"`
+			imageSet
+		}{picture, images.Set(picture)})
+		return
+	}
+	http.Redirect(w, r, "/admin/products", http.StatusSeeOther)
+}
+
+func catalogErrorCode(err error) int {
+	switch errors.Cause(err) {
+	case ErrProductNotFound:
+		return http.StatusNotFound
+	case ErrProductExists, ErrSkuExists, ErrImageExists:
+		return http.StatusConflict
+	case ErrInvalidProduct, ErrInvalidImage:
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// decodeProduct reads the product from the JSON body or from the form,
+// whose price is a decimal USD amount and categories a comma separated
+// list. The form has the translations as name_de, description_de and so on.
+func decodeProduct(r *http.Request) (Product, error) {
+	var p Product
+	if isJSONBody(r) {
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&p); err != nil {
+			return Product{}, errors.Wrap(err, "could not parse the product")
+		}
+		return p, nil
+	}
+
+	price, err := parseAmount(r.FormValue("price"), defaultCurrency)
+	if err != nil {
+		return Product{}, err
+	}
+	weight := 0
+	if s := strings.TrimSpace(r.FormValue("weight_grams")); s != "" {
+		if weight, err = strconv.Atoi(s); err != nil {
+			return Product{}, errors.Errorf("weight %q is not a number of grams", s)
+		}
+	}
+	var translations map[string]ProductText
+	for _, l := range locales[1:] {
+		lang := l.tag.String()
+		t := ProductText{
+			Name:        strings.TrimSpace(r.FormValue("name_" + lang)),
+			Description: strings.TrimSpace(r.FormValue("description_" + lang)),
+		}
+		if t != (ProductText{}) {
+			if translations == nil {
+				translations = map[string]ProductText{}
+			}
+			translations[lang] = t
+		}
+	}
+	return Product{
+		Id:           strings.TrimSpace(r.FormValue("id")),
+		Name:         strings.TrimSpace(r.FormValue("name")),
+		Description:  strings.TrimSpace(r.FormValue("description")),
+		Translations: translations,
+		Picture:      strings.TrimSpace(r.FormValue("picture")),
+		PriceUsd:     price,
+		WeightGrams:  weight,
+		Categories:   splitList(r.FormValue("categories")),
+	}, nil
+}
+
+// parseAmount parses a non-negative decimal amount such as "12.49" without
+// the rounding errors of a float.
+func parseAmount(s, currency string) (Money, error) {
+	s = strings.TrimSpace(s)
+	units, frac := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		units, frac = s[:i], s[i+1:]
+	}
+	if units == "" || strings.Trim(units+frac, "0123456789") != "" || len(frac) > 9 {
+		return Money{}, errors.Errorf("price %q is not an amount", s)
+	}
+	u, err := strconv.ParseInt(units, 10, 64)
+	if err != nil {
+		return Money{}, errors.Errorf("price %q is not an amount", s)
+	}
+	nanos := 0
+	if frac != "" {
+		nanos, _ = strconv.Atoi(frac + strings.Repeat("0", 9-len(frac)))
+	}
+	return Money{CurrencyCode: currency, Units: u, Nanos: int32(nanos)}, nil
+}
+
+// formatAmount formats the amount for parseAmount, with at least the cents.
+func formatAmount(m Money) string {
+	frac := strings.TrimRight(fmt.Sprintf("%09d", m.Nanos), "0")
+	for len(frac) < 2 {
+		frac += "0"
+	}
+	return fmt.Sprintf("%d.%s", m.Units, frac)
+}
+
+// newProductID returns a random ID looking like the ones of the catalog.
+func newProductID() string {
+	const chars = "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	for i := range b {
+		b[i] = chars[int(b[i])%len(chars)]
+	}
+	return string(b)
+}
+
+func adminUser(r *http.Request) string {
+	u, _, _ := r.BasicAuth()
+	return u
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestValidateProduct(t *testing.T) {
+	valid := Product{
+		Id:       "LAMP01",
+		Name:     "Desk Lamp",
+		Picture:  "/static/img/products/typewriter.jpg",
+		PriceUsd: Money{CurrencyCode: "USD", Units: 19, Nanos: 500000000},
+	}
+	tests := []struct {
+		name   string
+		change func(*Product)
+		valid  bool
+	}{
+		{"valid", func(*Product) {}, true},
+		{"free", func(p *Product) { p.PriceUsd = Money{CurrencyCode: "USD"} }, true},
+		{"bad id", func(p *Product) { p.Id = "../x" }, false},
+		{"no name", func(p *Product) { p.Name = " " }, false},
+		{"mismatching signs", func(p *Product) { p.PriceUsd.Nanos = -1 }, false},
+		{"nanos out of range", func(p *Product) { p.PriceUsd.Nanos = 1e9 }, false},
+		{"negative price", func(p *Product) { p.PriceUsd = Money{CurrencyCode: "USD", Units: -1} }, false},
+		{"price in EUR", func(p *Product) { p.PriceUsd.CurrencyCode = "EUR" }, false},
+		{"missing picture", func(p *Product) { p.Picture = "/static/img/products/lamp.jpg" }, false},
+		{"picture outside static", func(p *Product) { p.Picture = "/static/../products.json" }, false},
+		{"picture not under /static/", func(p *Product) { p.Picture = "img/products/typewriter.jpg" }, false},
+		{"directory as picture", func(p *Product) { p.Picture = "/static/img/products" }, false},
+		{"price list", func(p *Product) { p.Prices = map[string]Money{"JPY": {CurrencyCode: "JPY", Units: 1900}} }, true},
+		{"usd in the price list", func(p *Product) { p.Prices = map[string]Money{"USD": {CurrencyCode: "USD", Units: 19}} }, false},
+		{"price list currency mismatch", func(p *Product) { p.Prices = map[string]Money{"JPY": {CurrencyCode: "EUR", Units: 19}} }, false},
+		{"negative price list price", func(p *Product) { p.Prices = map[string]Money{"EUR": {CurrencyCode: "EUR", Units: -1}} }, false},
+		{"negative weight", func(p *Product) { p.WeightGrams = -1 }, false},
+		{"empty category", func(p *Product) { p.Categories = []string{"home", ""} }, false},
+		{"translated", func(p *Product) { p.Translations = map[string]ProductText{"de": {Name: "Schreibtischlampe"}} }, true},
+		{"translated to the default locale", func(p *Product) { p.Translations = map[string]ProductText{"en": {Name: "Lamp"}} }, false},
+		{"unsupported translation", func(p *Product) { p.Translations = map[string]ProductText{"xx": {Name: "Lamp"}} }, false},
+		{"variants", func(p *Product) {
+			p.Categories, p.Variants = []string{"cycling"}, variants(bike("S", "black"), bike("M", "black"))
+		}, true},
+		{"variants without attributes", func(p *Product) { p.Variants = variants(bike("S", "black")) }, false},
+		{"variant sku same as id", func(p *Product) {
+			p.Categories, p.Variants = []string{"cycling"}, []Variant{{Sku: p.Id, Attributes: map[string]string{"size": "S", "color": "black"}}}
+		}, false},
+		{"variant sku twice", func(p *Product) {
+			p.Categories, p.Variants = []string{"cycling"}, variants(bike("S", "black"), bike("M", "black"))
+			p.Variants[1].Sku = p.Variants[0].Sku
+		}, false},
+		{"unknown attribute value", func(p *Product) { p.Categories, p.Variants = []string{"cycling"}, variants(bike("XL", "black")) }, false},
+		{"missing attribute", func(p *Product) {
+			p.Categories, p.Variants = []string{"cycling"}, []Variant{{Sku: "LAMP01-S", Attributes: map[string]string{"size": "S"}}}
+		}, false},
+		{"extra attribute", func(p *Product) {
+			p.Categories, p.Variants = []string{"cycling"}, variants(bike("S", "black"))
+			p.Variants[0].Attributes["gears"] = "1"
+		}, false},
+		{"same attributes", func(p *Product) {
+			p.Categories, p.Variants = []string{"cycling"}, variants(bike("S", "black"), bike("S", "black"))
+		}, false},
+		{"variant price list without a price", func(p *Product) {
+			p.Categories, p.Variants = []string{"cycling"}, variants(bike("S", "black"))
+			p.Variants[0].Prices = map[string]Money{"EUR": {CurrencyCode: "EUR", Units: 1}}
+		}, false},
+		{"variant price in EUR", func(p *Product) {
+			p.Categories, p.Variants = []string{"cycling"}, variants(bike("S", "black"))
+			p.Variants[0].PriceUsd = &Money{CurrencyCode: "EUR", Units: 1}
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := valid
+			tt.change(&p)
+			err := validateProduct(p)
+			if (err == nil) != tt.valid {
+				t.Errorf("validateProduct() error = %v, want valid %v", err, tt.valid)
+			}
+			if err != nil && errors.Cause(err) != ErrInvalidProduct {
+				t.Errorf("validateProduct() error = %v, want %v", err, ErrInvalidProduct)
+			}
+		})
+	}
+}
+
+func bike(size, color string) map[string]string {
+	return map[string]string{"size": size, "color": color}
+}
+
+// variants numbers the variants with the given attributes.
+func variants(attrs ...map[string]string) []Variant {
+	vs := make([]Variant, len(attrs))
+	for i, a := range attrs {
+		vs[i] = Variant{Sku: "LAMP01-" + strconv.Itoa(i), Attributes: a}
+	}
+	return vs
+}
+
+func TestParseAmount(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Money
+		wantErr bool
+	}{
+		{"67.99", Money{CurrencyCode: "USD", Units: 67, Nanos: 990000000}, false},
+		{"12", Money{CurrencyCode: "USD", Units: 12}, false},
+		{" 0.000000001 ", Money{CurrencyCode: "USD", Nanos: 1}, false},
+		{"", Money{}, true},
+		{".5", Money{}, true},
+		{"-1.5", Money{}, true},
+		{"1,50", Money{}, true},
+		{"1.0000000001", Money{}, true},
+		{"99999999999999999999", Money{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseAmount(tt.in, "USD")
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseAmount(%q) = %v, %v, want %v, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+		if err == nil {
+			if back, _ := parseAmount(formatAmount(got), "USD"); back != got {
+				t.Errorf("formatAmount(%v) = %q does not parse back", got, formatAmount(got))
+			}
+		}
+	}
+	if got := formatAmount(Money{Units: 3, Nanos: 250000000}); got != "3.25" {
+		t.Errorf("formatAmount() = %q, want 3.25", got)
+	}
+}
+
+func TestAdminCatalog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "products.json")
+	b, err := embedded.ReadFile("products.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadCatalog(path); err != nil {
+		t.Fatal(err)
+	}
+	defer LoadCatalog(defaultConfig().CatalogPath)
+	before := len(ListProducts(context.Background()))
+
+	cfg := defaultConfig()
+	cfg.AdminPassword = "s3cret"
+	router := RegisterRouter(cfg)
+	do := func(method, target, contentType, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.SetBasicAuth("admin", "s3cret")
+		if contentType != "" {
+			r.Header.Set("Content-Type", contentType)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+	const (
+		jsonType = "application/json"
+		formType = "application/x-www-form-urlencoded"
+	)
+
+	lamp := `{"id":"LAMP01","name":"Desk Lamp","picture":"/static/img/products/typewriter.jpg","priceUsd":{"currencyCode":"USD","units":19,"nanos":500000000}}`
+	steps := []struct {
+		name, method, target, contentType, body string
+		wantCode                                int
+	}{
+		{"create", http.MethodPost, "/admin/products", jsonType, lamp, http.StatusCreated},
+		{"create twice", http.MethodPost, "/admin/products", jsonType, lamp, http.StatusConflict},
+		{"create invalid", http.MethodPost, "/admin/products", jsonType,
+			`{"id":"BAD","name":"Bad","picture":"/static/none.jpg","priceUsd":{"currencyCode":"USD","units":1,"nanos":-1}}`, http.StatusBadRequest},
+		{"create unknown field", http.MethodPost, "/admin/products", jsonType, `{"id":"X","price":1}`, http.StatusBadRequest},
+		{"create with form", http.MethodPost, "/admin/products", formType, url.Values{
+			"id": {"MUG01"}, "name": {"Mug"}, "price": {"8.5"}, "picture": {"/static/img/products/camp-mug.jpg"},
+			"categories": {"kitchen, camping"}, "weight_grams": {"300"},
+		}.Encode(), http.StatusSeeOther},
+		{"update", http.MethodPut, "/admin/products/LAMP01", jsonType,
+			`{"name":"Floor Lamp","picture":"/static/img/products/typewriter.jpg","priceUsd":{"currencyCode":"USD","units":49}}`, http.StatusOK},
+		{"update with form", http.MethodPost, "/admin/products/MUG01", formType, url.Values{
+			"name": {"Camp Mug"}, "price": {"9"}, "picture": {"/static/img/products/camp-mug.jpg"},
+			"name_de": {"Campingbecher"}, "description_ja": {" キャンプ用 "}, "name_tr": {" "},
+		}.Encode(), http.StatusSeeOther},
+		{"update missing", http.MethodPut, "/admin/products/NOPE", jsonType,
+			`{"name":"Nope","picture":"/static/img/products/typewriter.jpg","priceUsd":{"currencyCode":"USD","units":1}}`, http.StatusNotFound},
+		{"create with a taken sku", http.MethodPost, "/admin/products", jsonType,
+			`{"id":"BIKE02","name":"Bike","picture":"/static/img/products/city-bike.jpg","priceUsd":{"currencyCode":"USD","units":99},` +
+				`"categories":["cycling"],"variants":[{"sku":"9SIQT8TOJO-S-BK","attributes":{"size":"S","color":"black"}}]}`, http.StatusConflict},
+		{"create with the sku of a product", http.MethodPost, "/admin/products", jsonType,
+			`{"id":"BIKE02","name":"Bike","picture":"/static/img/products/city-bike.jpg","priceUsd":{"currencyCode":"USD","units":99},` +
+				`"categories":["cycling"],"variants":[{"sku":"LAMP01","attributes":{"size":"S","color":"black"}}]}`, http.StatusConflict},
+		{"update with form keeps the variants", http.MethodPost, "/admin/products/9SIQT8TOJO", formType, url.Values{
+			"name": {"Town Bike"}, "price": {"799"}, "picture": {"/static/img/products/city-bike.jpg"}, "categories": {"cycling"},
+		}.Encode(), http.StatusSeeOther},
+		{"update with form keeps the price list", http.MethodPost, "/admin/products/1YMWWN1N4O", formType, url.Values{
+			"name": {"Barista Kit"}, "price": {"119"}, "picture": {"/static/img/products/barista-kit.jpg"},
+		}.Encode(), http.StatusSeeOther},
+		{"variants page", http.MethodGet, "/admin/products/9SIQT8TOJO", "", "", http.StatusOK},
+		{"delete with form", http.MethodPost, "/admin/products/OLJCESPC7Z/delete", formType, "", http.StatusSeeOther},
+		{"delete missing", http.MethodDelete, "/admin/products/OLJCESPC7Z", jsonType, "", http.StatusNotFound},
+		{"edit page", http.MethodGet, "/admin/products/MUG01", "", "", http.StatusOK},
+		{"list page", http.MethodGet, "/admin/products", "", "", http.StatusOK},
+	}
+	for _, s := range steps {
+		if w := do(s.method, s.target, s.contentType, s.body); w.Code != s.wantCode {
+			t.Errorf("%s: %s %s code = %d, want %d: %s", s.name, s.method, s.target, w.Code, s.wantCode, w.Body.String())
+		}
+	}
+
+	p, err := GetProduct(context.Background(), "LAMP01")
+	if err != nil || p.Name != "Floor Lamp" || p.PriceUsd.Units != 49 {
+		t.Errorf("GetProduct(LAMP01) = %+v, %v", p, err)
+	}
+	if bike, err := GetProduct(context.Background(), "9SIQT8TOJO"); err != nil || bike.Name != "Town Bike" || len(bike.Variants) != 4 {
+		t.Errorf("GetProduct(9SIQT8TOJO) = %+v, %v, want the variants kept", bike, err)
+	}
+	if kit, err := GetProduct(context.Background(), "1YMWWN1N4O"); err != nil || kit.Prices["JPY"].Units != 17800 {
+		t.Errorf("GetProduct(1YMWWN1N4O) = %+v, %v, want the price list kept", kit, err)
+	}
+	if _, err := GetProduct(context.Background(), "OLJCESPC7Z"); errors.Cause(err) != ErrProductNotFound {
+		t.Errorf("deleted product is still served: %v", err)
+	}
+
+	// the changes are saved to the catalog file
+	if err := LoadCatalog(path); err != nil {
+		t.Fatal(err)
+	}
+	mug, err := GetProduct(context.Background(), "MUG01")
+	if err != nil {
+		t.Fatalf("product created with the form was not saved: %v", err)
+	}
+	want := Product{Id: "MUG01", Name: "Camp Mug", Picture: "/static/img/products/camp-mug.jpg",
+		PriceUsd:     Money{CurrencyCode: "USD", Units: 9},
+		Translations: map[string]ProductText{"de": {Name: "Campingbecher"}, "ja": {Description: "キャンプ用"}}}
+	if got, _ := json.Marshal(mug); string(got) != mustJSON(t, want) {
+		t.Errorf("saved product = %s, want %s", got, mustJSON(t, want))
+	}
+	if got := len(ListProducts(context.Background())); got != before+1 {
+		t.Errorf("%d products saved, want %d", got, before+1)
+	}
+}
+
+func TestCartDropsDeletedProducts(t *testing.T) {
+	defer LoadCatalog(defaultConfig().CatalogPath)
+	// change the catalog in memory only
+	catalogPath = ""
+	if err := DeleteProduct(context.Background(), "OLJCESPC7Z"); err != nil {
+		t.Fatal(err)
+	}
+	lines, _, err := cartLines(context.Background(), []CartItem{
+		{ProductId: "OLJCESPC7Z", Quantity: 1},
+		{ProductId: "66VCHSJNUP", Quantity: 2},
+	}, "USD")
+	if err != nil {
+		t.Fatalf("cartLines() error = %v", err)
+	}
+	if len(lines) != 1 || lines[0].Item.Id != "66VCHSJNUP" {
+		t.Errorf("cartLines() = %+v, want the camera lens only", lines)
+	}
+}
+
+func TestCheckoutSkipsDeletedProducts(t *testing.T) {
+	const session = "deleted-product-test"
+	defer LoadCatalog(defaultConfig().CatalogPath)
+	defer carts.EmptyCart(session)
+	catalogPath = ""
+	carts.AddItem(session, CartItem{ProductId: "OLJCESPC7Z", Quantity: 1})
+	carts.AddItem(session, CartItem{ProductId: "66VCHSJNUP", Quantity: 2})
+	if err := DeleteProduct(context.Background(), "OLJCESPC7Z"); err != nil {
+		t.Fatal(err)
+	}
+
+	router := RegisterRouter(defaultConfig())
+	do := func(method, target string, form url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(&http.Cookie{Name: cookieSessionID, Value: signCookie(cookieSessionID, session)})
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	w := do(http.MethodGet, "/cart?json=1", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /cart code = %d: %s", w.Code, w.Body.String())
+	}
+	var q cartQuote
+	if err := json.Unmarshal(w.Body.Bytes(), &q); err != nil {
+		t.Fatal(err)
+	}
+	if len(q.Items) != 1 || q.Items[0].Item.Id != "66VCHSJNUP" {
+		t.Errorf("cart lines = %+v, want the camera lens only", q.Items)
+	}
+
+	deleted, _ := inventory.Available("OLJCESPC7Z")
+	lens, _ := inventory.Available("66VCHSJNUP")
+	w = do(http.MethodPost, "/cart/checkout", checkoutForm())
+	if w.Code != http.StatusOK {
+		t.Fatalf("checkout code = %d: %s", w.Code, w.Body.String())
+	}
+	if got, _ := inventory.Available("OLJCESPC7Z"); got != deleted {
+		t.Errorf("deleted product stock = %d, want %d", got, deleted)
+	}
+	if got, _ := inventory.Available("66VCHSJNUP"); got != lens-2 {
+		t.Errorf("camera lens stock = %d, want %d", got, lens-2)
+	}
+}
+
+func mustJSON(t *testing.T, v interface{}) string {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
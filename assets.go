@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/go-chi/chi"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	assetsPrefix = "/static/"
+	// assetHashLen is the number of hex digits of the content hash in the
+	// fingerprinted file names, e.g. typewriter.3f2a1b9c0d.jpg.
+	assetHashLen = 10
+
+	// Fingerprinted URLs change with the content, so they are cached for a
+	// year, the other URLs are revalidated with their ETag.
+	cacheImmutable  = "public, max-age=31536000, immutable"
+	cacheRevalidate = "no-cache"
+
+	// minCompressSize is the size under which compressing is not worth it.
+	minCompressSize = 1 << 10
+)
+
+// asset is a static file with its fingerprint and compressed content.
+type asset struct {
+	hash        string
+	contentType string
+	modTime     time.Time
+	size        int64
+	// gzip and br are nil when the content does not compress well.
+	gzip, br []byte
+}
+
+// assetStore serves the static files, from disk or embedded. Files are
+// fingerprinted and compressed on start, files added or changed later, e.g.
+// uploaded pictures, when they are requested.
+type assetStore struct {
+	fsys fs.FS
+
+	mu     sync.RWMutex
+	assets map[string]*asset
+}
+
+var assets = newAssetStore(contentFS("", "static"))
+
+func newAssetStore(fsys fs.FS) *assetStore {
+	return &assetStore{fsys: fsys, assets: map[string]*asset{}}
+}
+
+// LoadAssets fingerprints and compresses the files of the static directory,
+// or the embedded ones when it is empty. It must be called before serving
+// requests.
+func LoadAssets(dir string) error {
+	s := newAssetStore(contentFS(dir, "static"))
+	n := 0
+	err := fs.WalkDir(s.fsys, ".", func(rel string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+		if _, err := s.lookup(rel); err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "could not load the static files")
+	}
+	assets = s
+	log.Info().Int("files", n).Msg("static files fingerprinted")
+	return nil
+}
+
+// lookup returns the asset of the file, slash separated and relative to the
+// static directory. The asset is loaded again when the file changed.
+// Directories and hidden files are not found.
+func (s *assetStore) lookup(rel string) (*asset, error) {
+	rel = strings.TrimPrefix(path.Clean("/"+rel), "/")
+	if rel == "" || strings.HasPrefix(path.Base(rel), ".") {
+		return nil, os.ErrNotExist
+	}
+	fi, err := fs.Stat(s.fsys, rel)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, os.ErrNotExist
+	}
+
+	s.mu.RLock()
+	a := s.assets[rel]
+	s.mu.RUnlock()
+	if a != nil && a.modTime.Equal(fi.ModTime()) && a.size == fi.Size() {
+		return a, nil
+	}
+	if a, err = s.load(rel, fi); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.assets[rel] = a
+	s.mu.Unlock()
+	return a, nil
+}
+
+func (s *assetStore) load(rel string, fi fs.FileInfo) (*asset, error) {
+	b, err := fs.ReadFile(s.fsys, rel)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read %s", rel)
+	}
+	sum := sha256.Sum256(b)
+	a := &asset{
+		hash:        hex.EncodeToString(sum[:])[:assetHashLen],
+		contentType: mime.TypeByExtension(path.Ext(rel)),
+		modTime:     fi.ModTime(),
+		size:        fi.Size(),
+	}
+	if a.contentType == "" {
+		a.contentType = http.DetectContentType(b)
+	}
+	if len(b) >= minCompressSize && compressible(a.contentType) {
+		var gz, br bytes.Buffer
+		gw, _ := gzip.NewWriterLevel(&gz, gzip.BestCompression)
+		gw.Write(b)
+		gw.Close()
+		bw := brotli.NewWriterLevel(&br, brotli.BestCompression)
+		bw.Write(b)
+		bw.Close()
+		// keep the compressed content when it saves at least a tenth
+		if gz.Len() < len(b)*9/10 {
+			a.gzip = gz.Bytes()
+		}
+		if br.Len() < len(b)*9/10 {
+			a.br = br.Bytes()
+		}
+	}
+	return a, nil
+}
+
+// compressible reports whether the content type is text, images such as
+// JPEG are compressed already.
+func compressible(contentType string) bool {
+	ct, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case strings.HasPrefix(ct, "text/"), strings.HasSuffix(ct, "+xml"), strings.HasSuffix(ct, "+json"):
+		return true
+	}
+	switch ct {
+	case "application/javascript", "application/json", "application/xml", "application/wasm":
+		return true
+	}
+	return false
+}
+
+// URL returns the fingerprinted URL of the /static/ URL, other URLs and
+// missing files are returned as is.
+func (s *assetStore) URL(u string) string {
+	rel := strings.TrimPrefix(u, assetsPrefix)
+	if rel == u {
+		return u
+	}
+	a, err := s.lookup(rel)
+	if err != nil {
+		return u
+	}
+	ext := path.Ext(rel)
+	return assetsPrefix + strings.TrimSuffix(rel, ext) + "." + a.hash + ext
+}
+
+// splitFingerprint returns the file name without the fingerprint and the
+// fingerprint, which is empty when the name has none.
+func splitFingerprint(rel string) (string, string) {
+	ext := path.Ext(rel)
+	stem := strings.TrimSuffix(rel, ext)
+	i := strings.LastIndexByte(stem, '.')
+	if i < 0 || len(stem)-i-1 != assetHashLen {
+		return rel, ""
+	}
+	hash := stem[i+1:]
+	if _, err := hex.DecodeString(hash); err != nil {
+		return rel, ""
+	}
+	return stem[:i] + ext, hash
+}
+
+// ServeHTTP serves the file of the /static/* route, compressed when the
+// client accepts it. A fingerprinted URL is cached for good when the
+// fingerprint matches the content, an outdated one serves the current
+// content like the plain URL does.
+func (s *assetStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rel := chi.URLParam(r, "*")
+	plain, hash := splitFingerprint(rel)
+	a, err := s.lookup(plain)
+	if err != nil && hash != "" {
+		// a file named like a fingerprinted one
+		plain, hash = rel, ""
+		a, err = s.lookup(plain)
+	}
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", a.contentType)
+	h.Set("X-Content-Type-Options", "nosniff")
+	if hash != "" && hash == a.hash {
+		h.Set("Cache-Control", cacheImmutable)
+	} else {
+		h.Set("Cache-Control", cacheRevalidate)
+	}
+	if a.gzip != nil || a.br != nil {
+		h.Add("Vary", "Accept-Encoding")
+	}
+
+	switch {
+	case a.br != nil && acceptsEncoding(r, "br"):
+		h.Set("Content-Encoding", "br")
+		h.Set("ETag", `"`+a.hash+`-br"`)
+		http.ServeContent(w, r, "", a.modTime, bytes.NewReader(a.br))
+	case a.gzip != nil && acceptsEncoding(r, "gzip"):
+		h.Set("Content-Encoding", "gzip")
+		h.Set("ETag", `"`+a.hash+`-gz"`)
+		http.ServeContent(w, r, "", a.modTime, bytes.NewReader(a.gzip))
+	default:
+		f, err := s.fsys.Open(strings.TrimPrefix(path.Clean("/"+plain), "/"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer f.Close()
+		// both the files on disk and the embedded ones can seek
+		content, ok := f.(io.ReadSeeker)
+		if !ok {
+			http.Error(w, "static file can not be served", http.StatusInternalServerError)
+			return
+		}
+		h.Set("ETag", `"`+a.hash+`"`)
+		http.ServeContent(w, r, "", a.modTime, content)
+	}
+}
+
+// acceptsEncoding reports whether the Accept-Encoding header of the request
+// lists the encoding without a zero quality.
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	for _, v := range r.Header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(v, ",") {
+			params := strings.Split(part, ";")
+			if strings.TrimSpace(params[0]) != encoding {
+				continue
+			}
+			for _, p := range params[1:] {
+				q := strings.TrimSpace(p)
+				if !strings.HasPrefix(q, "q=") {
+					continue
+				}
+				if f, err := strconv.ParseFloat(q[2:], 64); err == nil && f == 0 {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
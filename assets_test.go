@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+func newTestAssetStore(t *testing.T) (*assetStore, string, http.Handler) {
+	t.Helper()
+	dir := t.TempDir()
+	files := map[string][]byte{
+		"css/shop.css":          bytes.Repeat([]byte("body { margin: 0; }\n"), 200),
+		"css/tiny.css":          []byte("p { color: red; }"),
+		"img/lamp.jpg":          bytes.Repeat([]byte{0xff, 0xd8, 0xff}, 1000),
+		"img/.secret":           []byte("hidden"),
+		"img/name.0123456789ab": []byte("not a fingerprint"),
+	}
+	for name, b := range files {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := newAssetStore(os.DirFS(dir))
+	r := chi.NewRouter()
+	r.Get(assetsPrefix+"*", s.ServeHTTP)
+	return s, dir, r
+}
+
+func getAsset(h http.Handler, url string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, url, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestAssetURL(t *testing.T) {
+	s, _, _ := newTestAssetStore(t)
+	a, err := s.lookup("css/shop.css")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]string{
+		"/static/css/shop.css":     "/static/css/shop." + a.hash + ".css",
+		"/static/css/missing.css":  "/static/css/missing.css",
+		"/static/img/.secret":      "/static/img/.secret",
+		"https://example.com/a.js": "https://example.com/a.js",
+		"/product/OLJCESPC7Z":      "/product/OLJCESPC7Z",
+	}
+	for in, want := range tests {
+		if got := s.URL(in); got != want {
+			t.Errorf("URL(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestServeAsset(t *testing.T) {
+	s, _, h := newTestAssetStore(t)
+	hashed := s.URL("/static/css/shop.css")
+
+	tests := []struct {
+		name     string
+		url      string
+		header   []string
+		code     int
+		cache    string
+		encoding string
+	}{
+		{"fingerprinted", hashed, nil, http.StatusOK, cacheImmutable, ""},
+		{"plain", "/static/css/shop.css", nil, http.StatusOK, cacheRevalidate, ""},
+		{"outdated fingerprint", "/static/css/shop.0000000000.css", nil, http.StatusOK, cacheRevalidate, ""},
+		{"brotli", hashed, []string{"Accept-Encoding", "gzip, deflate, br"}, http.StatusOK, cacheImmutable, "br"},
+		{"gzip", hashed, []string{"Accept-Encoding", "gzip, br;q=0"}, http.StatusOK, cacheImmutable, "gzip"},
+		{"tiny file", "/static/css/tiny.css", []string{"Accept-Encoding", "gzip, br"}, http.StatusOK, cacheRevalidate, ""},
+		{"jpeg", "/static/img/lamp.jpg", []string{"Accept-Encoding", "gzip, br"}, http.StatusOK, cacheRevalidate, ""},
+		{"hex named file", "/static/img/name.0123456789ab", nil, http.StatusOK, cacheRevalidate, ""},
+		{"directory", "/static/css/", nil, http.StatusNotFound, "", ""},
+		{"root", "/static/", nil, http.StatusNotFound, "", ""},
+		{"hidden file", "/static/img/.secret", nil, http.StatusNotFound, "", ""},
+		{"missing", "/static/css/missing.css", nil, http.StatusNotFound, "", ""},
+		{"traversal", "/static/../assets_test.go", nil, http.StatusNotFound, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := getAsset(h, tt.url, tt.header...)
+			if w.Code != tt.code {
+				t.Fatalf("code = %d, want %d", w.Code, tt.code)
+			}
+			if tt.code != http.StatusOK {
+				return
+			}
+			if got := w.Header().Get("Cache-Control"); got != tt.cache {
+				t.Errorf("Cache-Control = %q, want %q", got, tt.cache)
+			}
+			if got := w.Header().Get("Content-Encoding"); got != tt.encoding {
+				t.Errorf("Content-Encoding = %q, want %q", got, tt.encoding)
+			}
+			if w.Header().Get("ETag") == "" {
+				t.Error("no ETag")
+			}
+			if got := w.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+				t.Errorf("X-Content-Type-Options = %q", got)
+			}
+		})
+	}
+
+	w := getAsset(h, "/static/css/shop.css")
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/css") {
+		t.Errorf("Content-Type = %q, want text/css", ct)
+	}
+	if vary := w.Header().Get("Vary"); vary != "Accept-Encoding" {
+		t.Errorf("Vary = %q, want Accept-Encoding", vary)
+	}
+	if w := getAsset(h, "/static/css/shop.css", "If-None-Match", w.Header().Get("ETag")); w.Code != http.StatusNotModified {
+		t.Errorf("revalidation code = %d, want %d", w.Code, http.StatusNotModified)
+	}
+}
+
+func TestAssetChanged(t *testing.T) {
+	s, dir, h := newTestAssetStore(t)
+	old := s.URL("/static/css/tiny.css")
+
+	file := filepath.Join(dir, "css", "tiny.css")
+	if err := ioutil.WriteFile(file, []byte("p { color: blue; }"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// the size is the same, the modification time tells the change
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(file, later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := s.URL("/static/css/tiny.css"); got == old {
+		t.Errorf("URL = %q after the change, want a new fingerprint", got)
+	}
+	w := getAsset(h, old)
+	if w.Code != http.StatusOK || w.Body.String() != "p { color: blue; }" {
+		t.Errorf("outdated URL code = %d, body %q", w.Code, w.Body)
+	}
+	if got := w.Header().Get("Cache-Control"); got != cacheRevalidate {
+		t.Errorf("outdated URL Cache-Control = %q, want %q", got, cacheRevalidate)
+	}
+}
+
+func TestSplitFingerprint(t *testing.T) {
+	tests := []struct {
+		in, name, hash string
+	}{
+		{"css/shop.0123456789.css", "css/shop.css", "0123456789"},
+		{"css/shop.css", "css/shop.css", ""},
+		{"css/shop.min.css", "css/shop.min.css", ""},
+		{"css/shop.012345678z.css", "css/shop.012345678z.css", ""},
+		{"LICENSE", "LICENSE", ""},
+		{"img/name.0123456789ab", "img/name.0123456789ab", ""},
+	}
+	for _, tt := range tests {
+		if name, hash := splitFingerprint(tt.in); name != tt.name || hash != tt.hash {
+			t.Errorf("splitFingerprint(%q) = %q, %q, want %q, %q", tt.in, name, hash, tt.name, tt.hash)
+		}
+	}
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, gzip;q=0.5", true},
+		{"gzip;q=0", false},
+		{"gzip; q=0.000", false},
+		{"gzip;q=0.01", true},
+		{"x-gzip", false},
+		{"*", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.header != "" {
+			r.Header.Set("Accept-Encoding", tt.header)
+		}
+		if got := acceptsEncoding(r, "gzip"); got != tt.want {
+			t.Errorf("acceptsEncoding(%q, gzip) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
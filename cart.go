@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// maxLineQuantity is the largest quantity of a cart line.
+const maxLineQuantity = 10
+
+var ErrLineQuantity = errors.New("quantity exceeds the limit of a cart line")
+
+// CartItem is a product with the quantity put in the cart.
+type CartItem struct {
+	ProductId string `json:"productId"`
+	// VariantSku is the variant of the product, empty for products without
+	// variants.
+	VariantSku string `json:"variantSku,omitempty"`
+	Quantity   int    `json:"quantity"`
+}
+
+// SKU returns the stock keeping unit of the item: the variant, or else the
+// product.
+func (it CartItem) SKU() string {
+	if it.VariantSku != "" {
+		return it.VariantSku
+	}
+	return it.ProductId
+}
+
+// cartStore keeps shopping carts per session in memory.
+type cartStore struct {
+	mu      sync.Mutex
+	carts   map[string][]CartItem
+	coupons map[string]string
+}
+
+var carts = newCartStore()
+
+func newCartStore() *cartStore {
+	return &cartStore{carts: map[string][]CartItem{}, coupons: map[string]string{}}
+}
+
+// AddItem puts the item into the session cart, merging quantities with an
+// existing line of the same product variant.
+func (s *cartStore) AddItem(sessionID string, item CartItem) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	items := s.carts[sessionID]
+	for i := range items {
+		if items[i].ProductId == item.ProductId && items[i].VariantSku == item.VariantSku {
+			items[i].Quantity += item.Quantity
+			return
+		}
+	}
+	s.carts[sessionID] = append(items, item)
+}
+
+// GetCart returns a copy of the session cart.
+func (s *cartStore) GetCart(sessionID string) []CartItem {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]CartItem(nil), s.carts[sessionID]...)
+}
+
+// EmptyCart removes all items from the session cart.
+func (s *cartStore) EmptyCart(sessionID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.carts, sessionID)
+	delete(s.coupons, sessionID)
+}
+
+// SetCoupon sets the coupon code entered for the session cart, an empty
+// code removes the coupon.
+func (s *cartStore) SetCoupon(sessionID, code string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if code == "" {
+		delete(s.coupons, sessionID)
+		return
+	}
+	s.coupons[sessionID] = code
+}
+
+// GetCoupon returns the coupon code entered for the session cart.
+func (s *cartStore) GetCoupon(sessionID string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.coupons[sessionID]
+}
+
+// Ping reports whether the store can serve requests.
+func (s *cartStore) Ping() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.carts == nil {
+		return errors.New("cart store is not initialized")
+	}
+	return nil
+}
+
+// cartSize returns the total quantity of items in the cart.
+func cartSize(items []CartItem) int {
+	n := 0
+	for _, it := range items {
+		n += it.Quantity
+	}
+	return n
+}
+
+// cartLines prices the cart items in the given currency and returns the
+// order lines together with their subtotal. The products are in the locale
+// of the request.
+func cartLines(ctx context.Context, items []CartItem, currency string) ([]OrderItem, Money, error) {
+	lang := requestLocale(ctx).tag.String()
+	lines := make([]OrderItem, 0, len(items))
+	subtotal := Money{CurrencyCode: currency}
+	for _, it := range items {
+		p, err := GetProduct(ctx, it.ProductId)
+		if errors.Cause(err) == ErrProductNotFound {
+			// removed from the catalog since it was added to the cart
+			continue
+		}
+		if err != nil {
+			return nil, Money{}, errors.Wrapf(err, "could not retrieve product #%s", it.ProductId)
+		}
+		v, err := p.FindVariant(it.VariantSku)
+		if err != nil {
+			// the variants changed since it was added to the cart
+			continue
+		}
+		cost := MultiplySlow(p.PriceIn(v, currency), uint32(it.Quantity))
+		if subtotal, err = Sum(subtotal, cost); err != nil {
+			return nil, Money{}, errors.Wrap(err, "could not sum cart")
+		}
+		lines = append(lines, OrderItem{Item: p.Localized(lang), Variant: v, Quantity: it.Quantity, Cost: cost, Discount: Money{CurrencyCode: currency}})
+	}
+	return lines, subtotal, nil
+}
+
+// cartQuote is the cart priced in the user currency.
+type cartQuote struct {
+	Items     []OrderItem  `json:"items"`
+	Subtotal  Money        `json:"subtotal"`
+	Discounts []Discount   `json:"discounts,omitempty"`
+	Shipping  Money        `json:"shipping"`
+	Tax       TaxBreakdown `json:"tax"`
+	Total     Money        `json:"total"`
+	// Coupon is the entered coupon code, CouponError explains why it could
+	// not be applied.
+	Coupon      string `json:"coupon,omitempty"`
+	CouponError string `json:"couponError,omitempty"`
+}
+
+// CartItems returns the priced lines of the cart, without the products and
+// variants removed from the catalog since they were added.
+func (q cartQuote) CartItems() []CartItem {
+	return cartItems(q.Items)
+}
+
+// quoteCart prices the cart for shipping to the address. An empty address
+// gives an estimate for the default shipping zone and tax jurisdiction.
+func quoteCart(ctx context.Context, items []CartItem, coupon string, addr Address, currency string) (cartQuote, error) {
+	var (
+		q   = cartQuote{Coupon: coupon}
+		err error
+	)
+	if q.Items, q.Subtotal, err = cartLines(ctx, items, currency); err != nil {
+		return cartQuote{}, err
+	}
+	discounts, err := promotions.Apply(q.Items, coupon, currency, time.Now())
+	if err != nil {
+		if !isCouponError(err) {
+			return cartQuote{}, errors.Wrap(err, "could not apply promotions")
+		}
+		q.CouponError = err.Error()
+	}
+	q.Discounts = discounts
+	if q.Shipping, err = QuoteShipping(addr, q.Items, currency); err != nil {
+		return cartQuote{}, errors.Wrap(err, "could not quote shipping")
+	}
+	if q.Tax, err = CalculateTax(addr, q.Items, currency); err != nil {
+		return cartQuote{}, errors.Wrap(err, "could not calculate tax")
+	}
+
+	if q.Total, err = Sum(q.Subtotal, q.Shipping); err != nil {
+		return cartQuote{}, errors.Wrap(err, "could not calculate the total")
+	}
+	for _, d := range q.Discounts {
+		if q.Total, err = Sum(q.Total, Negate(d.Amount)); err != nil {
+			return cartQuote{}, errors.Wrap(err, "could not calculate the total")
+		}
+	}
+	if !q.Tax.Inclusive {
+		if q.Total, err = Sum(q.Total, q.Tax.Total); err != nil {
+			return cartQuote{}, errors.Wrap(err, "could not calculate the total")
+		}
+	}
+	return q, nil
+}
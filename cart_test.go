@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// checkoutForm is a valid checkout of the cart.
+func checkoutForm() url.Values {
+	return url.Values{
+		"email":                        {"someone@example.com"},
+		"street_address":               {"1600 Amphitheatre Parkway"},
+		"zip_code":                     {"94043"},
+		"city":                         {"Mountain View"},
+		"country":                      {"United States"},
+		"credit_card_number":           {"4432-8015-6152-0454"},
+		"credit_card_expiration_month": {"1"},
+		"credit_card_expiration_year":  {strconv.Itoa(time.Now().Year() + 1)},
+		"credit_card_cvv":              {"672"},
+	}
+}
+
+func TestCartVariants(t *testing.T) {
+	const session = "variants-test"
+	defer carts.EmptyCart(session)
+	router := RegisterRouter(defaultConfig())
+	do := func(method, target string, form url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(&http.Cookie{Name: cookieSessionID, Value: signCookie(cookieSessionID, session)})
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+	add := func(pid, sku string, quantity string) int {
+		return do(http.MethodPost, "/cart", url.Values{"product_id": {pid}, "variant_sku": {sku}, "quantity": {quantity}}).Code
+	}
+
+	tests := []struct {
+		name, pid, sku, quantity string
+		want                     int
+	}{
+		{"no variant", "9SIQT8TOJO", "", "1", http.StatusBadRequest},
+		{"unknown variant", "9SIQT8TOJO", "9SIQT8TOJO-XL-BK", "1", http.StatusBadRequest},
+		{"variant of another product", "9SIQT8TOJO", "LS4PSXUNUM-SV", "1", http.StatusBadRequest},
+		{"variant of a product without variants", "OLJCESPC7Z", "9SIQT8TOJO-S-BK", "1", http.StatusBadRequest},
+		{"variant out of stock", "9SIQT8TOJO", "9SIQT8TOJO-M-GN", "1", http.StatusConflict},
+		{"variant", "9SIQT8TOJO", "9SIQT8TOJO-S-BK", "1", http.StatusFound},
+		{"same variant", "9SIQT8TOJO", "9SIQT8TOJO-S-BK", "1", http.StatusFound},
+		{"more than the variant stock", "9SIQT8TOJO", "9SIQT8TOJO-S-BK", "1", http.StatusConflict},
+		{"other variant", "9SIQT8TOJO", "9SIQT8TOJO-L-BK", "1", http.StatusFound},
+		{"product without variants", "OLJCESPC7Z", "", "1", http.StatusFound},
+	}
+	for _, tt := range tests {
+		if got := add(tt.pid, tt.sku, tt.quantity); got != tt.want {
+			t.Errorf("%s: add to cart code = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	w := do(http.MethodGet, "/cart?json=1", nil)
+	var q cartQuote
+	if err := json.Unmarshal(w.Body.Bytes(), &q); err != nil {
+		t.Fatalf("cart JSON: %v: %s", err, w.Body.String())
+	}
+	want := []struct {
+		sku      string
+		quantity int
+		cost     Money
+	}{
+		{"9SIQT8TOJO-S-BK", 2, Money{CurrencyCode: "USD", Units: 1579}},
+		{"9SIQT8TOJO-L-BK", 1, Money{CurrencyCode: "USD", Units: 829, Nanos: 500000000}},
+		{"OLJCESPC7Z", 1, Money{CurrencyCode: "USD", Units: 67, Nanos: 990000000}},
+	}
+	if len(q.Items) != len(want) {
+		t.Fatalf("cart has %d lines, want %d: %+v", len(q.Items), len(want), q.Items)
+	}
+	for i, w := range want {
+		if got := q.Items[i]; got.SKU() != w.sku || got.Quantity != w.quantity || got.Cost != w.cost {
+			t.Errorf("line %d = %s x %d for %v, want %s x %d for %v", i, got.SKU(), got.Quantity, got.Cost, w.sku, w.quantity, w.cost)
+		}
+	}
+
+	if body := do(http.MethodGet, "/cart", nil).Body.String(); !strings.Contains(body, "Color: black, Size: L") {
+		t.Error("cart page does not show the variant attributes")
+	}
+	if body := do(http.MethodGet, "/product/9SIQT8TOJO", nil).Body.String(); !strings.Contains(body, `<option value="9SIQT8TOJO-M-GN" disabled>`) {
+		t.Error("product page does not disable the variant out of stock")
+	}
+}
+
+func TestCartLineQuantityLimit(t *testing.T) {
+	const session = "quantity-test"
+	defer carts.EmptyCart(session)
+	router := RegisterRouter(defaultConfig())
+	add := func(quantity string) int {
+		form := url.Values{"product_id": {"66VCHSJNUP"}, "quantity": {quantity}}
+		r := httptest.NewRequest(http.MethodPost, "/cart", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(&http.Cookie{Name: cookieSessionID, Value: signCookie(cookieSessionID, session)})
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	tests := []struct {
+		name, quantity string
+		want           int
+	}{
+		{"zero", "0", http.StatusBadRequest},
+		{"over the limit", "11", http.StatusBadRequest},
+		{"overflowing", "4294967297", http.StatusBadRequest},
+		{"limit", "10", http.StatusFound},
+		{"over the limit with the cart", "1", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if got := add(tt.quantity); got != tt.want {
+			t.Errorf("%s: add to cart code = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+	if items := carts.GetCart(session); len(items) != 1 || items[0].Quantity != maxLineQuantity {
+		t.Errorf("cart = %+v, want a line of %d", items, maxLineQuantity)
+	}
+}
+
+func TestCheckoutSkipsRemovedVariants(t *testing.T) {
+	const session = "removed-variant-test"
+	defer LoadCatalog(defaultConfig().CatalogPath)
+	defer carts.EmptyCart(session)
+	catalogPath = ""
+	carts.AddItem(session, CartItem{ProductId: "9SIQT8TOJO", VariantSku: "9SIQT8TOJO-S-BK", Quantity: 1})
+	carts.AddItem(session, CartItem{ProductId: "9SIQT8TOJO", VariantSku: "9SIQT8TOJO-L-BK", Quantity: 1})
+	found, err := GetProduct(context.Background(), "9SIQT8TOJO")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := *found
+	var variants []Variant
+	for _, v := range p.Variants {
+		if v.Sku != "9SIQT8TOJO-S-BK" {
+			variants = append(variants, v)
+		}
+	}
+	p.Variants = variants
+	if err := UpdateProduct(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+
+	router := RegisterRouter(defaultConfig())
+	do := func(method, target string, form url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(&http.Cookie{Name: cookieSessionID, Value: signCookie(cookieSessionID, session)})
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	w := do(http.MethodGet, "/cart?json=1", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /cart code = %d: %s", w.Code, w.Body.String())
+	}
+	var q cartQuote
+	if err := json.Unmarshal(w.Body.Bytes(), &q); err != nil {
+		t.Fatal(err)
+	}
+	if len(q.Items) != 1 || q.Items[0].SKU() != "9SIQT8TOJO-L-BK" {
+		t.Errorf("cart lines = %+v, want the large black one only", q.Items)
+	}
+
+	removed, _ := inventory.Available("9SIQT8TOJO-S-BK")
+	large, _ := inventory.Available("9SIQT8TOJO-L-BK")
+	if w := do(http.MethodPost, "/cart/checkout", checkoutForm()); w.Code != http.StatusOK {
+		t.Fatalf("checkout code = %d: %s", w.Code, w.Body.String())
+	}
+	if got, _ := inventory.Available("9SIQT8TOJO-S-BK"); got != removed {
+		t.Errorf("removed variant stock = %d, want %d", got, removed)
+	}
+	if got, _ := inventory.Available("9SIQT8TOJO-L-BK"); got != large-1 {
+		t.Errorf("large variant stock = %d, want %d", got, large-1)
+	}
+}
+
+func TestCurrentCurrency(t *testing.T) {
+	saved := rates
+	defer func() { rates = saved }()
+	rates = map[string]float64{"EUR": 1, "USD": 1.1, "XXX": 2}
+
+	for _, tt := range []struct{ cookie, want string }{
+		{"", "USD"},
+		{"EUR", "EUR"},
+		{"XXX", "USD"},
+		{"GBP", "USD"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: cookieCurrency, Value: tt.cookie})
+		}
+		if got := currentCurrency(r); got != tt.want {
+			t.Errorf("currentCurrency() with %q = %s, want %s", tt.cookie, got, tt.want)
+		}
+	}
+}
+
+func TestCheckoutIgnoresUnpricedCurrency(t *testing.T) {
+	const session = "unpriced-currency-test"
+	defer carts.EmptyCart(session)
+	carts.AddItem(session, CartItem{ProductId: "66VCHSJNUP", Quantity: 1})
+
+	r := httptest.NewRequest(http.MethodPost, "/cart/checkout", strings.NewReader(checkoutForm().Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(&http.Cookie{Name: cookieSessionID, Value: signCookie(cookieSessionID, session)})
+	r.AddCookie(&http.Cookie{Name: cookieCurrency, Value: "XXX"})
+	w := httptest.NewRecorder()
+	RegisterRouter(defaultConfig()).ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("checkout code = %d: %s", w.Code, w.Body.String())
+	}
+	if body := w.Body.String(); strings.Contains(body, "XXX") {
+		t.Errorf("order is priced in the unknown currency: %s", body)
+	}
+}
+
+func TestCheckoutEmail(t *testing.T) {
+	const session = "checkout-email-test"
+	defer carts.EmptyCart(session)
+	router := RegisterRouter(defaultConfig())
+
+	tests := []struct {
+		email    string
+		wantCode int
+	}{
+		{"not an address", http.StatusBadRequest},
+		{"jane@example.com\r\nBcc: all@example.com", http.StatusBadRequest},
+		{"Jane <jane@example.com>", http.StatusOK},
+	}
+	for _, tt := range tests {
+		carts.AddItem(session, CartItem{ProductId: "66VCHSJNUP", Quantity: 1})
+		form := checkoutForm()
+		form.Set("email", tt.email)
+		r := httptest.NewRequest(http.MethodPost, "/cart/checkout", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(&http.Cookie{Name: cookieSessionID, Value: signCookie(cookieSessionID, session)})
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != tt.wantCode {
+			t.Errorf("checkout with %q code = %d, want %d", tt.email, w.Code, tt.wantCode)
+		}
+	}
+
+	var emails []string
+	orders.mu.RLock()
+	for _, o := range orders.orders {
+		if o.SessionId == session {
+			emails = append(emails, o.Email)
+		}
+	}
+	orders.mu.RUnlock()
+	if len(emails) != 1 || emails[0] != `"Jane" <jane@example.com>` {
+		t.Errorf("order emails = %q, want the parsed address only", emails)
+	}
+}
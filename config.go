@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caarlos0/env"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	logFormatConsole = "console"
+	logFormatJSON    = "json"
+
+	// minCookieKeyLen is the minimum length of a cookie signing key.
+	minCookieKeyLen = 32
+	redacted        = "REDACTED"
+)
+
+// config is the server configuration. Values are taken from the defaults,
+// then the YAML file, then the environment and then the command line flags,
+// each one overriding the previous.
+type config struct {
+	Host string `yaml:"host" env:"HOST"`
+	Port int    `yaml:"port" env:"PORT"`
+
+	ReadTimeout       time.Duration `yaml:"read_timeout" env:"READ_TIMEOUT"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout" env:"READ_HEADER_TIMEOUT"`
+	WriteTimeout      time.Duration `yaml:"write_timeout" env:"WRITE_TIMEOUT"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout" env:"IDLE_TIMEOUT"`
+	MaxHeaderBytes    int           `yaml:"max_header_bytes" env:"MAX_HEADER_BYTES"`
+	// DrainPeriod is how long the server keeps serving with failing
+	// readiness after a termination signal, before it stops accepting
+	// connections.
+	DrainPeriod     time.Duration `yaml:"drain_period" env:"DRAIN_PERIOD"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"`
+
+	// TLSCertFile and TLSKeyFile enable HTTPS, the certificate is reloaded
+	// when the files change.
+	TLSCertFile string `yaml:"tls_cert_file" env:"TLS_CERT_FILE"`
+	TLSKeyFile  string `yaml:"tls_key_file" env:"TLS_KEY_FILE"`
+
+	// RatesSource is the URL of the ECB daily reference rates XML.
+	RatesSource          string        `yaml:"rates_source" env:"RATES_SOURCE"`
+	RatesRefreshInterval time.Duration `yaml:"rates_refresh_interval" env:"RATES_REFRESH_INTERVAL"`
+
+	// CatalogPath, TemplatesDir and StaticDir load the catalog, the page
+	// templates and the static files from disk instead of the copies
+	// embedded in the binary. Catalog changes are saved to CatalogPath,
+	// templates are parsed again when they change and pictures can only be
+	// uploaded to StaticDir.
+	CatalogPath  string `yaml:"catalog_path" env:"CATALOG_PATH"`
+	TemplatesDir string `yaml:"templates_dir" env:"TEMPLATES_DIR"`
+	StaticDir    string `yaml:"static_dir" env:"STATIC_DIR"`
+	// ReviewsPath is the JSON file the product reviews are saved to, they
+	// are lost on restart when it is empty.
+	ReviewsPath string `yaml:"reviews_path" env:"REVIEWS_PATH"`
+	// CWebP is the cwebp tool generating the WebP pictures, which are not
+	// generated when it is empty or not found.
+	CWebP string `yaml:"cwebp" env:"CWEBP"`
+
+	// Currencies users can choose from, they must include USD.
+	Currencies []string `yaml:"currencies" env:"CURRENCIES" envSeparator:","`
+
+	// CookieKeys sign the session cookie. The first key signs new cookies,
+	// all of them are accepted so that keys can be rotated. A random key is
+	// used when none is set, sessions are lost on restart then.
+	CookieKeys []string `yaml:"cookie_keys" env:"COOKIE_KEYS" envSeparator:","`
+
+	// RateLimits replace the default limits of the route groups pages, api,
+	// checkout and admin, they can only be set in the file.
+	RateLimits map[string]RateLimitGroup `yaml:"rate_limits"`
+	// TrustedProxies are the addresses or CIDR ranges of the proxies whose
+	// X-Forwarded-For header is trusted.
+	TrustedProxies []string `yaml:"trusted_proxies" env:"TRUSTED_PROXIES" envSeparator:","`
+
+	// Webhooks are notified of the order and catalog events, they can only
+	// be set in the file. More can be registered with the admin API until
+	// the next restart.
+	Webhooks []Webhook `yaml:"webhooks"`
+	// WebhookDeadLetterPath is the JSON lines file the events which could
+	// not be delivered are appended to, they are only logged when it is
+	// empty.
+	WebhookDeadLetterPath string `yaml:"webhook_dead_letter_path" env:"WEBHOOK_DEAD_LETTER_PATH"`
+
+	// Mailer sends the order emails: log, file or smtp. The file mailer
+	// writes them to MailDir, the smtp one sends them to SMTPAddr, with
+	// SMTPUser and SMTPPassword when the server requires authentication.
+	Mailer       string `yaml:"mailer" env:"MAILER"`
+	MailFrom     string `yaml:"mail_from" env:"MAIL_FROM"`
+	MailDir      string `yaml:"mail_dir" env:"MAIL_DIR"`
+	SMTPAddr     string `yaml:"smtp_addr" env:"SMTP_ADDR"`
+	SMTPUser     string `yaml:"smtp_user" env:"SMTP_USER"`
+	SMTPPassword string `yaml:"smtp_password" env:"SMTP_PASSWORD"`
+
+	LogLevel  string `yaml:"log_level" env:"LOG_LEVEL"`
+	LogFormat string `yaml:"log_format" env:"LOG_FORMAT"`
+	// LogSampleBurst is how many debug and info lines the handlers log per
+	// second before only one out of LogSampleRate is kept, zero disables
+	// sampling.
+	LogSampleBurst int `yaml:"log_sample_burst" env:"LOG_SAMPLE_BURST"`
+	LogSampleRate  int `yaml:"log_sample_rate" env:"LOG_SAMPLE_RATE"`
+
+	// AdminUser and AdminPassword protect the /admin routes, which are
+	// disabled without a password.
+	AdminUser     string `yaml:"admin_user" env:"ADMIN_USER"`
+	AdminPassword string `yaml:"admin_password" env:"ADMIN_PASSWORD"`
+
+	BannerColor string `yaml:"banner_color" env:"BANNER_COLOR"`
+	// Flags override the default feature flags of the same name, they can
+	// only be set in the file.
+	Flags []FeatureFlag `yaml:"flags"`
+	// FlagOverrides allows to force flags with the X-Feature-Flags header,
+	// which is meant for testing.
+	FlagOverrides bool `yaml:"flag_overrides" env:"FLAG_OVERRIDES"`
+
+	// TracesExporter is one of none, stdout or otlp.
+	TracesExporter string `yaml:"traces_exporter" env:"TRACES_EXPORTER"`
+}
+
+func defaultConfig() config {
+	return config{
+		Port:                 3000,
+		ReadTimeout:          15 * time.Second,
+		ReadHeaderTimeout:    5 * time.Second,
+		WriteTimeout:         30 * time.Second,
+		IdleTimeout:          time.Minute,
+		MaxHeaderBytes:       64 << 10,
+		DrainPeriod:          5 * time.Second,
+		ShutdownTimeout:      10 * time.Second,
+		RatesSource:          defaultRatesSource,
+		RatesRefreshInterval: ratesRefreshInterval,
+		CWebP:                "cwebp",
+		Currencies:           append([]string(nil), defaultCurrencies...),
+		RateLimits:           defaultRateLimits(false),
+		Mailer:               mailerLog,
+		MailFrom:             defaultMailFrom,
+		LogLevel:             zerolog.InfoLevel.String(),
+		LogFormat:            logFormatConsole,
+		LogSampleBurst:       100,
+		LogSampleRate:        10,
+		AdminUser:            "admin",
+		BannerColor:          "green",
+		TracesExporter:       tracesExporterNone,
+	}
+}
+
+// Addr is the address the server listens on.
+func (c config) Addr() string {
+	return net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+}
+
+// bindFlags defines a flag for every config value but the secrets, which
+// should not show up in the process list.
+func (c *config) bindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Host, "host", c.Host, "`host` to listen on, all interfaces when empty")
+	fs.IntVar(&c.Port, "port", c.Port, "`port` to listen on")
+	fs.DurationVar(&c.ReadTimeout, "read-timeout", c.ReadTimeout, "maximum duration for reading a request")
+	fs.DurationVar(&c.ReadHeaderTimeout, "read-header-timeout", c.ReadHeaderTimeout, "maximum duration for reading the request headers")
+	fs.DurationVar(&c.WriteTimeout, "write-timeout", c.WriteTimeout, "maximum duration for writing a response")
+	fs.DurationVar(&c.IdleTimeout, "idle-timeout", c.IdleTimeout, "how long to keep idle connections open")
+	fs.IntVar(&c.MaxHeaderBytes, "max-header-bytes", c.MaxHeaderBytes, "maximum size of the request headers")
+	fs.DurationVar(&c.DrainPeriod, "drain-period", c.DrainPeriod, "how long to keep serving with failing readiness before shutting down")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "how long to wait for requests in flight on shutdown")
+	fs.StringVar(&c.TLSCertFile, "tls-cert-file", c.TLSCertFile, "TLS certificate `file`, enables HTTPS with --tls-key-file")
+	fs.StringVar(&c.TLSKeyFile, "tls-key-file", c.TLSKeyFile, "TLS private key `file`")
+	fs.StringVar(&c.RatesSource, "rates-source", c.RatesSource, "`URL` of the ECB daily reference rates")
+	fs.DurationVar(&c.RatesRefreshInterval, "rates-refresh-interval", c.RatesRefreshInterval, "how often to refresh the currency rates")
+	fs.StringVar(&c.CatalogPath, "catalog-path", c.CatalogPath, "product catalog JSON `file`, embedded when empty")
+	fs.StringVar(&c.TemplatesDir, "templates-dir", c.TemplatesDir, "`directory` of the page templates, embedded when empty")
+	fs.StringVar(&c.StaticDir, "static-dir", c.StaticDir, "`directory` of the static files, embedded when empty")
+	fs.StringVar(&c.ReviewsPath, "reviews-path", c.ReviewsPath, "product reviews JSON `file`, created when missing, in memory when empty")
+	fs.StringVar(&c.WebhookDeadLetterPath, "webhook-dead-letter-path", c.WebhookDeadLetterPath, "JSON lines `file` the undelivered webhook events are appended to")
+	fs.StringVar(&c.Mailer, "mailer", c.Mailer, "`mailer` of the order emails: log, file or smtp")
+	fs.StringVar(&c.MailFrom, "mail-from", c.MailFrom, "sender `address` of the emails")
+	fs.StringVar(&c.MailDir, "mail-dir", c.MailDir, "`directory` the file mailer writes the emails to")
+	fs.StringVar(&c.SMTPAddr, "smtp-addr", c.SMTPAddr, "`host:port` of the SMTP server")
+	fs.StringVar(&c.SMTPUser, "smtp-user", c.SMTPUser, "SMTP `user` name, no authentication when empty")
+	fs.StringVar(&c.CWebP, "cwebp", c.CWebP, "`path` of the cwebp tool generating the WebP pictures, empty to disable them")
+	fs.Var((*listFlag)(&c.Currencies), "currencies", "comma separated `list` of the supported currencies")
+	fs.Var((*listFlag)(&c.TrustedProxies), "trusted-proxies", "comma separated `list` of trusted proxy addresses or CIDR ranges")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "log `level`: debug, info, warn or error")
+	fs.StringVar(&c.LogFormat, "log-format", c.LogFormat, "log `format`: console or json")
+	fs.IntVar(&c.LogSampleBurst, "log-sample-burst", c.LogSampleBurst, "handler debug and info lines logged per second before sampling, 0 disables sampling")
+	fs.IntVar(&c.LogSampleRate, "log-sample-rate", c.LogSampleRate, "keep one out of `n` sampled handler lines")
+	fs.StringVar(&c.AdminUser, "admin-user", c.AdminUser, "admin `user` name")
+	fs.StringVar(&c.BannerColor, "banner-color", c.BannerColor, "banner CSS `color`")
+	fs.BoolVar(&c.FlagOverrides, "flag-overrides", c.FlagOverrides, "allow to force feature flags with the "+headerFeatureFlags+" header")
+	fs.StringVar(&c.TracesExporter, "traces-exporter", c.TracesExporter, "traces `exporter`: none, stdout or otlp")
+}
+
+// listFlag is a comma separated list flag.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(s string) error {
+	*l = splitList(s)
+	return nil
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// loadConfig builds the config from the defaults, the YAML file given with
+// the --config flag or CONFIG_FILE, the environment and the command line
+// arguments. It also reports whether --print-config was given.
+func loadConfig(args []string) (config, bool, error) {
+	var (
+		file        string
+		printConfig bool
+		flagged     = defaultConfig()
+		fs          = flag.NewFlagSet("kuberton-demo", flag.ContinueOnError)
+	)
+	fs.StringVar(&file, "config", os.Getenv("CONFIG_FILE"), "YAML configuration `file`")
+	fs.BoolVar(&printConfig, "print-config", false, "print the configuration with the secrets redacted and exit")
+	flagged.bindFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return config{}, false, err
+	}
+
+	cfg := defaultConfig()
+	// the default rate limits depend on the trusted proxies, they are added
+	// once those are known
+	cfg.RateLimits = nil
+	if file != "" {
+		if err := cfg.loadFile(file); err != nil {
+			return config{}, false, err
+		}
+	}
+	if err := env.Parse(&cfg); err != nil {
+		return config{}, false, errors.Wrap(err, "could not parse the environment")
+	}
+	// the flags were parsed before the file and the environment were
+	// loaded, set the ones given again on top of them
+	override := flag.NewFlagSet("", flag.ContinueOnError)
+	cfg.bindFlags(override)
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if o := override.Lookup(f.Name); o != nil && err == nil {
+			err = o.Value.Set(f.Value.String())
+		}
+	})
+	if err != nil {
+		return config{}, false, err
+	}
+	if cfg.RateLimits == nil {
+		cfg.RateLimits = map[string]RateLimitGroup{}
+	}
+	for name, g := range defaultRateLimits(len(cfg.TrustedProxies) > 0) {
+		if _, ok := cfg.RateLimits[name]; !ok {
+			cfg.RateLimits[name] = g
+		}
+	}
+
+	if err := cfg.validate(); err != nil {
+		return config{}, false, err
+	}
+	return cfg, printConfig, nil
+}
+
+// loadFile overrides the config with the values set in the YAML file.
+// Unknown keys are rejected so that typos do not go unnoticed.
+func (c *config) loadFile(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return errors.Wrap(err, "could not read the config file")
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && err != io.EOF {
+		return errors.Wrapf(err, "could not parse the config file %s", path)
+	}
+	return nil
+}
+
+// validate reports all the invalid values at once.
+func (c config) validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(c.Port > 0 && c.Port < 1<<16, "port %d is out of range", c.Port)
+	check(c.ReadTimeout >= 0, "read_timeout must not be negative")
+	check(c.ReadHeaderTimeout >= 0, "read_header_timeout must not be negative")
+	check(c.WriteTimeout >= 0, "write_timeout must not be negative")
+	check(c.IdleTimeout >= 0, "idle_timeout must not be negative")
+	check(c.MaxHeaderBytes >= 4<<10, "max_header_bytes must be at least 4096")
+	check(c.DrainPeriod >= 0, "drain_period must not be negative")
+	check(c.ShutdownTimeout >= 0, "shutdown_timeout must not be negative")
+	check((c.TLSCertFile == "") == (c.TLSKeyFile == ""), "tls_cert_file and tls_key_file must be set together")
+
+	u, err := url.Parse(c.RatesSource)
+	check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "",
+		"rates_source %q is not an HTTP URL", c.RatesSource)
+	check(c.RatesRefreshInterval >= time.Minute, "rates_refresh_interval must be at least a minute")
+
+	if c.CatalogPath != "" {
+		fi, err := os.Stat(c.CatalogPath)
+		check(err == nil && !fi.IsDir(), "catalog_path %q is not a file", c.CatalogPath)
+	}
+	if c.ReviewsPath != "" {
+		fi, err := os.Stat(filepath.Dir(c.ReviewsPath))
+		check(err == nil && fi.IsDir(), "reviews_path %q is not in a directory", c.ReviewsPath)
+	}
+	if c.WebhookDeadLetterPath != "" {
+		fi, err := os.Stat(filepath.Dir(c.WebhookDeadLetterPath))
+		check(err == nil && fi.IsDir(), "webhook_dead_letter_path %q is not in a directory", c.WebhookDeadLetterPath)
+	}
+	if c.TemplatesDir != "" {
+		fi, err := os.Stat(c.TemplatesDir)
+		check(err == nil && fi.IsDir(), "templates_dir %q is not a directory", c.TemplatesDir)
+	}
+	if c.StaticDir != "" {
+		fi, err := os.Stat(c.StaticDir)
+		check(err == nil && fi.IsDir(), "static_dir %q is not a directory", c.StaticDir)
+	}
+
+	seen := map[string]bool{}
+	for _, cur := range c.Currencies {
+		check(len(cur) == 3 && strings.ToUpper(cur) == cur, "currency %q is not an ISO 4217 code", cur)
+		check(!seen[cur], "currency %s is listed twice", cur)
+		seen[cur] = true
+	}
+	check(seen[defaultCurrency], "currencies must include %s", defaultCurrency)
+
+	for i, k := range c.CookieKeys {
+		check(len(k) >= minCookieKeyLen, "cookie key #%d is shorter than %d characters", i+1, minCookieKeyLen)
+	}
+
+	if err := validateRateLimits(c.RateLimits); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if _, err := parseTrustedProxies(c.TrustedProxies); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if err := validateWebhooks(c.Webhooks); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	switch c.Mailer {
+	case mailerLog:
+	case mailerFile:
+		fi, err := os.Stat(c.MailDir)
+		check(err == nil && fi.IsDir(), "mail_dir %q is not a directory", c.MailDir)
+	case mailerSMTP:
+		_, _, err := net.SplitHostPort(c.SMTPAddr)
+		check(err == nil, "smtp_addr %q is not a host:port address", c.SMTPAddr)
+	default:
+		check(false, "unknown mailer %q", c.Mailer)
+	}
+	_, err = mail.ParseAddress(c.MailFrom)
+	check(err == nil, "mail_from %q is not an email address", c.MailFrom)
+
+	_, err = zerolog.ParseLevel(c.LogLevel)
+	check(err == nil && c.LogLevel != "", "unknown log_level %q", c.LogLevel)
+	check(c.LogFormat == logFormatConsole || c.LogFormat == logFormatJSON, "unknown log_format %q", c.LogFormat)
+	check(c.LogSampleBurst >= 0, "log_sample_burst must not be negative")
+	check(c.LogSampleRate >= 1, "log_sample_rate must be at least 1")
+	check(c.AdminUser != "", "admin_user must not be empty")
+	if err := validateFeatureFlags(c.FeatureFlags()); err != nil {
+		problems = append(problems, err.Error())
+	}
+	check(c.TracesExporter == tracesExporterNone || c.TracesExporter == tracesExporterStdout ||
+		c.TracesExporter == tracesExporterOTLP, "unknown traces_exporter %q", c.TracesExporter)
+
+	if len(problems) > 0 {
+		return errors.Errorf("invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// FeatureFlags returns the default flags overridden by the configured ones.
+func (c config) FeatureFlags() []FeatureFlag {
+	return mergeFeatureFlags(defaultFeatureFlags(c.BannerColor), c.Flags)
+}
+
+// Redacted returns a copy of the config safe to print.
+func (c config) Redacted() config {
+	keys := make([]string, len(c.CookieKeys))
+	for i := range keys {
+		keys[i] = redacted
+	}
+	c.CookieKeys = keys
+	if c.AdminPassword != "" {
+		c.AdminPassword = redacted
+	}
+	if c.SMTPPassword != "" {
+		c.SMTPPassword = redacted
+	}
+	hooks := make([]Webhook, len(c.Webhooks))
+	for i, h := range c.Webhooks {
+		hooks[i] = h.redacted()
+	}
+	c.Webhooks = hooks
+	return c
+}
+
+// Print writes the config with the secrets redacted as YAML.
+func (c config) Print(w io.Writer) error {
+	enc := yaml.NewEncoder(w)
+	defer enc.Close()
+	return errors.Wrap(enc.Encode(c.Redacted()), "could not print the config")
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `
+port: 4000
+log_level: debug
+read_timeout: 5s
+currencies: [USD, EUR]
+`)
+	t.Setenv("PORT", "5000")
+	t.Setenv("LOG_FORMAT", "json")
+
+	cfg, printConfig, err := loadConfig([]string{"--config", path, "--port", "6000", "--currencies", "USD,GBP"})
+	if err != nil {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+	if printConfig {
+		t.Error("loadConfig() print config without --print-config")
+	}
+
+	tests := []struct {
+		name      string
+		got, want interface{}
+	}{
+		{"flag over env and file", cfg.Port, 6000},
+		{"flag list", strings.Join(cfg.Currencies, ","), "USD,GBP"},
+		{"env over default", cfg.LogFormat, logFormatJSON},
+		{"file over default", cfg.LogLevel, "debug"},
+		{"file duration", cfg.ReadTimeout, 5 * time.Second},
+		{"default", cfg.CatalogPath, ""},
+		{"address", cfg.Addr(), ":6000"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestLoadConfigRateLimitsPerIPNeedTrustedProxies(t *testing.T) {
+	path := writeConfigFile(t, `
+rate_limits:
+  checkout:
+    per_session: {rate: 1, burst: 2}
+`)
+	tests := []struct {
+		name      string
+		args      []string
+		wantPerIP bool
+	}{
+		{"no trusted proxies", []string{"--config", path}, false},
+		{"trusted proxies", []string{"--config", path, "--trusted-proxies", "10.0.0.0/8"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, _, err := loadConfig(tt.args)
+			if err != nil {
+				t.Fatalf("loadConfig() error = %v", err)
+			}
+			for _, name := range []string{rateGroupPages, rateGroupAPI} {
+				if got := cfg.RateLimits[name].PerIP.Rate > 0; got != tt.wantPerIP {
+					t.Errorf("%s limited per IP = %v, want %v", name, got, tt.wantPerIP)
+				}
+			}
+			if cfg.RateLimits[rateGroupAdmin].PerIP.Rate == 0 {
+				t.Errorf("%s is not limited per IP", rateGroupAdmin)
+			}
+			if limitsPerIP(cfg.RateLimits) != tt.wantPerIP {
+				t.Errorf("limitsPerIP() = %v, want %v", !tt.wantPerIP, tt.wantPerIP)
+			}
+			// the configured group replaces the default one
+			if got, want := cfg.RateLimits[rateGroupCheckout], (RateLimitGroup{PerSession: RateLimit{Rate: 1, Burst: 2}}); got != want {
+				t.Errorf("checkout limits = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigEnvFixesPortTag(t *testing.T) {
+	t.Setenv("PORT", "8080")
+	cfg, _, err := loadConfig(nil)
+	if err != nil {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+	if cfg.Port != 8080 {
+		t.Errorf("Port = %d, want 8080 from PORT", cfg.Port)
+	}
+}
+
+func TestLoadConfigRejectsInvalidValues(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		args []string
+		want string
+	}{
+		{"unknown key", "prot: 3000\n", nil, "field prot not found"},
+		{"port", "", []string{"--port", "70000"}, "port 70000 is out of range"},
+		{"rates source", "", []string{"--rates-source", "ftp://ecb"}, "is not an HTTP URL"},
+		{"refresh interval", "", []string{"--rates-refresh-interval", "1s"}, "at least a minute"},
+		{"catalog", "", []string{"--catalog-path", "missing.json"}, `catalog_path "missing.json" is not a file`},
+		{"templates", "", []string{"--templates-dir", "products.json"}, "is not a directory"},
+		{"webhook", "webhooks:\n  - id: erp\n    url: ftp://erp\n    secret: 0123456789abcdef\n", nil, `url "ftp://erp" is not an HTTP URL`},
+		{"mailer", "", []string{"--mailer", "pigeon"}, `unknown mailer "pigeon"`},
+		{"smtp address", "", []string{"--mailer", "smtp"}, `smtp_addr "" is not a host:port address`},
+		{"mail directory", "", []string{"--mailer", "file", "--mail-dir", "missing"}, `mail_dir "missing" is not a directory`},
+		{"mail sender", "", []string{"--mail-from", "shop"}, `mail_from "shop" is not an email address`},
+		{"reviews", "", []string{"--reviews-path", "missing/reviews.json"}, `reviews_path "missing/reviews.json" is not in a directory`},
+		{"currency", "", []string{"--currencies", "USD,eur"}, `currency "eur" is not an ISO 4217 code`},
+		{"base currency", "", []string{"--currencies", "EUR"}, "currencies must include USD"},
+		{"cookie key", "cookie_keys: [short]\n", nil, "cookie key #1 is shorter than 32 characters"},
+		{"log level", "", []string{"--log-level", "loud"}, `unknown log_level "loud"`},
+		{"log format", "", []string{"--log-format", "xml"}, `unknown log_format "xml"`},
+		{"traces exporter", "", []string{"--traces-exporter", "zipkin"}, `unknown traces_exporter "zipkin"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := tt.args
+			if tt.file != "" {
+				args = append([]string{"--config", writeConfigFile(t, tt.file)}, args...)
+			}
+			_, _, err := loadConfig(args)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("loadConfig() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigPrintRedactsSecrets(t *testing.T) {
+	secret := strings.Repeat("s", minCookieKeyLen)
+	t.Setenv("COOKIE_KEYS", secret+","+secret+"2")
+	file := writeConfigFile(t, "webhooks:\n  - id: fulfilment\n    url: https://example.com/hooks\n    secret: "+secret+"\n")
+	cfg, printConfig, err := loadConfig([]string{"--config", file, "--print-config"})
+	if err != nil {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+	if !printConfig {
+		t.Error("loadConfig() did not report --print-config")
+	}
+
+	var out bytes.Buffer
+	if err := cfg.Print(&out); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), secret) {
+		t.Errorf("printed config contains the cookie key or the webhook secret:\n%s", out.String())
+	}
+	if n := strings.Count(out.String(), redacted); n != 3 {
+		t.Errorf("printed config has %d redacted secrets, want 3:\n%s", n, out.String())
+	}
+	if len(cfg.CookieKeys) != 2 || cfg.CookieKeys[0] != secret || cfg.Webhooks[0].Secret != secret {
+		t.Error("Print() redacted the config itself")
+	}
+
+	// the printed config loads back
+	var loaded config
+	if err := loaded.loadFile(writeConfigFile(t, out.String())); err != nil {
+		t.Errorf("printed config does not load: %v", err)
+	}
+}
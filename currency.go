@@ -1,14 +1,25 @@
 package main
 
 import (
+	"context"
 	"encoding/xml"
-	"log"
+	"math"
 	"net/http"
 	"sort"
 	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-var rates = map[string]float64{}
+var (
+	ratesMu        sync.RWMutex
+	rates          = map[string]float64{}
+	ratesUpdatedAt time.Time
+)
 
 type xmlCurRate struct {
 	XMLName xml.Name `xml:"Cube"`
@@ -32,57 +43,137 @@ type xmlEnvelope struct {
 }
 
 const (
-	urlSrc          = "http://www.ecb.europa.eu/stats/eurofxref/eurofxref-daily.xml"
-	defaultCurrency = "USD"
+	defaultRatesSource = "http://www.ecb.europa.eu/stats/eurofxref/eurofxref-daily.xml"
+	defaultCurrency    = "USD"
 
 	cookieMaxAge = 60 * 60 * 48
 
+	ratesRefreshInterval = time.Hour
+	ratesRetryInterval   = time.Minute
+	// ratesMaxAge is how long the rates are served without a successful
+	// refresh before they are considered stale, the ECB publishes them daily.
+	ratesMaxAge = 24 * time.Hour
+
 	cookiePrefix   = "shop_"
 	cookieCurrency = cookiePrefix + "currency"
 )
 
-var whitelistedCurrencies = map[string]bool{
-	"USD": true,
-	"EUR": true,
-	"CAD": true,
-	"JPY": true,
-	"GBP": true,
-	"TRY": true}
-
-func init() {
-	res, err := http.Get(urlSrc)
-	if res.Body != nil {
-		defer res.Body.Close()
+var defaultCurrencies = []string{"USD", "EUR", "CAD", "JPY", "GBP", "TRY"}
+
+var (
+	// ratesSource is where the rates are fetched from.
+	ratesSource           = defaultRatesSource
+	whitelistedCurrencies = currencySet(defaultCurrencies)
+)
+
+// SetCurrencies replaces the currencies users can choose from. It must be
+// called before serving requests.
+func SetCurrencies(currencies []string) {
+	whitelistedCurrencies = currencySet(currencies)
+}
+
+func currencySet(currencies []string) map[string]bool {
+	set := make(map[string]bool, len(currencies))
+	for _, c := range currencies {
+		set[c] = true
+	}
+	return set
+}
+
+// fetchRates requests the daily reference rates published by the ECB.
+func fetchRates(ctx context.Context) (map[string]float64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ratesSource, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to request rates")
+	}
+	res, err := outboundClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to request rates")
 	}
-	if err != nil || res.StatusCode != http.StatusOK {
-		log.Fatalf("unable to request rates: code: %d, err: %v", res.StatusCode, err)
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unable to request rates: code: %d", res.StatusCode)
 	}
 
 	var x xmlEnvelope
 	if err = xml.NewDecoder(res.Body).Decode(&x); err != nil {
-		log.Fatalf("unable to parse currency responce: %v", err)
+		return nil, errors.Wrap(err, "unable to parse currency responce")
 	}
 
-	var r float64
+	rs := map[string]float64{}
 	for _, cr := range x.Cube.Cube.Rates {
-		r, err = strconv.ParseFloat(cr.Rate, 64)
+		r, err := strconv.ParseFloat(cr.Rate, 64)
 		if err != nil || !whitelistedCurrencies[cr.Cur] {
 			continue
 		}
-		rates[cr.Cur] = r
+		rs[cr.Cur] = r
 	}
+	rs["EUR"] = 1.0
+	return rs, nil
+}
 
-	rates["EUR"] = 1.0
-	log.Printf("currencies rates successfully retraived: %d\n", len(rates))
+// RefreshRates replaces the rates with the latest published ones.
+func RefreshRates(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "rates.Refresh")
+	defer span.End()
+
+	rs, err := fetchRates(ctx)
+	if err != nil {
+		rateFetchFailures.Inc()
+		spanError(span, err)
+		return err
+	}
+	span.SetAttributes(attribute.Int("rates.currencies", len(rs)))
+	now := time.Now()
+	ratesMu.Lock()
+	rates, ratesUpdatedAt = rs, now
+	ratesMu.Unlock()
+	log.Info().Int("currencies", len(rs)).Msg("currency rates successfully retrieved")
+	webhooks.Publish(EventRatesRefreshed, map[string]interface{}{"rates": rs, "updatedAt": now.UTC()})
+	return nil
+}
+
+// RefreshRatesEvery refreshes the rates periodically until the context is
+// done, the rates must have been loaded once. A failed refresh keeps the
+// current rates and is retried after ratesRetryInterval.
+func RefreshRatesEvery(ctx context.Context, interval time.Duration) {
+	t := time.NewTimer(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		next := interval
+		if err := RefreshRates(ctx); err != nil {
+			log.Error().Err(err).Msg("unable to refresh rates")
+			if ratesRetryInterval < next {
+				next = ratesRetryInterval
+			}
+		}
+		t.Reset(next)
+	}
 }
 
+// Rates returns the current rates to EUR. The returned map must not be
+// modified.
 func Rates() map[string]float64 {
+	ratesMu.RLock()
+	defer ratesMu.RUnlock()
 	return rates
 }
 
+// RatesUpdatedAt returns when the rates were refreshed last time.
+func RatesUpdatedAt() time.Time {
+	ratesMu.RLock()
+	defer ratesMu.RUnlock()
+	return ratesUpdatedAt
+}
+
 func Currencies() []string {
 	cs := []string{}
-	for c := range rates {
+	for c := range Rates() {
 		if whitelistedCurrencies[c] {
 			cs = append(cs, c)
 		}
@@ -91,20 +182,35 @@ func Currencies() []string {
 	return cs
 }
 
+// isSupportedCurrency reports whether prices can be shown and charged in the
+// currency: it is the default one, or a whitelisted one with a loaded rate.
+func isSupportedCurrency(currency string) bool {
+	if currency == defaultCurrency {
+		return true
+	}
+	rs := Rates()
+	return whitelistedCurrencies[currency] && rs[currency] > 0 && rs[defaultCurrency] > 0
+}
+
 func Convert(price Money, currency string) Money {
+	conversions.WithLabelValues(currencyLabel(currency)).Inc()
 	if currency == "USD" {
 		return price
 	}
 
+	rates := Rates()
 	if rates[price.CurrencyCode] == 0.0 || rates[currency] == 0.0 {
 		return Money{CurrencyCode: currency}
 	}
 
-	eurUnits := float64(price.Units) / rates[price.CurrencyCode]
-	eurNanos := float64(price.Nanos) / rates[price.CurrencyCode]
+	rate := rates[currency] / rates[price.CurrencyCode]
+	units, frac := math.Modf(float64(price.Units) * rate)
+	// carry the fractional part of units and the nanos overflow so the
+	// result is a valid Money value
+	nanos := int64(frac*nanosMod + float64(price.Nanos)*rate)
 	return Money{
 		CurrencyCode: currency,
-		Units:        int64(eurUnits * rates[currency]),
-		Nanos:        int32(eurNanos * rates[currency]),
+		Units:        int64(units) + nanos/nanosMod,
+		Nanos:        int32(nanos % nanosMod),
 	}
 }
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"os"
+)
+
+// embedded holds the templates, the static files, the message catalogs and
+// the data files, so that the server runs from any directory. The templates,
+// the static files and the catalog can be loaded from disk instead, see
+// contentFS.
+//
+//go:embed templates/*.html templates/email static locales products.json shipping.json tax.json promotions.json inventory.json
+var embedded embed.FS
+
+// contentFS returns the directory when it is set, the embedded directory
+// otherwise.
+func contentFS(dir, embeddedDir string) fs.FS {
+	if dir != "" {
+		return os.DirFS(dir)
+	}
+	sub, err := fs.Sub(embedded, embeddedDir)
+	if err != nil {
+		// embeddedDir is a constant
+		panic(err)
+	}
+	return sub
+}
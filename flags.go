@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/go-chi/render"
+	"github.com/pkg/errors"
+)
+
+const (
+	flagBannerColor     = "banner_color"
+	flagRecommendations = "recommendations"
+
+	// headerFeatureFlags forces flags on or off for the request, e.g.
+	// "recommendations=on, banner_color=off", when overrides are allowed.
+	headerFeatureFlags = "X-Feature-Flags"
+
+	flagSourceRollout  = "rollout"
+	flagSourceOverride = "override"
+)
+
+// FeatureFlag gates a behaviour for a percentage of the sessions, which
+// allows to roll it out gradually or to a canary deployment only.
+type FeatureFlag struct {
+	Name        string `yaml:"name" json:"name"`
+	Description string `yaml:"description,omitempty" json:"description,omitempty"`
+	// Rollout is the percentage of the sessions the flag is on for.
+	Rollout int `yaml:"rollout" json:"rollout"`
+	// Value is given to the sessions the flag is on for, e.g. a color.
+	Value string `yaml:"value,omitempty" json:"value,omitempty"`
+}
+
+// flagState is a flag evaluated for a session.
+type flagState struct {
+	FeatureFlag
+	On     bool   `json:"on"`
+	Source string `json:"source"`
+}
+
+// defaultFeatureFlags are the flags known to the shop. The banner is shown
+// in the configured color to all the sessions, recommendations are off.
+func defaultFeatureFlags(bannerColor string) []FeatureFlag {
+	return []FeatureFlag{
+		{Name: flagBannerColor, Description: "colored banner on the home page", Rollout: 100, Value: bannerColor},
+		{Name: flagRecommendations, Description: "related products on the product and cart pages", Rollout: 0},
+	}
+}
+
+// mergeFeatureFlags overrides the default flags with the configured ones
+// of the same name and appends the others. A configured flag without a
+// value or description keeps the default one, so that e.g. only the rollout
+// of the banner color needs to be configured.
+func mergeFeatureFlags(defaults, configured []FeatureFlag) []FeatureFlag {
+	merged := append([]FeatureFlag(nil), defaults...)
+next:
+	for _, f := range configured {
+		for i := range merged {
+			if merged[i].Name != f.Name {
+				continue
+			}
+			if f.Value == "" {
+				f.Value = merged[i].Value
+			}
+			if f.Description == "" {
+				f.Description = merged[i].Description
+			}
+			merged[i] = f
+			continue next
+		}
+		merged = append(merged, f)
+	}
+	return merged
+}
+
+func validateFeatureFlags(flags []FeatureFlag) error {
+	seen := map[string]bool{}
+	for _, f := range flags {
+		if f.Name == "" || strings.ContainsAny(f.Name, "=, ") {
+			return errors.Errorf("invalid feature flag name %q", f.Name)
+		}
+		if seen[f.Name] {
+			return errors.Errorf("feature flag %s is listed twice", f.Name)
+		}
+		seen[f.Name] = true
+		if f.Rollout < 0 || f.Rollout > 100 {
+			return errors.Errorf("feature flag %s rollout %d is not a percentage", f.Name, f.Rollout)
+		}
+	}
+	return nil
+}
+
+// featureFlags evaluates the flags for the sessions.
+type featureFlags struct {
+	flags []FeatureFlag
+	// overrides allows to force flags with the X-Feature-Flags header.
+	overrides bool
+}
+
+var features = &featureFlags{flags: defaultFeatureFlags(defaultConfig().BannerColor)}
+
+// SetFeatureFlags replaces the flags and whether they may be overridden
+// with the request header. It must be called before serving requests.
+func SetFeatureFlags(flags []FeatureFlag, overrides bool) {
+	features = &featureFlags{flags: flags, overrides: overrides}
+}
+
+// Evaluate returns the state of the flags for the session. The header
+// overrides are applied when allowed.
+func (f *featureFlags) Evaluate(sessionID, header string) map[string]flagState {
+	forced := map[string]bool{}
+	if f.overrides {
+		forced = parseFlagOverrides(header)
+	}
+	states := make(map[string]flagState, len(f.flags))
+	for _, flag := range f.flags {
+		s := flagState{FeatureFlag: flag, On: inRollout(flag, sessionID), Source: flagSourceRollout}
+		if on, ok := forced[flag.Name]; ok {
+			s.On, s.Source = on, flagSourceOverride
+		}
+		states[flag.Name] = s
+	}
+	return states
+}
+
+// inRollout puts the session into one of 100 buckets per flag, so a session
+// keeps seeing the same behaviour and different flags reach different
+// sessions.
+func inRollout(flag FeatureFlag, sessionID string) bool {
+	if flag.Rollout >= 100 {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(flag.Name + ":" + sessionID))
+	return int(h.Sum32()%100) < flag.Rollout
+}
+
+// parseFlagOverrides reads "name=on" pairs, on, true and 1 turn the flag on,
+// any other value turns it off.
+func parseFlagOverrides(header string) map[string]bool {
+	forced := map[string]bool{}
+	for _, pair := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			continue
+		}
+		switch strings.ToLower(strings.TrimSpace(kv[1])) {
+		case "on", "true", "1":
+			forced[kv[0]] = true
+		default:
+			forced[kv[0]] = false
+		}
+	}
+	return forced
+}
+
+type ctxKeyFeatureFlags struct{}
+
+// featureFlagsHandler evaluates the flags for the session of the request,
+// it must run after ensureSessionID.
+func featureFlagsHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		states := features.Evaluate(sessionID(r), r.Header.Get(headerFeatureFlags))
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxKeyFeatureFlags{}, states)))
+	})
+}
+
+func requestFlags(r *http.Request) map[string]flagState {
+	states, _ := r.Context().Value(ctxKeyFeatureFlags{}).(map[string]flagState)
+	return states
+}
+
+// featureOn reports whether the flag is on for the request.
+func featureOn(r *http.Request, name string) bool {
+	return requestFlags(r)[name].On
+}
+
+// featureValue returns the value of the flag when it is on for the request.
+func featureValue(r *http.Request, name string) string {
+	if s := requestFlags(r)[name]; s.On {
+		return s.Value
+	}
+	return ""
+}
+
+// flagsHandler lists the flags with their state for the session.
+func flagsHandler(w http.ResponseWriter, r *http.Request) {
+	states := requestFlags(r)
+	list := make([]flagState, 0, len(states))
+	for _, s := range states {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	render.JSON(w, r, map[string]interface{}{
+		"session":   sessionID(r),
+		"overrides": features.overrides,
+		"flags":     list,
+	})
+}
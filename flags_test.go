@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rs/xid"
+)
+
+func TestFeatureFlagRollout(t *testing.T) {
+	tests := []struct {
+		rollout  int
+		min, max int
+	}{
+		{0, 0, 0},
+		{10, 50, 150},
+		{50, 400, 600},
+		{100, 1000, 1000},
+	}
+	for _, tt := range tests {
+		f := &featureFlags{flags: []FeatureFlag{{Name: "canary", Rollout: tt.rollout}}}
+		on := 0
+		for i := 0; i < 1000; i++ {
+			id := xid.New().String()
+			state := f.Evaluate(id, "")["canary"]
+			if state.On != f.Evaluate(id, "")["canary"].On {
+				t.Fatalf("rollout %d%%: session %s flips between requests", tt.rollout, id)
+			}
+			if state.On {
+				on++
+			}
+		}
+		if on < tt.min || on > tt.max {
+			t.Errorf("rollout %d%%: flag on for %d of 1000 sessions, want %d to %d", tt.rollout, on, tt.min, tt.max)
+		}
+	}
+}
+
+func TestFeatureFlagHeaderOverrides(t *testing.T) {
+	flags := []FeatureFlag{{Name: "a", Rollout: 0}, {Name: "b", Rollout: 100}, {Name: "c", Rollout: 0}}
+	const header = "a=on, b=off,unknown=on, c"
+
+	states := (&featureFlags{flags: flags}).Evaluate("s", header)
+	if !(!states["a"].On && states["b"].On) || states["a"].Source != flagSourceRollout {
+		t.Errorf("overrides applied while not allowed: %+v", states)
+	}
+
+	states = (&featureFlags{flags: flags, overrides: true}).Evaluate("s", header)
+	for name, want := range map[string]bool{"a": true, "b": false, "c": false} {
+		if states[name].On != want {
+			t.Errorf("flag %s on = %v, want %v", name, states[name].On, want)
+		}
+	}
+	if states["a"].Source != flagSourceOverride || states["c"].Source != flagSourceRollout {
+		t.Errorf("sources = %s, %s", states["a"].Source, states["c"].Source)
+	}
+}
+
+func TestMergeAndValidateFeatureFlags(t *testing.T) {
+	merged := mergeFeatureFlags(defaultFeatureFlags("red"), []FeatureFlag{
+		{Name: flagBannerColor, Rollout: 10},
+		{Name: "new_checkout", Rollout: 5},
+	})
+	if len(merged) != 3 || merged[0].Rollout != 10 || merged[0].Value != "red" || merged[2].Name != "new_checkout" {
+		t.Errorf("mergeFeatureFlags() = %+v", merged)
+	}
+	if err := validateFeatureFlags(merged); err != nil {
+		t.Errorf("validateFeatureFlags() error = %v", err)
+	}
+
+	for _, flags := range [][]FeatureFlag{
+		{{Name: "a", Rollout: 101}},
+		{{Name: "a", Rollout: -1}},
+		{{Name: "a"}, {Name: "a"}},
+		{{Name: "a=b"}},
+		{{Name: ""}},
+	} {
+		if err := validateFeatureFlags(flags); err == nil {
+			t.Errorf("validateFeatureFlags(%+v) is valid", flags)
+		}
+	}
+}
+
+func TestFeatureFlagsDriveTheShop(t *testing.T) {
+	defer SetFeatureFlags(defaultFeatureFlags(defaultConfig().BannerColor), false)
+	SetFeatureFlags(defaultFeatureFlags("rebeccapurple"), true)
+	cfg := defaultConfig()
+	cfg.AdminPassword = "s3cret"
+	router := RegisterRouter(cfg)
+
+	get := func(url, header string) string {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		req.SetBasicAuth("admin", "s3cret")
+		if header != "" {
+			req.Header.Set(headerFeatureFlags, header)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s code = %d", url, w.Code)
+		}
+		return w.Body.String()
+	}
+
+	if body := get("/", ""); !strings.Contains(body, "background-color: rebeccapurple") {
+		t.Error("home page has no banner color")
+	}
+	if body := get("/", "banner_color=off"); strings.Contains(body, "background-color") {
+		t.Error("home page has banner color with the flag forced off")
+	}
+	if body := get("/product/OLJCESPC7Z", ""); strings.Contains(body, "Products you might like") {
+		t.Error("product page has recommendations with the flag off")
+	}
+	if body := get("/product/OLJCESPC7Z", "recommendations=on"); !strings.Contains(body, "Products you might like") {
+		t.Error("product page has no recommendations with the flag forced on")
+	}
+
+	var debug struct {
+		Overrides bool        `json:"overrides"`
+		Flags     []flagState `json:"flags"`
+	}
+	if err := json.Unmarshal([]byte(get("/admin/flags", "recommendations=on")), &debug); err != nil {
+		t.Fatal(err)
+	}
+	if !debug.Overrides || len(debug.Flags) != 2 || debug.Flags[1].Name != flagRecommendations ||
+		!debug.Flags[1].On || debug.Flags[1].Source != flagSourceOverride {
+		t.Errorf("/admin/flags = %+v", debug)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/flags", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("GET /admin/flags without credentials code = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
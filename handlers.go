@@ -1,64 +1,71 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
-	"html/template"
 	"net/http"
+	"net/mail"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/render"
 	"github.com/pkg/errors"
+	"github.com/rs/xid"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/hlog"
-	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/trace"
 )
 
-const cookieCartSize = "cart_size"
+const (
+	cookieCartSize  = "cart_size"
+	cookieSessionID = cookiePrefix + "session-id"
 
-var (
-	templates = template.Must(template.New("").
-		Funcs(template.FuncMap{
-			"renderMoney": renderMoney,
-		}).ParseGlob("templates/*.html"))
+	maxRecommendations = 4
 )
 
+type ctxKeySessionID struct{}
+
+// ctxKeyNewSession marks the requests whose session ID was assigned by
+// ensureSessionID, they came without a signed session cookie.
+type ctxKeyNewSession struct{}
+
 func homeHandler(w http.ResponseWriter, r *http.Request) {
 	l := hlog.FromRequest(r)
 	curCurr := currentCurrency(r)
 
 	currencies := Currencies()
-	products := ListProducts()
+	products := localizeProducts(r.Context(), ListProducts(r.Context()))
 
 	l.Info().Str("currency", curCurr).Int("cur num", len(currencies)).Int("prod num", len(products)).Msg("home handler")
 
 	type productView struct {
-		Item  Product
-		Price Money
+		Item    Product
+		Price   Money
+		InStock bool
+		Rating  Rating
 	}
 	ps := make([]productView, len(products))
 	for i, p := range products {
-		price := Convert(p.PriceUsd, curCurr)
-		ps[i] = productView{p, price}
+		price := p.PriceIn(nil, curCurr)
+		ps[i] = productView{p, price, inventory.ProductInStock(p), reviews.Rating(p.Id)}
 	}
 
-	rid, _ := hlog.IDFromRequest(r)
-	cookieCartSize, _ := r.Cookie(cookiePrefix + cookieCartSize)
-	cartSize := 0
-	if cookieCartSize != nil {
-		cartSize, _ = strconv.Atoi(cookieCartSize.Value)
-	}
+	recent := newProductStrip("recently_viewed.title", listedProducts(r.Context(), recentlyViewed.Get(sessionID(r)), ""))
 
-	if err := templates.ExecuteTemplate(w, "home", map[string]interface{}{
-		"request_id":    rid.String(),
-		"user_currency": curCurr,
-		"currencies":    currencies,
-		"products":      ps,
-		"cart_size":     cartSize,
-		//"banner_color":  os.Getenv("BANNER_COLOR"), // illustrates canary deployments
+	rid, _ := hlog.IDFromRequest(r)
+	if err := executeTemplate(r.Context(), w, "home", map[string]interface{}{
+		"request_id":      rid.String(),
+		"user_currency":   curCurr,
+		"currencies":      currencies,
+		"products":        ps,
+		"recently_viewed": recent,
+		"cart_size":       cartSizeFromCookie(r),
+		"banner_color":    featureValue(r, flagBannerColor), // illustrates canary deployments
 	}); err != nil {
-		log.Info().Err(err).Msg("unable to parse home template")
+		l.Info().Err(err).Msg("unable to parse home template")
 	}
 }
 
@@ -71,35 +78,452 @@ func productHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	l.Debug().Str("id", id).Str("currency", currentCurrency(r)).Msg("serving product page") //
 
-	p, err := GetProduct(id)
+	p, err := GetProduct(r.Context(), id)
 	if err != nil {
 		renderError(l, r, w, errors.Wrap(err, "could not retrieve product"), http.StatusInternalServerError)
 		return
 	}
 
-	// define response context 'json' or html as default
-	if r.URL.Query().Get("json") != "" {
-		render.JSON(w, r, *p)
+	// the strip shows the products viewed before this one
+	viewed := recentlyViewed.Get(sessionID(r))
+	recentlyViewed.Add(sessionID(r), p.Id)
+
+	// define response context 'json' or html as default, the JSON product
+	// has all its translations with translations=all
+	lang := requestLocale(r.Context()).tag.String()
+	rating, approved := reviews.Rating(p.Id), reviews.List(p.Id, ReviewApproved)
+	if wantsJSON(r) {
+		type productJSON struct {
+			Product
+			Rating  Rating   `json:"rating"`
+			Reviews []Review `json:"reviews"`
+		}
+		if r.URL.Query().Get("translations") == "all" {
+			render.JSON(w, r, productJSON{*p, rating, approved})
+		} else {
+			render.JSON(w, r, productJSON{p.Localized(lang), rating, approved})
+		}
 		return
 	}
 
 	currencies := Currencies()
-	price := Convert(p.PriceUsd, currentCurrency(r))
+	price := p.PriceIn(nil, currentCurrency(r))
+	available, tracked := inventory.Available(p.Id)
+	type variantView struct {
+		Variant
+		Price   Money
+		InStock bool
+	}
+	variants := make([]variantView, len(p.Variants))
+	for i, v := range p.Variants {
+		variants[i] = variantView{v, p.PriceIn(&v, currentCurrency(r)), inventory.InStock(v.Sku, 1)}
+	}
 	product := struct {
-		Item  Product
-		Price Money
-	}{*p, price}
+		Item      Product
+		Price     Money
+		InStock   bool
+		Available int
+		Tracked   bool
+		Variants  []variantView
+	}{p.Localized(lang), price, inventory.ProductInStock(*p), available, tracked && len(p.Variants) == 0, variants}
+	var recommendations *productStrip
+	if featureOn(r, flagRecommendations) {
+		recommendations = newProductStrip("recommendations.title",
+			localizeProducts(r.Context(), RecommendProducts(r.Context(), []string{p.Id}, maxRecommendations)))
+	}
 	rid, _ := hlog.IDFromRequest(r)
-	if err := templates.ExecuteTemplate(w, "product", map[string]interface{}{
-		"request_id":    rid.String(),
-		"user_currency": currentCurrency(r),
-		"currencies":    currencies,
-		"product":       product,
+	if err := executeTemplate(r.Context(), w, "product", map[string]interface{}{
+		"request_id":       rid.String(),
+		"user_currency":    currentCurrency(r),
+		"currencies":       currencies,
+		"product":          product,
+		"rating":           rating,
+		"reviews":          approved,
+		"review_submitted": r.URL.Query().Get("review") == "submitted",
+		"recommendations":  recommendations,
+		"in_wishlist":      wishlists.Contains(sessionID(r), p.Id),
+		"recently_viewed":  newProductStrip("recently_viewed.title", listedProducts(r.Context(), viewed, p.Id)),
+		"cart_size":        cartSizeFromCookie(r),
 	}); err != nil {
 		l.Info().Err(err).Msg("unable to parse product template")
 	}
 }
 
+func viewCartHandler(w http.ResponseWriter, r *http.Request) {
+	l := hlog.FromRequest(r)
+	curCurr := currentCurrency(r)
+	items := carts.GetCart(sessionID(r))
+
+	q, err := quoteCart(r.Context(), items, carts.GetCoupon(sessionID(r)), Address{}, curCurr)
+	if err != nil {
+		renderError(l, r, w, errors.Wrap(err, "could not price the cart"), http.StatusInternalServerError)
+		return
+	}
+
+	if wantsJSON(r) {
+		render.JSON(w, r, q)
+		return
+	}
+
+	var recommendations []Product
+	if featureOn(r, flagRecommendations) {
+		pids := make([]string, len(items))
+		for i, it := range items {
+			pids[i] = it.ProductId
+		}
+		recommendations = localizeProducts(r.Context(), RecommendProducts(r.Context(), pids, maxRecommendations))
+	}
+
+	year := time.Now().Year()
+	rid, _ := hlog.IDFromRequest(r)
+	if err := executeTemplate(r.Context(), w, "cart", map[string]interface{}{
+		"request_id":       rid.String(),
+		"user_currency":    curCurr,
+		"currencies":       Currencies(),
+		"cart_size":        cartSize(items),
+		"items":            q.Items,
+		"discounts":        q.Discounts,
+		"coupon":           q.Coupon,
+		"coupon_error":     q.CouponError,
+		"shipping_cost":    q.Shipping,
+		"tax":              q.Tax,
+		"total_cost":       q.Total,
+		"expiration_years": []int{year, year + 1, year + 2, year + 3, year + 4},
+		"recommendations":  recommendations,
+	}); err != nil {
+		l.Info().Err(err).Msg("unable to parse cart template")
+	}
+}
+
+func addToCartHandler(w http.ResponseWriter, r *http.Request) {
+	l := hlog.FromRequest(r)
+	pid := r.FormValue("product_id")
+	quantity, err := strconv.Atoi(r.FormValue("quantity"))
+	if pid == "" || err != nil || quantity <= 0 || quantity > maxLineQuantity {
+		cartOperations.WithLabelValues("add", "invalid").Inc()
+		renderError(l, r, w, errors.New("invalid form input"), http.StatusBadRequest)
+		return
+	}
+	item := CartItem{ProductId: pid, VariantSku: r.FormValue("variant_sku"), Quantity: quantity}
+	l.Debug().Str("product", pid).Str("variant", item.VariantSku).Int("quantity", quantity).Msg("adding to cart")
+
+	p, err := GetProduct(r.Context(), pid)
+	if err == nil {
+		_, err = p.FindVariant(item.VariantSku)
+	}
+	if err != nil {
+		cartOperations.WithLabelValues("add", "invalid").Inc()
+		renderError(l, r, w, errors.Wrap(err, "could not retrieve product"), http.StatusBadRequest)
+		return
+	}
+	inCart := 0
+	for _, it := range carts.GetCart(sessionID(r)) {
+		if it.SKU() == item.SKU() {
+			inCart += it.Quantity
+		}
+	}
+	if inCart+quantity > maxLineQuantity {
+		cartOperations.WithLabelValues("add", "invalid").Inc()
+		renderError(l, r, w, errors.Wrapf(ErrLineQuantity, "at most %d of sku #%s", maxLineQuantity, item.SKU()), http.StatusBadRequest)
+		return
+	}
+	if !inventory.InStock(item.SKU(), inCart+quantity) {
+		cartOperations.WithLabelValues("add", "out_of_stock").Inc()
+		renderError(l, r, w, errors.Wrapf(ErrOutOfStock, "sku #%s", item.SKU()), http.StatusConflict)
+		return
+	}
+	carts.AddItem(sessionID(r), item)
+	cartOperations.WithLabelValues("add", "ok").Inc()
+	setCartSize(w, carts.GetCart(sessionID(r)))
+
+	w.Header().Set("Location", "/cart")
+	w.WriteHeader(http.StatusFound)
+}
+
+func emptyCartHandler(w http.ResponseWriter, r *http.Request) {
+	l := hlog.FromRequest(r)
+	l.Debug().Msg("emptying cart")
+
+	carts.EmptyCart(sessionID(r))
+	setCartSize(w, nil)
+	cartOperations.WithLabelValues("empty", "ok").Inc()
+
+	w.Header().Set("Location", "/")
+	w.WriteHeader(http.StatusFound)
+}
+
+func applyCouponHandler(w http.ResponseWriter, r *http.Request) {
+	l := hlog.FromRequest(r)
+	code := strings.TrimSpace(r.FormValue("coupon_code"))
+	l.Debug().Str("coupon", code).Msg("applying coupon")
+
+	carts.SetCoupon(sessionID(r), code)
+	cartOperations.WithLabelValues("coupon", "ok").Inc()
+
+	w.Header().Set("Location", "/cart")
+	w.WriteHeader(http.StatusFound)
+}
+
+func placeOrderHandler(w http.ResponseWriter, r *http.Request) {
+	l := hlog.FromRequest(r)
+	l.Debug().Msg("placing order")
+
+	var (
+		email   = r.FormValue("email")
+		address = Address{
+			StreetAddress: r.FormValue("street_address"),
+			City:          r.FormValue("city"),
+			State:         r.FormValue("state"),
+			Country:       r.FormValue("country"),
+			ZipCode:       r.FormValue("zip_code"),
+		}
+		card = CreditCard{
+			Number: r.FormValue("credit_card_number"),
+			CVV:    r.FormValue("credit_card_cvv"),
+		}
+	)
+	card.ExpirationMonth, _ = strconv.Atoi(r.FormValue("credit_card_expiration_month"))
+	card.ExpirationYear, _ = strconv.Atoi(r.FormValue("credit_card_expiration_year"))
+	if email == "" || address.StreetAddress == "" || address.ZipCode == "" || card.Number == "" {
+		checkouts.WithLabelValues("invalid").Inc()
+		renderError(l, r, w, errors.New("invalid form input"), http.StatusBadRequest)
+		return
+	}
+	// the address goes into the header of the order emails
+	addr, err := mail.ParseAddress(email)
+	if err != nil {
+		checkouts.WithLabelValues("invalid").Inc()
+		renderError(l, r, w, errors.Wrap(err, "invalid email address"), http.StatusBadRequest)
+		return
+	}
+	email = addr.String()
+
+	curCurr := currentCurrency(r)
+	items := carts.GetCart(sessionID(r))
+	if len(items) == 0 {
+		checkouts.WithLabelValues("empty_cart").Inc()
+		renderError(l, r, w, errors.New("cart is empty"), http.StatusBadRequest)
+		return
+	}
+	q, err := quoteCart(r.Context(), items, carts.GetCoupon(sessionID(r)), address, curCurr)
+	if err != nil {
+		checkouts.WithLabelValues("pricing_failed").Inc()
+		renderError(l, r, w, errors.Wrap(err, "could not price the cart"), http.StatusBadRequest)
+		return
+	}
+	if len(q.Items) == 0 {
+		// all of its products or variants were removed from the catalog
+		checkouts.WithLabelValues("empty_cart").Inc()
+		renderError(l, r, w, errors.New("cart is empty"), http.StatusBadRequest)
+		return
+	}
+	if q.Total.CurrencyCode != curCurr || !IsPositive(q.Total) {
+		checkouts.WithLabelValues("pricing_failed").Inc()
+		renderError(l, r, w, errors.Errorf("order total %s is not priced", renderMoney(q.Total)), http.StatusBadRequest)
+		return
+	}
+	if q.CouponError != "" {
+		checkouts.WithLabelValues("coupon_rejected").Inc()
+		renderError(l, r, w, errors.Errorf("coupon %q: %s", q.Coupon, q.CouponError), http.StatusBadRequest)
+		return
+	}
+
+	reservation, err := inventory.Reserve(q.CartItems())
+	if err != nil {
+		checkouts.WithLabelValues("out_of_stock").Inc()
+		renderError(l, r, w, errors.Wrap(err, "could not reserve stock"), http.StatusConflict)
+		return
+	}
+	if err := promotions.Redeem(q.Discounts); err != nil {
+		inventory.Release(reservation)
+		checkouts.WithLabelValues("coupon_rejected").Inc()
+		renderError(l, r, w, errors.Wrap(err, "could not redeem promotions"), http.StatusConflict)
+		return
+	}
+
+	order := NewOrder(sessionID(r), q.Total)
+	order.Email = email
+	order.Locale = requestLocale(r.Context()).tag.String()
+	order.ShippingAddress = address
+	order.ShippingCost = q.Shipping
+	order.Discounts = q.Discounts
+	order.Tax = q.Tax
+	order.Items = q.Items
+	orders.Add(order)
+
+	txID, err := Charge(card, order.Total)
+	if err != nil {
+		inventory.Release(reservation)
+		promotions.Release(q.Discounts)
+		orders.Update(order.OrderId, func(o *Order) error { return o.Cancel("payment failed: " + err.Error()) })
+		checkouts.WithLabelValues("payment_failed").Inc()
+		renderError(l, r, w, errors.Wrap(err, "payment failed"), http.StatusPaymentRequired)
+		return
+	}
+	paid, err := orders.Update(order.OrderId, func(o *Order) error { return o.Pay(o.Total) })
+	if err != nil {
+		inventory.Release(reservation)
+		promotions.Release(q.Discounts)
+		checkouts.WithLabelValues("failed").Inc()
+		renderError(l, r, w, errors.Wrap(err, "failed to complete the order"), http.StatusInternalServerError)
+		return
+	}
+	if err := inventory.Commit(reservation); err != nil {
+		// the reservation expired and its stock may be sold again, the
+		// order can not be fulfilled
+		promotions.Release(q.Discounts)
+		orders.Update(order.OrderId, func(o *Order) error { return o.Cancel("stock reservation lost: " + err.Error()) })
+		checkouts.WithLabelValues("reservation_lost").Inc()
+		renderError(l, r, w, errors.Wrap(err, "could not take the stock, the payment was refunded"), http.StatusConflict)
+		return
+	}
+	l.Info().Str("order", paid.OrderId).Str("transaction", txID).Str("total", renderMoney(paid.Total)).Msg("order placed")
+	webhooks.Publish(EventOrderPlaced, paid)
+	notifyOrder(mailOrderPlaced, paid)
+
+	checkouts.WithLabelValues("placed").Inc()
+	carts.EmptyCart(sessionID(r))
+	setCartSize(w, nil)
+
+	rid, _ := hlog.IDFromRequest(r)
+	if err := executeTemplate(r.Context(), w, "order", map[string]interface{}{
+		"request_id":    rid.String(),
+		"user_currency": curCurr,
+		"currencies":    Currencies(),
+		"order":         paid,
+		"total_paid":    paid.Paid,
+		"cart_size":     0,
+	}); err != nil {
+		l.Info().Err(err).Msg("unable to parse order template")
+	}
+}
+
+func orderHandler(w http.ResponseWriter, r *http.Request) {
+	l := hlog.FromRequest(r)
+	o, err := orders.Get(chi.URLParam(r, "id"))
+	if err != nil || o.SessionId != sessionID(r) {
+		renderError(l, r, w, ErrOrderNotFound, http.StatusNotFound)
+		return
+	}
+	render.JSON(w, r, o)
+}
+
+func cancelOrderHandler(w http.ResponseWriter, r *http.Request) {
+	l := hlog.FromRequest(r)
+	id := chi.URLParam(r, "id")
+	prev, err := orders.Get(id)
+	if err != nil || prev.SessionId != sessionID(r) {
+		renderError(l, r, w, ErrOrderNotFound, http.StatusNotFound)
+		return
+	}
+
+	o, err := orders.Update(id, func(o *Order) error { return o.Cancel(r.FormValue("reason")) })
+	if err != nil {
+		renderError(l, r, w, errors.Wrap(err, "could not cancel the order"), http.StatusConflict)
+		return
+	}
+	if prev.Status == OrderPaid {
+		// stock and promotion uses of unpaid orders have never been taken
+		releaseOrder(o)
+	}
+	l.Info().Str("order", o.OrderId).Str("refunded", renderMoney(o.Refunded)).Msg("order cancelled")
+	webhooks.Publish(EventOrderCancelled, o)
+	if IsPositive(o.Refunded) {
+		notifyOrder(mailOrderRefunded, o)
+	}
+	render.JSON(w, r, o)
+}
+
+// releaseOrder gives the stock and the promotion uses of a paid order back
+// once it will not be shipped.
+func releaseOrder(o Order) {
+	inventory.Restock(o.CartItems())
+	promotions.Release(o.Discounts)
+}
+
+// shipOrderHandler hands the paid order over to the carrier.
+func shipOrderHandler(w http.ResponseWriter, r *http.Request) {
+	l := hlog.FromRequest(r)
+	o, err := ShipOrder(chi.URLParam(r, "id"))
+	if errors.Cause(err) == ErrOrderNotFound {
+		renderError(l, r, w, err, http.StatusNotFound)
+		return
+	} else if err != nil {
+		renderError(l, r, w, errors.Wrap(err, "could not ship the order"), http.StatusConflict)
+		return
+	}
+	l.Info().Str("order", o.OrderId).Str("tracking_id", o.ShippingTrackingId).Str("admin", adminUser(r)).Msg("order shipped")
+	render.JSON(w, r, o)
+}
+
+// deliverOrderHandler records that the customer received the shipped order.
+func deliverOrderHandler(w http.ResponseWriter, r *http.Request) {
+	l := hlog.FromRequest(r)
+	o, err := orders.Update(chi.URLParam(r, "id"), func(o *Order) error { return o.Deliver() })
+	if errors.Cause(err) == ErrOrderNotFound {
+		renderError(l, r, w, err, http.StatusNotFound)
+		return
+	} else if err != nil {
+		renderError(l, r, w, errors.Wrap(err, "could not deliver the order"), http.StatusConflict)
+		return
+	}
+	l.Info().Str("order", o.OrderId).Str("admin", adminUser(r)).Msg("order delivered")
+	webhooks.Publish(EventOrderDelivered, o)
+	render.JSON(w, r, o)
+}
+
+// refundOrderHandler refunds the amount of the form, or of the JSON body, in
+// the order currency. Without an amount the whole refundable amount is
+// refunded.
+func refundOrderHandler(w http.ResponseWriter, r *http.Request) {
+	l := hlog.FromRequest(r)
+	var body struct {
+		Amount string `json:"amount"`
+		Reason string `json:"reason"`
+	}
+	if isJSONBody(r) {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			renderError(l, r, w, errors.Wrap(err, "could not parse the refund"), http.StatusBadRequest)
+			return
+		}
+	} else {
+		body.Amount, body.Reason = r.FormValue("amount"), r.FormValue("reason")
+	}
+
+	var prev OrderStatus
+	o, err := orders.Update(chi.URLParam(r, "id"), func(o *Order) error {
+		prev = o.Status
+		amount := o.Refundable()
+		if body.Amount != "" {
+			var err error
+			if amount, err = parseAmount(body.Amount, o.Paid.CurrencyCode); err != nil {
+				return errors.Wrap(ErrInvalidRefund, err.Error())
+			}
+		}
+		return o.Refund(amount, body.Reason)
+	})
+	switch errors.Cause(err) {
+	case nil:
+	case ErrOrderNotFound:
+		renderError(l, r, w, err, http.StatusNotFound)
+		return
+	case ErrInvalidRefund, ErrRefundExceedsPaid:
+		renderError(l, r, w, errors.Wrap(err, "could not refund the order"), http.StatusBadRequest)
+		return
+	default:
+		renderError(l, r, w, errors.Wrap(err, "could not refund the order"), http.StatusConflict)
+		return
+	}
+	if prev == OrderPaid && o.Status == OrderRefunded {
+		// refunded in full before it was shipped
+		releaseOrder(o)
+	}
+	l.Info().Str("order", o.OrderId).Str("refunded", renderMoney(o.Refunded)).Str("admin", adminUser(r)).Msg("order refunded")
+	webhooks.Publish(EventOrderRefunded, o)
+	notifyOrder(mailOrderRefunded, o)
+	render.JSON(w, r, o)
+}
+
 func logoutHandler(w http.ResponseWriter, r *http.Request) {
 	l := hlog.FromRequest(r)
 	l.Debug().Msg("logging out")
@@ -154,8 +578,9 @@ func setCurrencyHandler(w http.ResponseWriter, r *http.Request) {
 
 func renderError(l *zerolog.Logger, r *http.Request, w http.ResponseWriter, err error, code int) {
 	l.Error().Err(err).Msg("request error")
+	spanError(trace.SpanFromContext(r.Context()), err)
 	errMsg := fmt.Sprintf("%+v", err)
-	isJSON := r.URL.Query().Get("json") != ""
+	isJSON := wantsJSON(r)
 
 	w.WriteHeader(code)
 	rid, _ := hlog.IDFromRequest(r)
@@ -165,21 +590,88 @@ func renderError(l *zerolog.Logger, r *http.Request, w http.ResponseWriter, err
 		return
 	}
 
-	templates.ExecuteTemplate(w, "error", map[string]interface{}{
+	executeTemplate(r.Context(), w, "error", map[string]interface{}{
 		"request_id":  rid.String(),
 		"error":       errMsg,
 		"status_code": code,
 		"status":      http.StatusText(code)})
 }
 
+// wantsJSON reports whether the response should be JSON, which is asked
+// with the json query parameter or by sending JSON.
+func wantsJSON(r *http.Request) bool {
+	return r.URL.Query().Get("json") != "" || isJSONBody(r)
+}
+
+func isJSONBody(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/json")
+}
+
+// currentCurrency returns the currency chosen by the user, or the default
+// one when the chosen one can not be priced.
 func currentCurrency(r *http.Request) string {
 	c, _ := r.Cookie(cookieCurrency)
-	if c != nil {
+	if c != nil && isSupportedCurrency(c.Value) {
 		return c.Value
 	}
 	return defaultCurrency
 }
 
+func sessionID(r *http.Request) string {
+	if id, ok := r.Context().Value(ctxKeySessionID{}).(string); ok {
+		return id
+	}
+	return ""
+}
+
+// isNewSession reports whether the request came without a signed session
+// cookie, a client which drops the cookie gets a new session every time.
+func isNewSession(r *http.Request) bool {
+	newSession, _ := r.Context().Value(ctxKeyNewSession{}).(bool)
+	return newSession
+}
+
+// ensureSessionID assigns a session ID cookie to visitors which do not
+// have one yet or whose cookie is not signed with one of the cookie keys.
+func ensureSessionID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var id string
+		if c, err := r.Cookie(cookieSessionID); err == nil {
+			id, _ = verifyCookie(cookieSessionID, c.Value)
+		}
+		ctx := r.Context()
+		if id == "" {
+			id = xid.New().String()
+			http.SetCookie(w, &http.Cookie{
+				Name:     cookieSessionID,
+				Value:    signCookie(cookieSessionID, id),
+				MaxAge:   cookieMaxAge,
+				HttpOnly: true,
+			})
+			ctx = context.WithValue(ctx, ctxKeyNewSession{}, true)
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, ctxKeySessionID{}, id)))
+	})
+}
+
+// cartSizeFromCookie returns the cart size remembered by setCartSize, which
+// saves looking up the cart on the pages not showing it.
+func cartSizeFromCookie(r *http.Request) int {
+	n := 0
+	if c, err := r.Cookie(cookiePrefix + cookieCartSize); err == nil {
+		n, _ = strconv.Atoi(c.Value)
+	}
+	return n
+}
+
+func setCartSize(w http.ResponseWriter, items []CartItem) {
+	http.SetCookie(w, &http.Cookie{
+		Name:   cookiePrefix + cookieCartSize,
+		Value:  strconv.Itoa(cartSize(items)),
+		MaxAge: cookieMaxAge,
+	})
+}
+
 func renderMoney(money Money) string {
 	return fmt.Sprintf("%s %d.%02d", money.CurrencyCode, money.Units, money.Nanos/10000000)
 }
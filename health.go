@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/render"
+	"github.com/pkg/errors"
+)
+
+const (
+	healthCheckTimeout = 2 * time.Second
+
+	healthOK      = "ok"
+	healthFailing = "failing"
+)
+
+// HealthCheck returns an error when the dependency it checks can not be used
+// to serve requests.
+type HealthCheck func(ctx context.Context) error
+
+// checkResult is the outcome of a single health check.
+type checkResult struct {
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// healthReport is the outcome of all the health checks, it is ok only when
+// all the checks are.
+type healthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks,omitempty"`
+}
+
+// healthRegistry holds the named readiness checks.
+type healthRegistry struct {
+	mu           sync.RWMutex
+	checks       map[string]HealthCheck
+	timeout      time.Duration
+	shuttingDown atomic.Bool
+}
+
+var health = newHealthRegistry(healthCheckTimeout)
+
+func newHealthRegistry(timeout time.Duration) *healthRegistry {
+	return &healthRegistry{checks: map[string]HealthCheck{}, timeout: timeout}
+}
+
+func init() {
+	health.Register("rates", checkRates)
+	health.Register("catalog", checkCatalog)
+	health.Register("templates", checkTemplates)
+	health.Register("carts", func(context.Context) error { return carts.Ping() })
+	health.Register("orders", func(context.Context) error { return orders.Ping() })
+}
+
+// Register adds the named check, replacing a check with the same name.
+func (h *healthRegistry) Register(name string, check HealthCheck) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks[name] = check
+}
+
+// SetShuttingDown makes the readiness fail so that no new traffic is routed
+// to the server while it is shutting down.
+func (h *healthRegistry) SetShuttingDown() {
+	h.shuttingDown.Store(true)
+}
+
+// Check runs all the checks concurrently, each one is given at most the
+// registry timeout.
+func (h *healthRegistry) Check(ctx context.Context) healthReport {
+	h.mu.RLock()
+	names := make([]string, 0, len(h.checks))
+	for name := range h.checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	checks := make([]HealthCheck, len(names))
+	for i, name := range names {
+		checks[i] = h.checks[name]
+	}
+	h.mu.RUnlock()
+
+	results := make([]checkResult, len(names))
+	var wg sync.WaitGroup
+	for i := range checks {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = h.run(ctx, checks[i])
+		}(i)
+	}
+	wg.Wait()
+
+	report := healthReport{Status: healthOK, Checks: map[string]checkResult{}}
+	if h.shuttingDown.Load() {
+		report.Checks["shutdown"] = checkResult{Status: healthFailing, Error: "server is shutting down"}
+		report.Status = healthFailing
+	}
+	for i, name := range names {
+		report.Checks[name] = results[i]
+		if results[i].Status != healthOK {
+			report.Status = healthFailing
+		}
+	}
+	return report
+}
+
+func (h *healthRegistry) run(ctx context.Context, check HealthCheck) checkResult {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- check(ctx) }()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = errors.Wrap(ctx.Err(), "check did not complete")
+	}
+
+	res := checkResult{Status: healthOK, Duration: time.Since(start).String()}
+	if err != nil {
+		res.Status, res.Error = healthFailing, err.Error()
+	}
+	return res
+}
+
+// checkRates fails when there are no currency rates or they were not
+// refreshed for longer than ratesMaxAge.
+func checkRates(context.Context) error {
+	at := RatesUpdatedAt()
+	if at.IsZero() || len(Rates()) == 0 {
+		return errors.New("no currency rates loaded")
+	}
+	if age := time.Since(at); age > ratesMaxAge {
+		return errors.Errorf("currency rates are stale: refreshed %s ago", age.Round(time.Second))
+	}
+	return nil
+}
+
+// checkCatalog fails when there are no products to sell.
+func checkCatalog(context.Context) error {
+	if len(catalog()) == 0 {
+		return errors.New("product catalog is empty")
+	}
+	return nil
+}
+
+// checkTemplates fails when one of the page templates is missing.
+func checkTemplates(context.Context) error {
+	if templates == nil {
+		return errors.New("templates are not loaded")
+	}
+	for _, name := range []string{"home", "product", "cart", "order", "error"} {
+		if templates.Lookup(name) == nil {
+			return errors.Errorf("template %q is not parsed", name)
+		}
+	}
+	return nil
+}
+
+// livezHandler reports that the process is up and serving requests.
+func livezHandler(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, healthReport{Status: healthOK})
+}
+
+// readyzHandler reports whether the server can handle traffic with the
+// details of every check. It responds 503 when any check fails.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	report := health.Check(r.Context())
+	if report.Status != healthOK {
+		render.Status(r, http.StatusServiceUnavailable)
+	}
+	render.JSON(w, r, report)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestHealthRegistryCheck(t *testing.T) {
+	h := newHealthRegistry(10 * time.Millisecond)
+	h.Register("ok", func(context.Context) error { return nil })
+	report := h.Check(context.Background())
+	if report.Status != healthOK {
+		t.Fatalf("Check() status = %q, want %q", report.Status, healthOK)
+	}
+
+	h.Register("broken", func(context.Context) error { return errors.New("boom") })
+	h.Register("stuck", func(ctx context.Context) error { <-ctx.Done(); time.Sleep(time.Millisecond); return nil })
+	report = h.Check(context.Background())
+	if report.Status != healthFailing {
+		t.Errorf("Check() status = %q, want %q", report.Status, healthFailing)
+	}
+	tests := []struct {
+		name, status, err string
+	}{
+		{"ok", healthOK, ""},
+		{"broken", healthFailing, "boom"},
+		{"stuck", healthFailing, "check did not complete: context deadline exceeded"},
+	}
+	for _, tt := range tests {
+		got := report.Checks[tt.name]
+		if got.Status != tt.status || got.Error != tt.err {
+			t.Errorf("check %q = %+v, want status %q and error %q", tt.name, got, tt.status, tt.err)
+		}
+	}
+}
+
+func TestHealthRegistryFailsWhileShuttingDown(t *testing.T) {
+	h := newHealthRegistry(time.Second)
+	h.Register("ok", func(context.Context) error { return nil })
+	h.SetShuttingDown()
+
+	report := h.Check(context.Background())
+	if report.Status != healthFailing || report.Checks["shutdown"].Status != healthFailing {
+		t.Errorf("Check() = %+v, want failing shutdown", report)
+	}
+}
+
+func TestCheckRates(t *testing.T) {
+	ratesMu.Lock()
+	saved, savedAt := rates, ratesUpdatedAt
+	ratesMu.Unlock()
+	defer func() {
+		ratesMu.Lock()
+		rates, ratesUpdatedAt = saved, savedAt
+		ratesMu.Unlock()
+	}()
+
+	tests := []struct {
+		name    string
+		rates   map[string]float64
+		age     time.Duration
+		wantErr bool
+	}{
+		{"fresh", map[string]float64{"EUR": 1}, time.Hour, false},
+		{"stale", map[string]float64{"EUR": 1}, ratesMaxAge + time.Minute, true},
+		{"empty", map[string]float64{}, time.Hour, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ratesMu.Lock()
+			rates, ratesUpdatedAt = tt.rates, time.Now().Add(-tt.age)
+			ratesMu.Unlock()
+			if err := checkRates(context.Background()); (err != nil) != tt.wantErr {
+				t.Errorf("checkRates() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReadyzReportsFailingChecks(t *testing.T) {
+	ratesMu.Lock()
+	saved, savedAt := rates, ratesUpdatedAt
+	rates, ratesUpdatedAt = map[string]float64{}, time.Time{}
+	ratesMu.Unlock()
+	defer func() {
+		ratesMu.Lock()
+		rates, ratesUpdatedAt = saved, savedAt
+		ratesMu.Unlock()
+	}()
+
+	w := httptest.NewRecorder()
+	RegisterRouter(defaultConfig()).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("GET /readyz code = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	var report healthReport
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"rates": healthFailing, "catalog": healthOK, "templates": healthOK, "carts": healthOK, "orders": healthOK,
+	} {
+		if got := report.Checks[name].Status; got != want {
+			t.Errorf("check %q status = %q, want %q", name, got, want)
+		}
+	}
+
+	for _, path := range []string{"/livez", "/_healthz"} {
+		w = httptest.NewRecorder()
+		RegisterRouter(defaultConfig()).ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("GET %s code = %d, want %d", path, w.Code, http.StatusOK)
+		}
+	}
+}
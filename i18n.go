@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/hlog"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/text/currency"
+	"golang.org/x/text/feature/plural"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+	"golang.org/x/text/number"
+)
+
+const (
+	cookieLocale  = cookiePrefix + "locale"
+	defaultLocale = "en"
+)
+
+// translation is a message translated to a locale, a fmt format. Messages
+// depending on a count have the CLDR plural forms, such as "one" and
+// "other", the others only "other".
+type translation map[string]string
+
+func (m *translation) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*m = translation{"other": s}
+		return nil
+	}
+	var forms map[string]string
+	if err := json.Unmarshal(b, &forms); err != nil {
+		return errors.New("message must be a string or an object of plural forms")
+	}
+	if forms["other"] == "" {
+		return errors.New(`plural forms must include "other"`)
+	}
+	*m = forms
+	return nil
+}
+
+// locale translates the storefront texts and formats numbers, amounts and
+// dates for a language.
+type locale struct {
+	tag      language.Tag
+	messages map[string]translation
+	printer  *message.Printer
+}
+
+var (
+	// locales lists the message catalogs, the default locale first.
+	locales       []*locale
+	localeMatcher language.Matcher
+)
+
+func init() {
+	if err := loadLocales(embedded, "locales"); err != nil {
+		log.Fatal().Err(err).Msg("failed to load the message catalogs")
+	}
+	log.Info().Int("locales", len(locales)).Msg("successfully parsed message catalogs from json")
+}
+
+// loadLocales reads the catalogs of the directory, named after their
+// language such as de.json. Messages missing from a catalog fall back to
+// the default locale.
+func loadLocales(fsys fs.FS, dir string) error {
+	files, err := fs.Glob(fsys, dir+"/*.json")
+	if err != nil {
+		return errors.Wrap(err, "could not list the message catalogs")
+	}
+	var ls []*locale
+	for _, file := range files {
+		name := strings.TrimSuffix(path.Base(file), ".json")
+		tag, err := language.Parse(name)
+		if err != nil {
+			return errors.Wrapf(err, "catalog %s is not named after a language", file)
+		}
+		b, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return errors.Wrapf(err, "could not read %s", file)
+		}
+		l := &locale{tag: tag, printer: message.NewPrinter(tag)}
+		if err := json.Unmarshal(b, &l.messages); err != nil {
+			return errors.Wrapf(err, "could not parse %s", file)
+		}
+		ls = append(ls, l)
+	}
+	sort.SliceStable(ls, func(i, j int) bool { return ls[i].tag.String() == defaultLocale && ls[j].tag.String() != defaultLocale })
+	if len(ls) == 0 || ls[0].tag.String() != defaultLocale {
+		return errors.Errorf("no %s message catalog", defaultLocale)
+	}
+
+	tags := make([]language.Tag, len(ls))
+	for i, l := range ls {
+		tags[i] = l.tag
+	}
+	locales, localeMatcher = ls, language.NewMatcher(tags)
+	return nil
+}
+
+// findLocale returns the locale of the language, nil when there is none.
+func findLocale(name string) *locale {
+	for _, l := range locales {
+		if l.tag.String() == name {
+			return l
+		}
+	}
+	return nil
+}
+
+// matchLocale picks the locale best matching the Accept-Language header.
+func matchLocale(acceptLanguage string) *locale {
+	tags, _, err := language.ParseAcceptLanguage(acceptLanguage)
+	if err != nil || len(tags) == 0 {
+		return locales[0]
+	}
+	_, i, confidence := localeMatcher.Match(tags...)
+	if confidence == language.No {
+		return locales[0]
+	}
+	return locales[i]
+}
+
+type ctxKeyLocale struct{}
+
+// localeHandler picks the locale of the locale cookie, or else the one
+// preferred by the browser.
+func localeHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var l *locale
+		if c, err := r.Cookie(cookieLocale); err == nil {
+			l = findLocale(c.Value)
+		}
+		if l == nil {
+			l = matchLocale(r.Header.Get("Accept-Language"))
+		}
+		w.Header().Set("Content-Language", l.tag.String())
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxKeyLocale{}, l)))
+	})
+}
+
+// requestLocale returns the locale of the request, the default one outside
+// of requests.
+func requestLocale(ctx context.Context) *locale {
+	if l, ok := ctx.Value(ctxKeyLocale{}).(*locale); ok {
+		return l
+	}
+	return locales[0]
+}
+
+func setLocaleHandler(w http.ResponseWriter, r *http.Request) {
+	l := hlog.FromRequest(r)
+	name := r.FormValue("locale")
+	if findLocale(name) == nil {
+		renderError(l, r, w, errors.Errorf("unsupported locale %q", name), http.StatusBadRequest)
+		return
+	}
+	l.Info().Str("locale.new", name).Str("locale.old", requestLocale(r.Context()).tag.String()).Msg("setting locale")
+	http.SetCookie(w, &http.Cookie{
+		Name:   cookieLocale,
+		Value:  name,
+		MaxAge: cookieMaxAge,
+	})
+	referer := r.Header.Get("referer")
+	if referer == "" {
+		referer = "/"
+	}
+	http.Redirect(w, r, referer, http.StatusFound)
+}
+
+// T translates the message. When the message has plural forms, the first
+// argument is the count choosing the form. Numbers are formatted for the
+// locale. Unknown keys are returned as is.
+func (l *locale) T(key string, args ...interface{}) string {
+	m := l.translation(key)
+	if m == nil {
+		return key
+	}
+	format := m["other"]
+	if len(m) > 1 && len(args) > 0 {
+		if n, ok := pluralCount(args[0]); ok {
+			if f := m[pluralForm(l.tag, n)]; f != "" {
+				format = f
+			}
+		}
+	}
+	return l.printer.Sprintf(format, args...)
+}
+
+// translation returns the message of the locale, or else of the default
+// locale, nil when there is none.
+func (l *locale) translation(key string) translation {
+	if m, ok := l.messages[key]; ok {
+		return m
+	}
+	return locales[0].messages[key]
+}
+
+func pluralCount(v interface{}) (int, bool) {
+	switch n := v.(type) {
+	case int:
+		return n, true
+	case int32:
+		return int(n), true
+	case int64:
+		return int(n), true
+	case uint32:
+		return int(n), true
+	}
+	return 0, false
+}
+
+// pluralForm returns the CLDR plural form of the count in the language.
+func pluralForm(tag language.Tag, n int) string {
+	if n < 0 {
+		n = -n
+	}
+	switch plural.Cardinal.MatchPlural(tag, n, 0, 0, 0, 0) {
+	case plural.Zero:
+		return "zero"
+	case plural.One:
+		return "one"
+	case plural.Two:
+		return "two"
+	case plural.Few:
+		return "few"
+	case plural.Many:
+		return "many"
+	}
+	return "other"
+}
+
+// Money formats the amount with the digits of its currency, e.g. no
+// decimals for JPY, and the separators of the locale.
+func (l *locale) Money(m Money) string {
+	scale := 2
+	if cur, err := currency.ParseISO(m.CurrencyCode); err == nil {
+		scale, _ = currency.Standard.Rounding(cur)
+	}
+	value := float64(m.Units) + float64(m.Nanos)/1e9
+	amount := l.printer.Sprint(number.Decimal(value, number.Scale(scale)))
+	return l.printer.Sprintf(l.translation("format.money")["other"], m.CurrencyCode, amount)
+}
+
+// Date formats the day with the layout of the locale, month names are
+// translated.
+func (l *locale) Date(t time.Time) string {
+	layout := l.translation("format.date")["other"]
+	s := t.Format(layout)
+	if strings.Contains(layout, "January") {
+		s = strings.Replace(s, t.Month().String(), l.T("month."+strconv.Itoa(int(t.Month()))), 1)
+	}
+	return s
+}
+
+// Attributes describes the attributes of a variant, e.g. "Color: black,
+// Size: M". Attributes and values without a message, such as sizes, are
+// shown as is.
+func (l *locale) Attributes(attrs map[string]string) string {
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		label, value := name, attrs[name]
+		if l.translation("attribute."+name) != nil {
+			label = l.T("attribute." + name)
+		}
+		if l.translation("attribute."+name+"."+value) != nil {
+			value = l.T("attribute." + name + "." + value)
+		}
+		parts[i] = l.T("format.attribute", label, value)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// localeOption is a choice of the language selector.
+type localeOption struct {
+	Tag, Name string
+}
+
+// funcs are the template funcs translating to the locale.
+func (l *locale) funcs() template.FuncMap {
+	return template.FuncMap{
+		"T":           l.T,
+		"renderMoney": l.Money,
+		"formatDate":  l.Date,
+		"attributes":  l.Attributes,
+		"locale":      func() string { return l.tag.String() },
+		"locales": func() []localeOption {
+			options := make([]localeOption, len(locales))
+			for i, o := range locales {
+				options[i] = localeOption{Tag: o.tag.String(), Name: o.T("locale.name")}
+			}
+			return options
+		},
+	}
+}
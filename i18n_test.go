@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var formatVerb = regexp.MustCompile(`%(\[\d\])?[sdv]`)
+
+func TestMessageCatalogsAreComplete(t *testing.T) {
+	en := locales[0]
+	for _, l := range locales[1:] {
+		for key, m := range en.messages {
+			tm, ok := l.messages[key]
+			if !ok {
+				t.Errorf("%s: %q is not translated", l.tag, key)
+				continue
+			}
+			want := len(formatVerb.FindAllString(m["other"], -1))
+			for form, f := range tm {
+				if got := len(formatVerb.FindAllString(f, -1)); got != want {
+					t.Errorf("%s: %q %s has %d arguments, want %d", l.tag, key, form, got, want)
+				}
+			}
+		}
+		for key := range l.messages {
+			if _, ok := en.messages[key]; !ok {
+				t.Errorf("%s: %q is not an %s message", l.tag, key, defaultLocale)
+			}
+		}
+	}
+}
+
+func TestTranslate(t *testing.T) {
+	tests := []struct {
+		locale string
+		key    string
+		args   []interface{}
+		want   string
+	}{
+		{"en", "cart.items", []interface{}{1}, "1 item in your Shopping Cart"},
+		{"en", "cart.items", []interface{}{2}, "2 items in your Shopping Cart"},
+		{"en", "cart.items", []interface{}{0}, "0 items in your Shopping Cart"},
+		{"en", "product.only_left", []interface{}{1234}, "Only 1,234 left in stock"},
+		{"de", "product.only_left", []interface{}{1234}, "Nur noch 1.234 auf Lager"},
+		{"ja", "cart.items", []interface{}{1}, "ショッピングカートに1点の商品があります"},
+		{"tr", "cart.sku", []interface{}{"OLJCESPC7Z"}, "Stok kodu: #OLJCESPC7Z"},
+		{"en", "no.such.key", nil, "no.such.key"},
+	}
+	for _, tt := range tests {
+		if got := findLocale(tt.locale).T(tt.key, tt.args...); got != tt.want {
+			t.Errorf("%s T(%q, %v) = %q, want %q", tt.locale, tt.key, tt.args, got, tt.want)
+		}
+	}
+
+	// missing messages fall back to the default locale
+	l := &locale{tag: findLocale("de").tag, messages: map[string]translation{}, printer: findLocale("de").printer}
+	if got := l.T("home.buy"); got != "Buy" {
+		t.Errorf("T() of a missing message = %q, want Buy", got)
+	}
+}
+
+func TestLocaleFormats(t *testing.T) {
+	day := time.Date(2026, time.March, 2, 15, 4, 0, 0, time.UTC)
+	tests := []struct {
+		locale    string
+		money     Money
+		wantMoney string
+		wantDate  string
+		wantZero  string
+	}{
+		{"en", Money{CurrencyCode: "USD", Units: 1234, Nanos: 500000000}, "USD 1,234.50", "March 2, 2026", "USD 0.00"},
+		{"de", Money{CurrencyCode: "EUR", Units: 1234, Nanos: 500000000}, "1.234,50 EUR", "2. März 2026", "0,00 EUR"},
+		{"ja", Money{CurrencyCode: "JPY", Units: 1234, Nanos: 600000000}, "JPY 1,235", "2026年3月2日", "JPY 0"},
+		{"tr", Money{CurrencyCode: "TRY", Units: 1234, Nanos: 500000000}, "1.234,50 TRY", "2 Mart 2026", "0,00 TRY"},
+	}
+	for _, tt := range tests {
+		l := findLocale(tt.locale)
+		if got := l.Money(tt.money); got != tt.wantMoney {
+			t.Errorf("%s Money(%v) = %q, want %q", tt.locale, tt.money, got, tt.wantMoney)
+		}
+		if got := l.Money(Money{CurrencyCode: tt.money.CurrencyCode}); got != tt.wantZero {
+			t.Errorf("%s Money(0) = %q, want %q", tt.locale, got, tt.wantZero)
+		}
+		if got := l.Date(day); got != tt.wantDate {
+			t.Errorf("%s Date() = %q, want %q", tt.locale, got, tt.wantDate)
+		}
+	}
+}
+
+func TestMatchLocale(t *testing.T) {
+	tests := map[string]string{
+		"":                         "en",
+		"de-AT,de;q=0.9,en;q=0.8":  "de",
+		"ja-JP":                    "ja",
+		"tr-TR,tr;q=0.9":           "tr",
+		"en-GB,en;q=0.9,de;q=0.5":  "en",
+		"fr-FR":                    "en",
+		"fr-FR,fr;q=0.9,ja;q=0.5":  "ja",
+		"not a language header!!!": "en",
+	}
+	for header, want := range tests {
+		if got := matchLocale(header).tag.String(); got != want {
+			t.Errorf("matchLocale(%q) = %s, want %s", header, got, want)
+		}
+	}
+}
+
+func TestLocalizedPages(t *testing.T) {
+	router := RegisterRouter(defaultConfig())
+	get := func(target string, header ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	tests := []struct {
+		name     string
+		header   []string
+		language string
+		text     string
+	}{
+		{"default", nil, "en", "Add to Cart"},
+		{"accept language", []string{"Accept-Language", "de-DE,de;q=0.9"}, "de", "In den Warenkorb"},
+		{"cookie over accept language", []string{"Accept-Language", "de", "Cookie", cookieLocale + "=ja"}, "ja", "カートに入れる"},
+		{"unknown cookie", []string{"Accept-Language", "tr", "Cookie", cookieLocale + "=xx"}, "tr", "Sepete ekle"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := get("/product/OLJCESPC7Z", tt.header...)
+			if w.Code != http.StatusOK {
+				t.Fatalf("code = %d, want %d", w.Code, http.StatusOK)
+			}
+			if got := w.Header().Get("Content-Language"); got != tt.language {
+				t.Errorf("Content-Language = %q, want %q", got, tt.language)
+			}
+			body := w.Body.String()
+			if !strings.Contains(body, tt.text) || !strings.Contains(body, `<html lang="`+tt.language+`">`) {
+				t.Errorf("page is not in %s, want %q", tt.language, tt.text)
+			}
+		})
+	}
+
+	set := func(locale string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/setLocale", strings.NewReader(url.Values{"locale": {locale}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Referer", "/cart")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+	w := set("tr")
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/cart" {
+		t.Errorf("setLocale code = %d, headers %v", w.Code, w.Header())
+	}
+	saved := false
+	for _, c := range w.Result().Cookies() {
+		saved = saved || c.Name == cookieLocale && c.Value == "tr"
+	}
+	if !saved {
+		t.Errorf("setLocale did not save the locale cookie: %v", w.Header()["Set-Cookie"])
+	}
+	if w := set("xx"); w.Code != http.StatusBadRequest {
+		t.Errorf("setLocale of an unknown locale code = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestLocalizedProducts(t *testing.T) {
+	for _, p := range ListProducts(context.Background()) {
+		for _, l := range locales[1:] {
+			if tr := p.Translations[l.tag.String()]; tr.Name == "" || tr.Description == "" {
+				t.Errorf("product %s is not translated to %s", p.Id, l.tag)
+			}
+		}
+	}
+
+	p := Product{Id: "X", Name: "Lamp", Description: "A lamp.", Translations: map[string]ProductText{
+		"de": {Name: "Lampe", Description: "Eine Lampe."},
+		"ja": {Name: "ランプ"},
+	}}
+	tests := []struct {
+		lang, name, description string
+	}{
+		{"en", "Lamp", "A lamp."},
+		{"de", "Lampe", "Eine Lampe."},
+		{"ja", "ランプ", "A lamp."},
+		{"tr", "Lamp", "A lamp."},
+	}
+	for _, tt := range tests {
+		got := p.Localized(tt.lang)
+		if got.Name != tt.name || got.Description != tt.description || got.Translations != nil {
+			t.Errorf("Localized(%s) = %+v, want %q, %q", tt.lang, got, tt.name, tt.description)
+		}
+	}
+
+	search := func(lang, query string) []string {
+		ctx := context.WithValue(context.Background(), ctxKeyLocale{}, findLocale(lang))
+		ps, err := SearchProducts(ctx, query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := make([]string, len(ps))
+		for i, p := range ps {
+			ids[i] = p.Id
+		}
+		return ids
+	}
+	if got := search("de", "schreibmaschine"); len(got) != 1 || got[0] != "OLJCESPC7Z" {
+		t.Errorf("search in de = %v, want the typewriter", got)
+	}
+	if got := search("en", "schreibmaschine"); len(got) != 0 {
+		t.Errorf("search in en = %v, want none", got)
+	}
+	if got := search("ja", "タイプライター"); len(got) != 1 || got[0] != "OLJCESPC7Z" {
+		t.Errorf("search in ja = %v, want the typewriter", got)
+	}
+
+	router := RegisterRouter(defaultConfig())
+	get := func(target string) Product {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.Header.Set("Accept-Language", "de")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		var p Product
+		if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+			t.Fatalf("GET %s: %v: %s", target, err, w.Body.String())
+		}
+		return p
+	}
+	if p := get("/product/OLJCESPC7Z?json=1"); p.Name != "Vintage-Schreibmaschine" || p.Translations != nil {
+		t.Errorf("product JSON = %+v, want the de name only", p)
+	}
+	if p := get("/product/OLJCESPC7Z?json=1&translations=all"); p.Name != "Vintage Typewriter" || p.Translations["ja"].Name != "ヴィンテージタイプライター" {
+		t.Errorf("product JSON with all translations = %+v", p)
+	}
+}
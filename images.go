@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	// picturesDir holds the product pictures, relative to the static
+	// directory, and variantsDir their resized variants, relative to the
+	// pictures.
+	picturesDir = "img/products"
+	variantsDir = "variants"
+
+	maxUploadBytes    = 10 << 20
+	minImageSide      = 160
+	maxImageSide      = 8000
+	pictureQuality    = 90
+	variantQuality    = 85
+	webpQuality       = 80
+	webpEncodeTimeout = 30 * time.Second
+)
+
+var (
+	ErrInvalidImage = errors.New("invalid image")
+	ErrImageExists  = errors.New("a picture with this name already exists")
+	ErrNoStaticDir  = errors.New("pictures can only be written to a static_dir")
+)
+
+// imageWidths are the widths of the variants of a picture: the thumbnail of
+// the cart, the cards of the home page and the recommendations and the
+// product page. Variants are never wider than the picture itself.
+var imageWidths = []int{160, 400, 800}
+
+// imageSet renders a picture: Src is the picture itself, JPEG and WebP are
+// the srcset attributes of its variants, empty when there are none. The URLs
+// are fingerprinted.
+type imageSet struct {
+	Src  string `json:"src"`
+	JPEG string `json:"jpegSrcset,omitempty"`
+	WebP string `json:"webpSrcset,omitempty"`
+}
+
+// webpEncoder encodes a PNG file to a WebP file.
+type webpEncoder interface {
+	EncodeWebP(ctx context.Context, src, dst string) error
+}
+
+// cwebp encodes with the cwebp tool of libwebp, there is no WebP encoder in
+// the Go standard library.
+type cwebp struct {
+	path    string
+	quality int
+}
+
+func (c cwebp) EncodeWebP(ctx context.Context, src, dst string) error {
+	ctx, cancel := context.WithTimeout(ctx, webpEncodeTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, c.path, "-quiet", "-q", strconv.Itoa(c.quality), src, "-o", dst).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "cwebp failed: %s", bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// imageStore saves the product pictures and their variants in the static
+// directory. With the embedded static files there is no directory to write
+// to, the pictures are shown without variants then.
+type imageStore struct {
+	// staticDir is empty with the embedded static files.
+	staticDir string
+	// webp is nil when WebP variants are not generated.
+	webp webpEncoder
+
+	saveMu sync.Mutex
+
+	mu   sync.Mutex
+	sets map[string]imageSet
+}
+
+var images = newImageStore("", nil)
+
+func newImageStore(staticDir string, webp webpEncoder) *imageStore {
+	return &imageStore{staticDir: staticDir, webp: webp, sets: map[string]imageSet{}}
+}
+
+// SetupImages sets the static directory, empty with the embedded static
+// files, and looks up the cwebp tool, WebP variants are not generated
+// without it. It must be called before serving
+// requests.
+func SetupImages(staticDir, cwebpPath string) {
+	var enc webpEncoder
+	if cwebpPath != "" {
+		if p, err := exec.LookPath(cwebpPath); err == nil {
+			enc = cwebp{path: p, quality: webpQuality}
+		} else {
+			log.Warn().Str("cwebp", cwebpPath).Msg("cwebp not found, WebP pictures are not generated")
+		}
+	}
+	images = newImageStore(staticDir, enc)
+}
+
+// staticFile returns the file of the /static/ URL, it reports false for
+// other URLs and for paths leaving the static directory.
+func staticFile(staticDir, url string) (string, bool) {
+	rel := strings.TrimPrefix(url, "/static/")
+	if rel == url || strings.Contains(rel, "..") {
+		return "", false
+	}
+	return filepath.Join(staticDir, filepath.FromSlash(rel)), true
+}
+
+// Set returns how to render the picture. It is cached until the variants of
+// the picture are generated again.
+func (s *imageStore) Set(picture string) imageSet {
+	s.mu.Lock()
+	set, ok := s.sets[picture]
+	s.mu.Unlock()
+	if ok {
+		return set
+	}
+
+	set = imageSet{Src: assets.URL(picture)}
+	file, ok := staticFile(s.staticDir, picture)
+	if !ok || s.staticDir == "" {
+		return set
+	}
+	var jpegs, webps []string
+	widths := s.variantWidths(file, ".jpg")
+	for _, w := range widths {
+		jpegs = append(jpegs, assets.URL(variantURL(picture, w, ".jpg"))+" "+strconv.Itoa(w)+"w")
+	}
+	for _, w := range s.variantWidths(file, ".webp") {
+		webps = append(webps, assets.URL(variantURL(picture, w, ".webp"))+" "+strconv.Itoa(w)+"w")
+	}
+	if len(widths) > 0 {
+		// the picture itself is the largest candidate
+		if width, _ := imageSize(file); width > widths[len(widths)-1] {
+			jpegs = append(jpegs, set.Src+" "+strconv.Itoa(width)+"w")
+		}
+	}
+	set.JPEG, set.WebP = strings.Join(jpegs, ", "), strings.Join(webps, ", ")
+
+	s.mu.Lock()
+	s.sets[picture] = set
+	s.mu.Unlock()
+	return set
+}
+
+// variantWidths lists the widths of the variants of the picture file in the
+// format, narrowest first.
+func (s *imageStore) variantWidths(file, ext string) []int {
+	base := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	matches, _ := filepath.Glob(filepath.Join(filepath.Dir(file), variantsDir, base+"-*"+ext))
+	var widths []int
+	for _, m := range matches {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(m), base+"-"), ext)
+		if w, err := strconv.Atoi(suffix); err == nil {
+			widths = append(widths, w)
+		}
+	}
+	sort.Ints(widths)
+	return widths
+}
+
+func variantFile(file string, width int, ext string) string {
+	base := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	return filepath.Join(filepath.Dir(file), variantsDir, base+"-"+strconv.Itoa(width)+ext)
+}
+
+func variantURL(picture string, width int, ext string) string {
+	base := strings.TrimSuffix(path.Base(picture), path.Ext(picture))
+	return path.Join(path.Dir(picture), variantsDir, base+"-"+strconv.Itoa(width)+ext)
+}
+
+// Generate writes the variants of the picture which are missing or older
+// than the picture and returns how many were written.
+func (s *imageStore) Generate(ctx context.Context, picture string) (int, error) {
+	if s.staticDir == "" {
+		return 0, ErrNoStaticDir
+	}
+	file, ok := staticFile(s.staticDir, picture)
+	if !ok {
+		return 0, errors.Errorf("picture %q is not under /static/", picture)
+	}
+	fi, err := os.Stat(file)
+	if err != nil {
+		return 0, errors.Wrap(err, "could not read the picture")
+	}
+	width, err := imageSize(file)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(filepath.Join(filepath.Dir(file), variantsDir), 0755); err != nil {
+		return 0, errors.Wrap(err, "could not create the variants directory")
+	}
+
+	var (
+		img     image.Image
+		written int
+		done    = map[int]bool{}
+	)
+	for _, w := range imageWidths {
+		if w > width {
+			w = width
+		}
+		if done[w] {
+			continue
+		}
+		done[w] = true
+		jpegFile, webpFile := variantFile(file, w, ".jpg"), variantFile(file, w, ".webp")
+		needJPEG := !newerThan(jpegFile, fi.ModTime())
+		needWebP := s.webp != nil && !newerThan(webpFile, fi.ModTime())
+		if !needJPEG && !needWebP {
+			continue
+		}
+		if img == nil {
+			if img, err = decodeImageFile(file); err != nil {
+				return written, err
+			}
+		}
+		v := resizeImage(img, w)
+		if needJPEG {
+			if err := writeFileAtomic(jpegFile, func(w io.Writer) error {
+				return jpeg.Encode(w, v, &jpeg.Options{Quality: variantQuality})
+			}); err != nil {
+				return written, err
+			}
+			written++
+		}
+		if needWebP {
+			if err := s.encodeWebP(ctx, webpFile, v); err != nil {
+				return written, err
+			}
+			written++
+		}
+	}
+
+	s.mu.Lock()
+	delete(s.sets, picture)
+	s.mu.Unlock()
+	return written, nil
+}
+
+// GenerateAll generates the missing variants of the pictures, e.g. of the
+// catalog on start. Failures are logged.
+func (s *imageStore) GenerateAll(ctx context.Context, pictures []string) {
+	written := 0
+	for _, p := range pictures {
+		if ctx.Err() != nil {
+			return
+		}
+		n, err := s.Generate(ctx, p)
+		if err != nil {
+			log.Error().Err(err).Str("picture", p).Msg("unable to generate picture variants")
+		}
+		written += n
+	}
+	log.Info().Int("pictures", len(pictures)).Int("variants", written).Bool("webp", s.webp != nil).Msg("picture variants generated")
+}
+
+// encodeWebP writes the image as a temporary PNG for the encoder.
+func (s *imageStore) encodeWebP(ctx context.Context, dst string, img image.Image) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), ".*.png")
+	if err != nil {
+		return errors.Wrap(err, "could not encode the WebP picture")
+	}
+	defer os.Remove(tmp.Name())
+	err = png.Encode(tmp, img)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return errors.Wrap(err, "could not encode the WebP picture")
+	}
+	if err := s.webp.EncodeWebP(ctx, tmp.Name(), dst+".tmp"); err != nil {
+		os.Remove(dst + ".tmp")
+		return err
+	}
+	return errors.Wrap(os.Rename(dst+".tmp", dst), "could not save the WebP picture")
+}
+
+// Save validates the uploaded JPEG, PNG or WebP picture and saves it as a
+// JPEG with its variants under the name. Saving it again strips its
+// metadata, such as the location the photo was taken at. It returns the
+// URL of the picture.
+func (s *imageStore) Save(ctx context.Context, name string, r io.Reader) (string, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(r, maxUploadBytes+1))
+	if err != nil {
+		return "", errors.Wrap(err, "could not read the picture")
+	}
+	if len(b) > maxUploadBytes {
+		return "", errors.Wrapf(ErrInvalidImage, "picture is larger than %d MB", maxUploadBytes>>20)
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return "", errors.Wrap(ErrInvalidImage, "picture is not a JPEG, PNG or WebP image")
+	}
+	if cfg.Width < minImageSide || cfg.Height < minImageSide || cfg.Width > maxImageSide || cfg.Height > maxImageSide {
+		return "", errors.Wrapf(ErrInvalidImage, "picture of %dx%d pixels, its sides must be between %d and %d pixels",
+			cfg.Width, cfg.Height, minImageSide, maxImageSide)
+	}
+	img, _, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		return "", errors.Wrap(ErrInvalidImage, err.Error())
+	}
+
+	if name == "" {
+		return "", errors.Wrap(ErrInvalidImage, "picture name is required")
+	}
+	if s.staticDir == "" {
+		return "", ErrNoStaticDir
+	}
+	picture := "/static/" + picturesDir + "/" + name + ".jpg"
+	file, _ := staticFile(s.staticDir, picture)
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	if _, err := os.Stat(file); err == nil {
+		return "", errors.Wrapf(ErrImageExists, "picture %s", picture)
+	}
+	if err := writeFileAtomic(file, func(w io.Writer) error {
+		return jpeg.Encode(w, resizeImage(img, cfg.Width), &jpeg.Options{Quality: pictureQuality})
+	}); err != nil {
+		return "", err
+	}
+	if _, err := s.Generate(ctx, picture); err != nil {
+		return picture, err
+	}
+	return picture, nil
+}
+
+// pictureName turns the name of an uploaded file into a picture name such
+// as "desk-lamp".
+func pictureName(s string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(s) {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+		if b.Len() >= 64 {
+			break
+		}
+	}
+	return b.String()
+}
+
+// resizeImage scales the image to the width, keeping its aspect ratio, onto
+// a white background since JPEG has no transparency.
+func resizeImage(src image.Image, width int) image.Image {
+	b := src.Bounds()
+	height := b.Dy() * width / b.Dx()
+	if height < 1 {
+		height = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, b, draw.Over, nil)
+	return dst
+}
+
+func imageSize(file string) (int, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, errors.Wrap(err, "could not read the picture")
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return 0, errors.Wrapf(err, "could not decode the picture %s", file)
+	}
+	return cfg.Width, nil
+}
+
+func decodeImageFile(file string) (image.Image, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read the picture")
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	return img, errors.Wrapf(err, "could not decode the picture %s", file)
+}
+
+func newerThan(file string, t time.Time) bool {
+	fi, err := os.Stat(file)
+	return err == nil && !fi.ModTime().Before(t)
+}
+
+// writeFileAtomic writes to a temporary file which then replaces the file,
+// so that it is never left half written.
+func writeFileAtomic(file string, write func(io.Writer) error) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".*")
+	if err != nil {
+		return errors.Wrapf(err, "could not write %s", file)
+	}
+	defer os.Remove(tmp.Name())
+	err = write(tmp)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return errors.Wrapf(err, "could not write %s", file)
+	}
+	if fi, err := os.Stat(file); err == nil {
+		os.Chmod(tmp.Name(), fi.Mode())
+	} else {
+		os.Chmod(tmp.Name(), 0644)
+	}
+	return errors.Wrapf(os.Rename(tmp.Name(), file), "could not write %s", file)
+}
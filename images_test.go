@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// copyWebP pretends to encode WebP by copying the PNG.
+type copyWebP struct{ calls int }
+
+func (c *copyWebP) EncodeWebP(_ context.Context, src, dst string) error {
+	c.calls++
+	b, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dst, b, 0644)
+}
+
+func testPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		img.Set(x, height/2, color.NRGBA{R: 255, A: 128})
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func newTestImageStore(t *testing.T, webp webpEncoder) *imageStore {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, filepath.FromSlash(picturesDir)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return newImageStore(dir, webp)
+}
+
+func TestImageStoreSave(t *testing.T) {
+	webp := &copyWebP{}
+	s := newTestImageStore(t, webp)
+
+	picture, err := s.Save(context.Background(), "desk-lamp", bytes.NewReader(testPNG(t, 1000, 500)))
+	if err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	if picture != "/static/img/products/desk-lamp.jpg" {
+		t.Errorf("Save() = %s", picture)
+	}
+	for _, w := range imageWidths {
+		f, _ := staticFile(s.staticDir, variantURL(picture, w, ".jpg"))
+		if got, err := imageSize(f); err != nil || got != w {
+			t.Errorf("variant %d is %d wide, %v", w, got, err)
+		}
+	}
+	if webp.calls != len(imageWidths) {
+		t.Errorf("%d WebP variants encoded, want %d", webp.calls, len(imageWidths))
+	}
+
+	want := imageSet{
+		Src: picture,
+		JPEG: "/static/img/products/variants/desk-lamp-160.jpg 160w, /static/img/products/variants/desk-lamp-400.jpg 400w, " +
+			"/static/img/products/variants/desk-lamp-800.jpg 800w, /static/img/products/desk-lamp.jpg 1000w",
+		WebP: "/static/img/products/variants/desk-lamp-160.webp 160w, /static/img/products/variants/desk-lamp-400.webp 400w, " +
+			"/static/img/products/variants/desk-lamp-800.webp 800w",
+	}
+	if got := s.Set(picture); got != want {
+		t.Errorf("Set() = %+v\nwant %+v", got, want)
+	}
+
+	if _, err := s.Save(context.Background(), "desk-lamp", bytes.NewReader(testPNG(t, 1000, 500))); errors.Cause(err) != ErrImageExists {
+		t.Errorf("Save() twice error = %v, want %v", err, ErrImageExists)
+	}
+}
+
+func TestImageStoreSaveRejectsInvalidImages(t *testing.T) {
+	s := newTestImageStore(t, nil)
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"not an image", []byte("<html></html>")},
+		{"too small", testPNG(t, 100, 400)},
+		{"too large", testPNG(t, maxImageSide+1, 200)},
+		{"too heavy", append(testPNG(t, 200, 200), make([]byte, maxUploadBytes)...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := s.Save(context.Background(), "x", bytes.NewReader(tt.data)); errors.Cause(err) != ErrInvalidImage {
+				t.Errorf("Save() error = %v, want %v", err, ErrInvalidImage)
+			}
+		})
+	}
+	if _, err := s.Save(context.Background(), "", bytes.NewReader(testPNG(t, 200, 200))); errors.Cause(err) != ErrInvalidImage {
+		t.Errorf("Save() without a name error = %v, want %v", err, ErrInvalidImage)
+	}
+}
+
+func TestImageStoreGenerate(t *testing.T) {
+	s := newTestImageStore(t, nil)
+	picture, err := s.Save(context.Background(), "mug", bytes.NewReader(testPNG(t, 300, 300)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// variants are never wider than the picture
+	want := imageSet{
+		Src:  picture,
+		JPEG: "/static/img/products/variants/mug-160.jpg 160w, /static/img/products/variants/mug-300.jpg 300w",
+	}
+	if got := s.Set(picture); got != want {
+		t.Errorf("Set() = %+v, want %+v", got, want)
+	}
+
+	if n, err := s.Generate(context.Background(), picture); err != nil || n != 0 {
+		t.Errorf("Generate() of up to date variants = %d, %v", n, err)
+	}
+	file, _ := staticFile(s.staticDir, picture)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(file, later, later)
+	if n, err := s.Generate(context.Background(), picture); err != nil || n != 2 {
+		t.Errorf("Generate() of a changed picture = %d, %v, want 2", n, err)
+	}
+
+	if got := s.Set("/static/img/products/none.jpg"); got != (imageSet{Src: "/static/img/products/none.jpg"}) {
+		t.Errorf("Set() of a picture without variants = %+v", got)
+	}
+	if _, err := s.Generate(context.Background(), "/static/../products.json"); err == nil {
+		t.Error("Generate() accepted a file outside the static directory")
+	}
+}
+
+func TestPictureName(t *testing.T) {
+	tests := map[string]string{
+		"Desk Lamp!":            "desk-lamp",
+		"IMG_2031":              "img-2031",
+		"../../etc/passwd":      "etc-passwd",
+		"--":                    "",
+		strings.Repeat("a", 80): strings.Repeat("a", 64),
+	}
+	for in, want := range tests {
+		if got := pictureName(in); got != want {
+			t.Errorf("pictureName(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestUploadImageHandler(t *testing.T) {
+	saved := images
+	defer func() { images = saved }()
+	images = newTestImageStore(t, nil)
+	savedAssets := assets
+	defer func() { assets = savedAssets }()
+	assets = newAssetStore(os.DirFS(images.staticDir))
+
+	cfg := defaultConfig()
+	cfg.AdminPassword = "s3cret"
+	cfg.StaticDir = images.staticDir
+	router := RegisterRouter(cfg)
+	upload := func(filename string, data []byte) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, _ := mw.CreateFormFile("image", filename)
+		fw.Write(data)
+		mw.Close()
+		r := httptest.NewRequest(http.MethodPost, "/admin/images?json=1", &body)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		r.SetBasicAuth("admin", "s3cret")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	w := upload("City Bike.png", testPNG(t, 500, 400))
+	if w.Code != http.StatusCreated || !strings.Contains(w.Body.String(), `"picture":"/static/img/products/city-bike.jpg","src":"/static/img/products/city-bike.`) {
+		t.Errorf("upload code = %d, body %s", w.Code, w.Body)
+	}
+	if w := upload("City Bike.png", testPNG(t, 500, 400)); w.Code != http.StatusConflict {
+		t.Errorf("second upload code = %d, want %d", w.Code, http.StatusConflict)
+	}
+	if w := upload("notes.txt", []byte("hello")); w.Code != http.StatusBadRequest {
+		t.Errorf("text upload code = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
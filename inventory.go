@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog/log"
+)
+
+// reservationTTL is how long reserved stock is held for a checkout which
+// has neither been paid nor released.
+const reservationTTL = 15 * time.Minute
+
+var (
+	ErrOutOfStock          = errors.New("not enough items in stock")
+	ErrReservationNotFound = errors.New("stock reservation not found or expired")
+)
+
+// reservation is stock held for a checkout in progress.
+type reservation struct {
+	items     map[string]int
+	expiresAt time.Time
+}
+
+// inventoryStore tracks the stock by SKU, the product ID for products
+// without variants. SKUs without a stock level are not tracked and never
+// run out of stock.
+type inventoryStore struct {
+	mu           sync.Mutex
+	stock        map[string]int
+	reserved     map[string]int
+	reservations map[string]reservation
+	ttl          time.Duration
+	now          func() time.Time
+}
+
+var inventory = newInventoryStore(nil, reservationTTL)
+
+func newInventoryStore(stock map[string]int, ttl time.Duration) *inventoryStore {
+	s := &inventoryStore{
+		stock:        map[string]int{},
+		reserved:     map[string]int{},
+		reservations: map[string]reservation{},
+		ttl:          ttl,
+		now:          time.Now,
+	}
+	for sku, n := range stock {
+		s.stock[sku] = n
+	}
+	return s
+}
+
+func init() {
+	c, err := embedded.ReadFile("inventory.json")
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to open inventory json file")
+	}
+	inv := map[string]map[string]int{}
+	if err := json.Unmarshal(c, &inv); err != nil {
+		log.Fatal().Err(err).Msg("failed to parse the inventory JSON")
+	}
+	inventory = newInventoryStore(inv["stock"], reservationTTL)
+	log.Info().Int("skus", len(inv["stock"])).Msg("successfully parsed stock from json")
+}
+
+// Available returns the stock of the SKU which is not reserved and whether
+// the SKU is tracked at all.
+func (s *inventoryStore) Available(sku string) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+	n, ok := s.stock[sku]
+	return n - s.reserved[sku], ok
+}
+
+// InStock reports whether the quantity of the SKU can be sold.
+func (s *inventoryStore) InStock(sku string, quantity int) bool {
+	n, tracked := s.Available(sku)
+	return !tracked || n >= quantity
+}
+
+// ProductInStock reports whether the product, or one of its variants, can
+// be sold.
+func (s *inventoryStore) ProductInStock(p Product) bool {
+	for _, sku := range p.skus() {
+		if s.InStock(sku, 1) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reserve holds the stock of all the items at once and returns the
+// reservation ID. Nothing is reserved if one of the items is out of stock.
+func (s *inventoryStore) Reserve(items []CartItem) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+
+	wanted := map[string]int{}
+	for _, it := range items {
+		if _, ok := s.stock[it.SKU()]; ok {
+			wanted[it.SKU()] += it.Quantity
+		}
+	}
+	for sku, n := range wanted {
+		if left := s.stock[sku] - s.reserved[sku]; left < n {
+			return "", errors.Wrapf(ErrOutOfStock, "sku #%s: %d requested, %d available", sku, n, left)
+		}
+	}
+
+	id := xid.New().String()
+	for sku, n := range wanted {
+		s.reserved[sku] += n
+	}
+	s.reservations[id] = reservation{items: wanted, expiresAt: s.now().Add(s.ttl)}
+	return id, nil
+}
+
+// Commit takes the reserved items out of the stock once they are paid.
+func (s *inventoryStore) Commit(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+	r, ok := s.reservations[id]
+	if !ok {
+		return errors.Wrap(ErrReservationNotFound, id)
+	}
+	for sku, n := range r.items {
+		s.reserved[sku] -= n
+		s.stock[sku] -= n
+	}
+	delete(s.reservations, id)
+	return nil
+}
+
+// Release returns the reserved items to the available stock.
+func (s *inventoryStore) Release(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.release(id)
+}
+
+// Restock puts sold items back into the stock, e.g. of a cancelled order.
+func (s *inventoryStore) Restock(items []CartItem) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, it := range items {
+		if _, ok := s.stock[it.SKU()]; ok {
+			s.stock[it.SKU()] += it.Quantity
+		}
+	}
+}
+
+func (s *inventoryStore) release(id string) {
+	for sku, n := range s.reservations[id].items {
+		s.reserved[sku] -= n
+	}
+	delete(s.reservations, id)
+}
+
+// expire releases the reservations which have timed out. Must be called
+// with the lock held.
+func (s *inventoryStore) expire() {
+	now := s.now()
+	for id, r := range s.reservations {
+		if !now.Before(r.expiresAt) {
+			s.release(id)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestInventoryReserveIsAllOrNothing(t *testing.T) {
+	s := newInventoryStore(map[string]int{"a": 2, "b": 1}, time.Minute)
+
+	_, err := s.Reserve([]CartItem{{"a", "", 2}, {"b", "", 2}})
+	if errors.Cause(err) != ErrOutOfStock {
+		t.Fatalf("Reserve() error = %v, want %v", err, ErrOutOfStock)
+	}
+	if n, _ := s.Available("a"); n != 2 {
+		t.Errorf("failed reservation held stock: %d of a available, want 2", n)
+	}
+
+	if _, err := s.Reserve([]CartItem{{"a", "", 1}, {"a", "", 1}, {"untracked", "", 100}}); err != nil {
+		t.Fatalf("Reserve() error = %v", err)
+	}
+	if n, _ := s.Available("a"); n != 0 {
+		t.Errorf("%d of a available, want 0", n)
+	}
+	if !s.InStock("untracked", 1000) {
+		t.Error("untracked product is out of stock")
+	}
+}
+
+func TestInventoryTracksVariants(t *testing.T) {
+	s := newInventoryStore(map[string]int{"p-s": 1, "p-m": 0}, time.Minute)
+	p := Product{Id: "p", Variants: []Variant{{Sku: "p-s"}, {Sku: "p-m"}}}
+	if !s.ProductInStock(p) {
+		t.Fatal("product with a variant in stock is out of stock")
+	}
+	if _, err := s.Reserve([]CartItem{{"p", "p-s", 1}}); err != nil {
+		t.Fatalf("Reserve() error = %v", err)
+	}
+	if n, _ := s.Available("p-s"); n != 0 {
+		t.Errorf("%d of p-s available, want 0", n)
+	}
+	if s.ProductInStock(p) {
+		t.Error("product with all variants reserved is in stock")
+	}
+	if _, tracked := s.Available("p"); tracked {
+		t.Error("product of variants is tracked itself")
+	}
+}
+
+func TestInventoryCommitAndRelease(t *testing.T) {
+	s := newInventoryStore(map[string]int{"a": 5}, time.Minute)
+
+	paid, _ := s.Reserve([]CartItem{{"a", "", 2}})
+	failed, _ := s.Reserve([]CartItem{{"a", "", 3}})
+	if s.InStock("a", 1) {
+		t.Fatal("reserved stock is still available")
+	}
+
+	if err := s.Commit(paid); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+	s.Release(failed)
+	if n, _ := s.Available("a"); n != 3 {
+		t.Errorf("%d of a available, want 3", n)
+	}
+	if err := s.Commit(failed); errors.Cause(err) != ErrReservationNotFound {
+		t.Errorf("Commit() of released reservation error = %v, want %v", err, ErrReservationNotFound)
+	}
+
+	s.Restock([]CartItem{{"a", "", 2}})
+	if n, _ := s.Available("a"); n != 5 {
+		t.Errorf("%d of a available after restock, want 5", n)
+	}
+}
+
+func TestInventoryReservationExpires(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	s := newInventoryStore(map[string]int{"a": 1}, time.Minute)
+	s.now = func() time.Time { return now }
+
+	id, err := s.Reserve([]CartItem{{"a", "", 1}})
+	if err != nil {
+		t.Fatalf("Reserve() error = %v", err)
+	}
+	if s.InStock("a", 1) {
+		t.Fatal("reserved stock is still available")
+	}
+
+	now = now.Add(time.Minute)
+	if !s.InStock("a", 1) {
+		t.Error("expired reservation still holds stock")
+	}
+	if err := s.Commit(id); errors.Cause(err) != ErrReservationNotFound {
+		t.Errorf("Commit() of expired reservation error = %v, want %v", err, ErrReservationNotFound)
+	}
+}
+
+func TestInventoryConcurrentReservationsDoNotOversell(t *testing.T) {
+	const stock, buyers = 50, 200
+	s := newInventoryStore(map[string]int{"a": stock, "b": stock}, time.Minute)
+
+	var (
+		wg       sync.WaitGroup
+		reserved int64
+		failed   int64
+	)
+	for i := 0; i < buyers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id, err := s.Reserve([]CartItem{{"a", "", 1}, {"b", "", 1}})
+			if err != nil {
+				atomic.AddInt64(&failed, 1)
+				return
+			}
+			atomic.AddInt64(&reserved, 1)
+			// every other buyer fails to pay and gives the stock back
+			if i%2 == 0 {
+				if err := s.Commit(id); err != nil {
+					t.Error(err)
+				}
+			} else {
+				s.Release(id)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	a, _ := s.Available("a")
+	b, _ := s.Available("b")
+	if a < 0 || b < 0 || a != b {
+		t.Errorf("oversold: %d of a and %d of b available", a, b)
+	}
+	if sold := stock - a; sold > stock || int64(sold) > reserved {
+		t.Errorf("sold %d items with %d reservations", sold, reserved)
+	}
+	if reserved+failed != buyers {
+		t.Errorf("%d reserved and %d failed of %d buyers", reserved, failed, buyers)
+	}
+}
+
+func TestInventoryConcurrentCheckoutSellsExactStock(t *testing.T) {
+	const stock, buyers = 20, 100
+	s := newInventoryStore(map[string]int{"a": stock}, time.Minute)
+
+	var (
+		wg   sync.WaitGroup
+		sold int64
+	)
+	for i := 0; i < buyers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id, err := s.Reserve([]CartItem{{"a", "", 1}})
+			if errors.Cause(err) == ErrOutOfStock {
+				return
+			} else if err != nil {
+				t.Error(err)
+				return
+			}
+			if err := s.Commit(id); err != nil {
+				t.Error(err)
+				return
+			}
+			atomic.AddInt64(&sold, 1)
+		}()
+	}
+	wg.Wait()
+
+	if sold != stock {
+		t.Errorf("sold %d items, want %d", sold, stock)
+	}
+	if n, _ := s.Available("a"); n != 0 {
+		t.Errorf("%d items available, want 0", n)
+	}
+}
+
+func TestCheckoutRefundsWhenTheReservationIsLost(t *testing.T) {
+	const session = "lost-reservation-test"
+	saved := inventory
+	defer func() { inventory = saved }()
+	// reservations expire right away
+	inventory = newInventoryStore(map[string]int{"66VCHSJNUP": 5}, -time.Second)
+	defer carts.EmptyCart(session)
+	carts.AddItem(session, CartItem{ProductId: "66VCHSJNUP", Quantity: 2})
+
+	r := httptest.NewRequest(http.MethodPost, "/cart/checkout", strings.NewReader(checkoutForm().Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(&http.Cookie{Name: cookieSessionID, Value: signCookie(cookieSessionID, session)})
+	w := httptest.NewRecorder()
+	RegisterRouter(defaultConfig()).ServeHTTP(w, r)
+	if w.Code != http.StatusConflict {
+		t.Errorf("checkout code = %d, want %d", w.Code, http.StatusConflict)
+	}
+	if n, _ := inventory.Available("66VCHSJNUP"); n != 5 {
+		t.Errorf("%d items available, want 5", n)
+	}
+	if got := carts.GetCart(session); len(got) != 1 {
+		t.Errorf("cart = %v, want it kept", got)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/go-chi/render"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/hlog"
+	"github.com/rs/zerolog/log"
+)
+
+// setupLogging sets the global log level and writes the logs either as
+// human readable console lines or as JSON.
+func setupLogging(level, format string) {
+	if l, err := zerolog.ParseLevel(level); err == nil {
+		zerolog.SetGlobalLevel(l)
+	}
+	log.Logger = newLogger(format, os.Stderr)
+}
+
+func newLogger(format string, w io.Writer) zerolog.Logger {
+	if format == logFormatJSON {
+		return zerolog.New(w).With().Timestamp().Logger()
+	}
+	return zerolog.New(zerolog.ConsoleWriter{Out: w, TimeFormat: time.RFC3339Nano}).With().Timestamp().Logger()
+}
+
+// requestLogger samples the debug and info lines logged by the handlers:
+// the first burst lines of every second are kept, then one out of every
+// rate. Warnings and errors are always kept. A zero burst disables
+// sampling.
+func requestLogger(logger zerolog.Logger, burst, rate int) zerolog.Logger {
+	if burst <= 0 {
+		return logger
+	}
+	s := &zerolog.BurstSampler{
+		Burst:       uint32(burst),
+		Period:      time.Second,
+		NextSampler: &zerolog.BasicSampler{N: uint32(rate)},
+	}
+	return logger.Sample(zerolog.LevelSampler{DebugSampler: s, InfoSampler: s})
+}
+
+// logLevelHandler returns the global log level.
+func logLevelHandler(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, map[string]string{"level": zerolog.GlobalLevel().String()})
+}
+
+// setLogLevelHandler changes the global log level to the level form value,
+// e.g. to debug a running server. It lasts until the server restarts.
+func setLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	l := hlog.FromRequest(r)
+	level, err := zerolog.ParseLevel(r.FormValue("level"))
+	if err != nil || r.FormValue("level") == "" {
+		renderError(l, r, w, errors.Errorf("unknown log level %q", r.FormValue("level")), http.StatusBadRequest)
+		return
+	}
+	previous := zerolog.GlobalLevel()
+	zerolog.SetGlobalLevel(level)
+	// logged without a level so that it is written whatever the new level
+	l.Log().Str("level", level.String()).Str("previous", previous.String()).Msg("log level changed")
+	render.JSON(w, r, map[string]string{"level": level.String(), "previous": previous.String()})
+}
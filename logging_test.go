@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"github.com/rs/zerolog"
+)
+
+func TestNewLoggerJSON(t *testing.T) {
+	var buf bytes.Buffer
+	l := newLogger(logFormatJSON, &buf)
+	l.Info().Str("order", "42").Msg("order placed")
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("log line %q is not JSON: %v", buf.String(), err)
+	}
+	for k, want := range map[string]string{"level": "info", "order": "42", "message": "order placed"} {
+		if line[k] != want {
+			t.Errorf("%s = %v, want %s", k, line[k], want)
+		}
+	}
+	if _, ok := line["time"]; !ok {
+		t.Error("log line has no time")
+	}
+}
+
+func TestRequestLoggerSamples(t *testing.T) {
+	tests := []struct {
+		name        string
+		burst, rate int
+		wantInfo    int
+	}{
+		{"sampling", 3, 5, 3 + 3},
+		{"disabled", 0, 5, 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			l := requestLogger(zerolog.New(&buf), tt.burst, tt.rate)
+			for i := 0; i < 20; i++ {
+				l.Info().Msg("home handler")
+				l.Warn().Msg("unable to commit stock reservation")
+			}
+			if got := strings.Count(buf.String(), `"level":"info"`); got != tt.wantInfo {
+				t.Errorf("%d info lines logged, want %d", got, tt.wantInfo)
+			}
+			if got := strings.Count(buf.String(), `"level":"warn"`); got != 20 {
+				t.Errorf("%d warn lines logged, want all 20", got)
+			}
+		})
+	}
+}
+
+func TestLogLevelHandler(t *testing.T) {
+	defer zerolog.SetGlobalLevel(zerolog.GlobalLevel())
+	zerolog.SetGlobalLevel(zerolog.InfoLevel)
+
+	cfg := defaultConfig()
+	cfg.AdminPassword = "s3cret"
+	router := RegisterRouter(cfg)
+	do := func(method, target, user, password string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, nil)
+		if user != "" {
+			r.SetBasicAuth(user, password)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	tests := []struct {
+		name, method, target, user, password string
+		wantCode                             int
+		wantLevel                            zerolog.Level
+	}{
+		{"no credentials", http.MethodPut, "/admin/log-level?level=debug", "", "", http.StatusUnauthorized, zerolog.InfoLevel},
+		{"wrong password", http.MethodPut, "/admin/log-level?level=debug", "admin", "guess", http.StatusUnauthorized, zerolog.InfoLevel},
+		{"get", http.MethodGet, "/admin/log-level", "admin", "s3cret", http.StatusOK, zerolog.InfoLevel},
+		{"unknown level", http.MethodPut, "/admin/log-level?level=loud&json=1", "admin", "s3cret", http.StatusBadRequest, zerolog.InfoLevel},
+		{"set", http.MethodPut, "/admin/log-level?level=debug", "admin", "s3cret", http.StatusOK, zerolog.DebugLevel},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := do(tt.method, tt.target, tt.user, tt.password)
+			if w.Code != tt.wantCode {
+				t.Errorf("%s %s code = %d, want %d", tt.method, tt.target, w.Code, tt.wantCode)
+			}
+			if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Error("no WWW-Authenticate header")
+			}
+			if got := zerolog.GlobalLevel(); got != tt.wantLevel {
+				t.Errorf("global level = %s, want %s", got, tt.wantLevel)
+			}
+		})
+	}
+
+	err := chi.Walk(RegisterRouter(defaultConfig()), func(_, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+		if strings.HasPrefix(route, "/admin") {
+			t.Errorf("route %s is registered without an admin password", route)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
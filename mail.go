@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	htmltemplate "html/template"
+	"io"
+	"io/fs"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	mailerLog  = "log"
+	mailerFile = "file"
+	mailerSMTP = "smtp"
+
+	defaultMailFrom = "Online Boutique <shop@example.com>"
+
+	mailQueueSize   = 100
+	mailWorkers     = 2
+	mailMaxAttempts = 5
+	mailBackoff     = 2 * time.Second
+	mailMaxBackoff  = time.Minute
+	// smtpTimeout bounds the whole SMTP exchange of an email.
+	smtpTimeout = 30 * time.Second
+)
+
+// Order emails, named after their templates.
+const (
+	mailOrderPlaced   = "order_placed"
+	mailOrderShipped  = "order_shipped"
+	mailOrderRefunded = "order_refunded"
+)
+
+var (
+	ErrMailQueueFull   = errors.New("mail queue is full")
+	ErrMailQueueClosed = errors.New("mail queue is closed")
+)
+
+// Mail is an email with a text and an HTML body.
+type Mail struct {
+	From    string
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Mailer sends emails.
+type Mailer interface {
+	Send(ctx context.Context, m Mail) error
+}
+
+// newMailer returns the mailer of the kind, see config.Mailer.
+func newMailer(kind, dir, smtpAddr, smtpUser, smtpPassword string) (Mailer, error) {
+	switch kind {
+	case "", mailerLog:
+		return logMailer{}, nil
+	case mailerFile:
+		return fileMailer{dir: dir}, nil
+	case mailerSMTP:
+		host, _, err := net.SplitHostPort(smtpAddr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid SMTP address %q", smtpAddr)
+		}
+		m := smtpMailer{addr: smtpAddr, host: host}
+		if smtpUser != "" {
+			m.auth = smtp.PlainAuth("", smtpUser, smtpPassword, host)
+		}
+		return m, nil
+	}
+	return nil, errors.Errorf("unknown mailer %q", kind)
+}
+
+// logMailer logs the emails instead of sending them, which is meant for
+// development. The text body, which holds the customer details, is only
+// logged at debug level.
+type logMailer struct{}
+
+func (logMailer) Send(_ context.Context, m Mail) error {
+	log.Info().Str("to", m.To).Str("subject", m.Subject).Msg("email")
+	log.Debug().Str("to", m.To).Str("subject", m.Subject).Str("text", m.Text).Msg("email text")
+	return nil
+}
+
+// fileMailer writes the emails to .eml files of the directory.
+type fileMailer struct {
+	dir string
+}
+
+func (f fileMailer) Send(_ context.Context, m Mail) error {
+	b, err := m.message(time.Now())
+	if err != nil {
+		return err
+	}
+	name := filepath.Join(f.dir, strconv.FormatInt(time.Now().UnixNano(), 10)+"-"+xid.New().String()+".eml")
+	return writeFileAtomic(name, func(w io.Writer) error {
+		_, err := w.Write(b)
+		return err
+	})
+}
+
+// smtpMailer sends the emails to an SMTP server, with STARTTLS when the
+// server supports it. Authentication requires TLS unless the server is on
+// localhost.
+type smtpMailer struct {
+	addr, host string
+	auth       smtp.Auth
+}
+
+func (s smtpMailer) Send(ctx context.Context, m Mail) error {
+	from, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return errors.Wrap(err, "invalid sender")
+	}
+	to, err := mail.ParseAddress(m.To)
+	if err != nil {
+		return permanentMailError{errors.Wrap(err, "invalid recipient")}
+	}
+	b, err := m.message(time.Now())
+	if err != nil {
+		return err
+	}
+	err = s.send(ctx, from.Address, to.Address, b)
+	if tpErr, ok := err.(*textproto.Error); ok && tpErr.Code >= 500 {
+		return permanentMailError{err}
+	}
+	return errors.Wrap(err, "could not send the email")
+}
+
+// send does what smtp.SendMail does, within smtpTimeout and until the
+// context is done.
+func (s smtpMailer) send(ctx context.Context, from, to string, msg []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, smtpTimeout)
+	defer cancel()
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	// unblock the exchange when the context is cancelled
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+
+	c, err := smtp.NewClient(conn, s.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: s.host}); err != nil {
+			return err
+		}
+	}
+	if s.auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("the SMTP server does not support authentication")
+		}
+		if err := c.Auth(s.auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// permanentMailError is a failure that would fail again, such as an
+// invalid address.
+type permanentMailError struct {
+	error
+}
+
+// message returns the email in the MIME format, with both bodies as
+// alternatives.
+func (m Mail) message(now time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	header := []struct{ key, value string }{
+		{"From", m.From},
+		{"To", m.To},
+		{"Subject", mime.QEncoding.Encode("utf-8", m.Subject)},
+		{"Date", now.Format(time.RFC1123Z)},
+		{"Message-ID", "<" + xid.New().String() + "@" + mailDomain(m.From) + ">"},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", mime.FormatMediaType("multipart/alternative", map[string]string{"boundary": mw.Boundary()})},
+	}
+	for _, h := range header {
+		if strings.ContainsAny(h.value, "\r\n") {
+			return nil, errors.Errorf("line break in the %s header", h.key)
+		}
+		buf.WriteString(h.key + ": " + h.value + "\r\n")
+	}
+	buf.WriteString("\r\n")
+
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", m.Text},
+		{"text/html; charset=utf-8", m.HTML},
+	} {
+		if part.body == "" {
+			continue
+		}
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "could not write the email")
+		}
+		qw := quotedprintable.NewWriter(pw)
+		if _, err := qw.Write([]byte(part.body)); err != nil {
+			return nil, errors.Wrap(err, "could not write the email")
+		}
+		if err := qw.Close(); err != nil {
+			return nil, errors.Wrap(err, "could not write the email")
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, errors.Wrap(err, "could not write the email")
+	}
+	return buf.Bytes(), nil
+}
+
+// mailDomain returns the domain of the address, for the message IDs.
+func mailDomain(address string) string {
+	if a, err := mail.ParseAddress(address); err == nil {
+		if i := strings.LastIndexByte(a.Address, '@'); i >= 0 {
+			return a.Address[i+1:]
+		}
+	}
+	return "localhost"
+}
+
+// mailQueue sends the emails in the background, retrying failed ones with
+// exponential backoff so that checkout does not wait for the mail server.
+type mailQueue struct {
+	mailer Mailer
+	from   string
+	mails  chan Mail
+
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+
+	mu     sync.Mutex
+	closed bool
+
+	// ctx is cancelled to abort the retries left on shutdown.
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+var mails = newMailQueue(logMailer{}, defaultMailFrom)
+
+func newMailQueue(m Mailer, from string) *mailQueue {
+	ctx, cancel := context.WithCancel(context.Background())
+	q := &mailQueue{
+		mailer:      m,
+		from:        from,
+		mails:       make(chan Mail, mailQueueSize),
+		maxAttempts: mailMaxAttempts,
+		backoff:     mailBackoff,
+		maxBackoff:  mailMaxBackoff,
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+	q.wg.Add(mailWorkers)
+	for i := 0; i < mailWorkers; i++ {
+		go func() {
+			defer q.wg.Done()
+			for m := range q.mails {
+				q.send(m)
+			}
+		}()
+	}
+	return q
+}
+
+// SetMailer sends the emails with the mailer from the address. It must be
+// called before serving requests.
+func SetMailer(m Mailer, from string) {
+	old := mails
+	mails = newMailQueue(m, from)
+	old.Close(context.Background())
+}
+
+// Enqueue queues the email for sending, from the queue address when it has
+// no sender. It fails rather than waiting when the queue is full.
+func (q *mailQueue) Enqueue(m Mail) error {
+	if m.From == "" {
+		m.From = q.from
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return ErrMailQueueClosed
+	}
+	select {
+	case q.mails <- m:
+		return nil
+	default:
+		mailsSent.WithLabelValues("dropped").Inc()
+		return errors.Wrapf(ErrMailQueueFull, "%d emails waiting", mailQueueSize)
+	}
+}
+
+// send tries to send the email until it succeeds, fails permanently, runs
+// out of attempts or the queue is closed.
+func (q *mailQueue) send(m Mail) {
+	logger := log.With().Str("to", m.To).Str("subject", m.Subject).Logger()
+	if q.ctx.Err() != nil {
+		mailsSent.WithLabelValues("failed").Inc()
+		logger.Error().Msg("email abandoned on shutdown")
+		return
+	}
+	for attempt := 1; ; attempt++ {
+		err := q.mailer.Send(q.ctx, m)
+		if err == nil {
+			mailsSent.WithLabelValues("sent").Inc()
+			logger.Debug().Int("attempt", attempt).Msg("email sent")
+			return
+		}
+		if _, permanent := err.(permanentMailError); permanent || attempt == q.maxAttempts {
+			mailsSent.WithLabelValues("failed").Inc()
+			logger.Error().Err(err).Int("attempts", attempt).Msg("email abandoned")
+			return
+		}
+		wait := exponentialBackoff(q.backoff, q.maxBackoff, attempt)
+		mailsSent.WithLabelValues("retried").Inc()
+		logger.Warn().Err(err).Int("attempt", attempt).Dur("retry_in", wait).Msg("email sending failed")
+		t := time.NewTimer(wait)
+		select {
+		case <-q.ctx.Done():
+			t.Stop()
+			mailsSent.WithLabelValues("failed").Inc()
+			logger.Error().Err(err).Int("attempts", attempt).Msg("email abandoned on shutdown")
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Close sends the queued emails until the context is done, the emails being
+// sent are then aborted and the ones left are abandoned.
+func (q *mailQueue) Close(ctx context.Context) {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.mails)
+	}
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		q.cancel()
+		<-done
+	}
+	q.cancel()
+}
+
+// mailTemplates renders the emails, the HTML bodies with html/template and
+// the text bodies with text/template so that they are not escaped.
+type mailTemplates struct {
+	html *htmltemplate.Template
+	text *texttemplate.Template
+}
+
+var emailTemplates *mailTemplates
+
+// LoadMailTemplates parses the email templates of the email directory of
+// the templates directory, or the embedded ones when it is empty. It must
+// be called before serving requests.
+func LoadMailTemplates(dir string) error {
+	fsys, err := fs.Sub(contentFS(dir, "templates"), "email")
+	if err != nil {
+		return errors.Wrap(err, "could not open the email templates")
+	}
+	t, err := parseMailTemplates(fsys)
+	if err != nil {
+		return err
+	}
+	emailTemplates = t
+	return nil
+}
+
+func parseMailTemplates(fsys fs.FS) (*mailTemplates, error) {
+	html, err := htmltemplate.New("").Funcs(locales[0].funcs()).ParseFS(fsys, "*.html")
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse the HTML email templates")
+	}
+	text, err := texttemplate.New("").Funcs(locales[0].funcs()).ParseFS(fsys, "*.txt")
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse the text email templates")
+	}
+	return &mailTemplates{html: html, text: text}, nil
+}
+
+// Render renders the email with the templates named after it, translated
+// to the locale. The templates get the subject with the data.
+func (t *mailTemplates) Render(l *locale, name, subject string, data map[string]interface{}) (Mail, error) {
+	m := Mail{Subject: subject}
+	data["subject"] = subject
+
+	html, err := t.html.Clone()
+	if err != nil {
+		return Mail{}, errors.Wrap(err, "could not clone the HTML email templates")
+	}
+	var buf bytes.Buffer
+	if err := html.Funcs(l.funcs()).ExecuteTemplate(&buf, name+".html", data); err != nil {
+		return Mail{}, errors.Wrapf(err, "could not render the %s email", name)
+	}
+	m.HTML = buf.String()
+
+	text, err := t.text.Clone()
+	if err != nil {
+		return Mail{}, errors.Wrap(err, "could not clone the text email templates")
+	}
+	buf.Reset()
+	if err := text.Funcs(l.funcs()).ExecuteTemplate(&buf, name+".txt", data); err != nil {
+		return Mail{}, errors.Wrapf(err, "could not render the %s email", name)
+	}
+	m.Text = buf.String()
+	return m, nil
+}
+
+// notifyOrder emails the customer about the order in the language of the
+// checkout. Failures are logged, they do not fail the order.
+func notifyOrder(name string, o Order) {
+	if o.Email == "" || emailTemplates == nil {
+		return
+	}
+	l := findLocale(o.Locale)
+	if l == nil {
+		l = locales[0]
+	}
+	subject := l.T("email."+name+".subject", o.OrderId)
+	m, err := emailTemplates.Render(l, name, subject, map[string]interface{}{"order": o})
+	if err == nil {
+		m.To = o.Email
+		err = mails.Enqueue(m)
+	}
+	if err != nil {
+		log.Error().Err(err).Str("order", o.OrderId).Str("email", name).Msg("unable to send order email")
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"html"
+	"io"
+	"io/fs"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+func TestMailMessage(t *testing.T) {
+	m := Mail{
+		From:    defaultMailFrom,
+		To:      "Jane <jane@example.com>",
+		Subject: "Ihre Bestellung ist bestätigt",
+		Text:    "Grüße & Dank",
+		HTML:    "<p>Grüße &amp; Dank</p>",
+	}
+	b, err := m.message(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(string(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject")); got != m.Subject {
+		t.Errorf("Subject = %q, want %q", got, m.Subject)
+	}
+	if got := msg.Header.Get("Message-ID"); !strings.HasSuffix(got, "@example.com>") {
+		t.Errorf("Message-ID = %q, want the sender domain", got)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("Content-Type = %q, %v", mediaType, err)
+	}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for _, want := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", m.Text},
+		{"text/html; charset=utf-8", m.HTML},
+	} {
+		p, err := mr.NextRawPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(quotedprintable.NewReader(p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := p.Header.Get("Content-Type"); got != want.contentType || string(body) != want.body {
+			t.Errorf("part = %q %q, want %q %q", got, body, want.contentType, want.body)
+		}
+	}
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Errorf("NextPart() after the bodies error = %v, want EOF", err)
+	}
+
+	m.To = "jane@example.com\r\nBcc: all@example.com"
+	if _, err := m.message(time.Now()); err == nil {
+		t.Error("message() accepted a line break in the To header")
+	}
+}
+
+func TestFileMailer(t *testing.T) {
+	dir := t.TempDir()
+	m, err := newMailer(mailerFile, dir, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Send(context.Background(), Mail{From: defaultMailFrom, To: "jane@example.com", Subject: "Hello", Text: "Hi"}); err != nil {
+		t.Fatal(err)
+	}
+	names, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if len(names) != 1 {
+		t.Fatalf("emails written = %v, want one", names)
+	}
+	f, err := os.Open(names[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	msg, err := mail.ReadMessage(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := msg.Header.Get("To"); got != "jane@example.com" {
+		t.Errorf("To = %q, want jane@example.com", got)
+	}
+}
+
+func TestLogMailerKeepsTheTextAtDebug(t *testing.T) {
+	saved := log.Logger
+	defer func() { log.Logger = saved }()
+	defer zerolog.SetGlobalLevel(zerolog.GlobalLevel())
+	m := Mail{From: defaultMailFrom, To: "jane@example.com", Subject: "Hello", Text: "Ship to 1600 Amphitheatre Parkway"}
+
+	for _, tt := range []struct {
+		level    zerolog.Level
+		wantText bool
+	}{{zerolog.InfoLevel, false}, {zerolog.DebugLevel, true}} {
+		var buf bytes.Buffer
+		log.Logger = zerolog.New(&buf)
+		zerolog.SetGlobalLevel(tt.level)
+		if err := (logMailer{}).Send(context.Background(), m); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(buf.String(), "Hello") {
+			t.Errorf("%s: log = %q, want the subject", tt.level, buf.String())
+		}
+		if got := strings.Contains(buf.String(), "Amphitheatre"); got != tt.wantText {
+			t.Errorf("%s: text logged = %v, want %v", tt.level, got, tt.wantText)
+		}
+	}
+}
+
+// fakeSMTPServer answers the SMTP commands of one client, the replies to
+// RCPT are given, and sends the received message to the channel.
+func fakeSMTPServer(t *testing.T, rcptReply string) (string, <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	msgs := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tp := textproto.NewConn(conn)
+		tp.PrintfLine("220 localhost ESMTP")
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+			switch cmd := strings.ToUpper(strings.Fields(line + " ")[0]); cmd {
+			case "EHLO", "HELO", "MAIL":
+				tp.PrintfLine("250 OK")
+			case "RCPT":
+				tp.PrintfLine(rcptReply)
+			case "DATA":
+				tp.PrintfLine("354 go ahead")
+				b, err := tp.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				msgs <- string(b)
+				tp.PrintfLine("250 queued")
+			case "QUIT":
+				tp.PrintfLine("221 bye")
+				return
+			default:
+				tp.PrintfLine("502 unknown command")
+			}
+		}
+	}()
+	return ln.Addr().String(), msgs
+}
+
+func TestSMTPMailer(t *testing.T) {
+	m := Mail{From: defaultMailFrom, To: "jane@example.com", Subject: "Hello", Text: "Hi"}
+
+	addr, msgs := fakeSMTPServer(t, "250 OK")
+	mailer, err := newMailer(mailerSMTP, "", addr, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mailer.Send(context.Background(), m); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	if msg := <-msgs; !strings.Contains(msg, "Subject: Hello") {
+		t.Errorf("message = %q, want the email", msg)
+	}
+
+	addr, _ = fakeSMTPServer(t, "550 no such user")
+	mailer, _ = newMailer(mailerSMTP, "", addr, "", "")
+	if err := mailer.Send(context.Background(), m); err == nil {
+		t.Error("Send() to a rejected recipient succeeded")
+	} else if _, ok := err.(permanentMailError); !ok {
+		t.Errorf("Send() to a rejected recipient error = %v, want a permanent error", err)
+	}
+
+	// a server which never answers
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	mailer, _ = newMailer(mailerSMTP, "", ln.Addr().String(), "", "")
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := mailer.Send(ctx, m); err == nil {
+		t.Error("Send() to a silent server succeeded")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Send() returned after %v, want it to stop with the context", d)
+	}
+}
+
+// blockingMailer sends nothing until the context is done.
+type blockingMailer struct {
+	mu    sync.Mutex
+	calls int
+}
+
+func (b *blockingMailer) Send(ctx context.Context, _ Mail) error {
+	b.mu.Lock()
+	b.calls++
+	b.mu.Unlock()
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestMailQueueCloseAbandonsQueuedMails(t *testing.T) {
+	b := &blockingMailer{}
+	q := newMailQueue(b, defaultMailFrom)
+	for i := 0; i < 10; i++ {
+		if err := q.Enqueue(Mail{To: "jane@example.com", Subject: "Hello"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	q.Close(ctx)
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Close() returned after %v, want it to stop with the context", d)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.calls != mailWorkers {
+		t.Errorf("%d emails tried, want only the %d being sent when the context was done", b.calls, mailWorkers)
+	}
+}
+
+// fakeMailer fails the first sends with its errors.
+type fakeMailer struct {
+	mu   sync.Mutex
+	errs []error
+	sent []Mail
+}
+
+func (f *fakeMailer) Send(_ context.Context, m Mail) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		return err
+	}
+	f.sent = append(f.sent, m)
+	return nil
+}
+
+func TestMailQueueRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		errs     []error
+		wantSent bool
+	}{
+		{"sent", nil, true},
+		{"retried", []error{errors.New("connection refused"), errors.New("timeout")}, true},
+		{"permanent failure", []error{permanentMailError{errors.New("no such user")}}, false},
+		{"out of attempts", []error{errors.New("1"), errors.New("2"), errors.New("3")}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeMailer{errs: tt.errs}
+			q := newMailQueue(f, defaultMailFrom)
+			q.maxAttempts, q.backoff, q.maxBackoff = 3, time.Millisecond, time.Millisecond
+			if err := q.Enqueue(Mail{To: "jane@example.com", Subject: "Hello"}); err != nil {
+				t.Fatal(err)
+			}
+			// Close waits for the email to be sent or abandoned.
+			q.Close(context.Background())
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			if got := len(f.sent) == 1; got != tt.wantSent {
+				t.Fatalf("sent = %v, want %v", f.sent, tt.wantSent)
+			}
+			if tt.wantSent && f.sent[0].From != defaultMailFrom {
+				t.Errorf("From = %q, want the queue sender", f.sent[0].From)
+			}
+			if err := q.Enqueue(Mail{To: "jane@example.com"}); errors.Cause(err) != ErrMailQueueClosed {
+				t.Errorf("Enqueue() after Close() error = %v, want ErrMailQueueClosed", err)
+			}
+		})
+	}
+}
+
+func emailFS(t *testing.T) fs.FS {
+	fsys, err := fs.Sub(embedded, "templates/email")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fsys
+}
+
+func TestOrderEmails(t *testing.T) {
+	templates, err := parseMailTemplates(emailFS(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	eur := func(units int64, nanos int32) Money { return Money{CurrencyCode: "EUR", Units: units, Nanos: nanos} }
+	o := Order{
+		OrderId:            "c0ffee",
+		Email:              "jane@example.com",
+		ShippingTrackingId: "TRACK-42",
+		ShippingCost:       eur(8, 990000000),
+		ShippingAddress:    Address{StreetAddress: "1 Rue <Haute>", City: "Paris", Country: "France", ZipCode: "75001"},
+		Items: []OrderItem{{
+			Item:     Product{Name: "Sunglasses"},
+			Quantity: 2,
+			Cost:     eur(38, 0),
+		}},
+		Tax:       TaxBreakdown{Total: eur(0, 0)},
+		Total:     eur(46, 990000000),
+		Paid:      eur(46, 990000000),
+		Refunded:  eur(46, 990000000),
+		CreatedAt: time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC),
+	}
+	tests := []struct {
+		locale, name string
+		status       OrderStatus
+		want         []string
+	}{
+		{"en", mailOrderPlaced, OrderPaid, []string{"Thank you for your order!", "c0ffee", "Sunglasses", "46.99", "1 Rue <Haute>"}},
+		{"en", mailOrderShipped, OrderShipped, []string{"Your order is on its way!", "TRACK-42"}},
+		{"en", mailOrderRefunded, OrderRefunded, []string{"Your order has been refunded", "We have refunded EUR 46.99"}},
+		{"de", mailOrderPlaced, OrderPaid, []string{"Vielen Dank für Ihre Bestellung!", "46,99", "Lieferadresse"}},
+		{"de", mailOrderRefunded, OrderCancelled, []string{"Ihre Bestellung wurde storniert", "46,99"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.locale+"/"+tt.name+"/"+string(tt.status), func(t *testing.T) {
+			o := o
+			o.Status = tt.status
+			l := findLocale(tt.locale)
+			m, err := templates.Render(l, tt.name, l.T("email."+tt.name+".subject", o.OrderId), map[string]interface{}{"order": o})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(m.Subject, o.OrderId) {
+				t.Errorf("Subject = %q, want the order ID", m.Subject)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(m.Text, want) {
+					t.Errorf("text body does not contain %q:\n%s", want, m.Text)
+				}
+				if !strings.Contains(m.HTML, html.EscapeString(want)) {
+					t.Errorf("HTML body does not contain %q:\n%s", want, m.HTML)
+				}
+			}
+		})
+	}
+}
+
+func TestNotifyOrder(t *testing.T) {
+	templates, err := parseMailTemplates(emailFS(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeMailer{}
+	oldQueue, oldTemplates := mails, emailTemplates
+	mails, emailTemplates = newMailQueue(f, defaultMailFrom), templates
+	defer func() { mails, emailTemplates = oldQueue, oldTemplates }()
+
+	notifyOrder(mailOrderShipped, Order{OrderId: "c0ffee", Locale: "unknown", Paid: Money{CurrencyCode: "USD"}})
+	notifyOrder(mailOrderShipped, Order{OrderId: "c0ffee", Email: "jane@example.com", Locale: "de", Paid: Money{CurrencyCode: "USD"}})
+	mails.Close(context.Background())
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.sent) != 1 {
+		t.Fatalf("emails sent = %d, want only the one with an address", len(f.sent))
+	}
+	if got, want := f.sent[0].Subject, "Ihre Bestellung c0ffee wurde versandt"; got != want || f.sent[0].To != "jane@example.com" {
+		t.Errorf("email = %q to %q, want %q to jane@example.com", got, f.sent[0].To, want)
+	}
+}
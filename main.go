@@ -2,61 +2,130 @@ package main
 
 import (
 	"context"
-	"net/http"
+	"flag"
+	"net"
 	"os"
 	"os/signal"
-	"strconv"
-	"time"
+	"syscall"
 
-	"github.com/caarlos0/env"
-	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
-type config struct {
-	Port int `env:"port" envDefault:"3000"`
+func main() {
+	cfg, printConfig, err := loadConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	} else if err != nil {
+		log.Fatal().Err(err).Msg("Unable to load configuration")
+	}
+	if printConfig {
+		if err := cfg.Print(os.Stdout); err != nil {
+			log.Fatal().Err(err).Msg("Unable to print configuration")
+		}
+		return
+	}
 
-	BannerColor string `env:"BANNER_COLOR" envDefault:"green"`
-}
+	setupLogging(cfg.LogLevel, cfg.LogFormat)
 
-func main() {
-	log.Logger = log.Output(
-		zerolog.ConsoleWriter{
-			Out:        os.Stderr,
-			TimeFormat: time.RFC3339Nano,
-		},
-	)
-
-	cfg := config{}
-	err := env.Parse(&cfg)
+	SetCurrencies(cfg.Currencies)
+	ratesSource = cfg.RatesSource
+	if len(cfg.CookieKeys) == 0 {
+		log.Warn().Msg("No cookie keys configured, sessions will not survive a restart")
+	}
+	if len(cfg.TrustedProxies) == 0 && limitsPerIP(cfg.RateLimits) {
+		log.Warn().Msg("Rate limiting per IP without trusted proxies, behind a proxy all the clients share its limits")
+	}
+	if cfg.AdminPassword == "" {
+		log.Info().Msg("No admin password configured, the admin routes are disabled")
+	}
+	SetCookieKeys(cfg.CookieKeys)
+	SetFeatureFlags(cfg.FeatureFlags(), cfg.FlagOverrides)
+	SetWebhooks(cfg.Webhooks, cfg.WebhookDeadLetterPath)
+	mailer, err := newMailer(cfg.Mailer, cfg.MailDir, cfg.SMTPAddr, cfg.SMTPUser, cfg.SMTPPassword)
 	if err != nil {
-		log.Fatal().Err(err).Msg("Unable to parse configuration values")
+		log.Fatal().Err(err).Msg("Unable to set up the mailer")
 	}
-
-	srv := http.Server{
-		Addr:    ":" + strconv.Itoa(cfg.Port),
-		Handler: RegisterRouter(),
+	SetMailer(mailer, cfg.MailFrom)
+	if cfg.Mailer == mailerLog {
+		log.Info().Msg("Logging the order emails instead of sending them")
+	}
+	if err := LoadCatalog(cfg.CatalogPath); err != nil {
+		log.Fatal().Err(err).Msg("Unable to load product catalog")
+	}
+	if cfg.CatalogPath == "" && cfg.AdminPassword != "" {
+		log.Warn().Msg("No catalog path configured, catalog changes will be lost on restart")
+	}
+	if err := LoadReviews(cfg.ReviewsPath); err != nil {
+		log.Fatal().Err(err).Msg("Unable to load product reviews")
+	}
+	if cfg.ReviewsPath == "" {
+		log.Warn().Msg("No reviews path configured, product reviews will be lost on restart")
+	}
+	if cfg.StaticDir == "" {
+		log.Info().Msg("Serving the embedded static files, picture variants and uploads are disabled")
+	}
+	SetupImages(cfg.StaticDir, cfg.CWebP)
+	if err := LoadAssets(cfg.StaticDir); err != nil {
+		log.Fatal().Err(err).Msg("Unable to load static files")
+	}
+	if err := LoadTemplates(cfg.TemplatesDir); err != nil {
+		log.Fatal().Err(err).Msg("Unable to load templates")
+	}
+	if err := LoadMailTemplates(cfg.TemplatesDir); err != nil {
+		log.Fatal().Err(err).Msg("Unable to load email templates")
 	}
 
-	//fmt.Println(docgen.MarkdownRoutesDoc(srv.Handler.(chi.Router), docgen.MarkdownOpts{}))
+	shutdownTracing, err := setupTracing(context.Background(), cfg.TracesExporter, os.Stdout)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Unable to set up tracing")
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			log.Error().Err(err).Msg("Unable to flush traces")
+		}
+	}()
 
+	// without rates the prices in other currencies can not be computed
+	if err := RefreshRates(context.Background()); err != nil {
+		log.Fatal().Err(err).Msg("Unable to retrieve currency rates")
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 	go func() {
-		log.Info().Int("port", cfg.Port).Msg("Listening HTTP")
-		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
-			// Error starting or closing listener
-			log.Fatal().Err(err).Msg("Error when running HTTP server")
-		}
+		// a second signal terminates the process right away
+		<-ctx.Done()
+		stop()
 	}()
+	go RefreshRatesEvery(ctx, cfg.RatesRefreshInterval)
+	if cfg.StaticDir != "" {
+		go images.GenerateAll(ctx, catalogPictures(ListProducts(ctx)))
+	}
 
-	sigint := make(chan os.Signal, 1)
-	signal.Notify(sigint, os.Interrupt)
-	<-sigint
-	// We received an interrupt signal, shut down.
-	log.Info().Msg("Shutting down...")
-	ctx, _ := context.WithTimeout(context.Background(), time.Second*10)
-	if err := srv.Shutdown(ctx); err != nil {
-		// Error from closing listeners, or context timeout:
-		log.Error().Err(err).Msg("HTTP server shutdown error")
+	srv := newServer(cfg, RegisterRouter(cfg))
+	if cfg.TLSCertFile != "" {
+		certs, err := newCertReloader(cfg.TLSCertFile, cfg.TLSKeyFile, certCheckInterval)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Unable to load TLS certificate")
+		}
+		srv.TLSConfig = certs.TLSConfig()
+	}
+
+	//fmt.Println(docgen.MarkdownRoutesDoc(srv.Handler.(chi.Router), docgen.MarkdownOpts{}))
+
+	l, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Unable to listen")
+	}
+	log.Info().Str("addr", srv.Addr).Bool("tls", srv.TLSConfig != nil).Msg("Listening HTTP")
+	err = serve(ctx, srv, l, health, cfg.DrainPeriod, cfg.ShutdownTimeout)
+	// deliver the events and the emails of the last requests
+	closeCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	webhooks.Close(closeCtx)
+	mails.Close(closeCtx)
+	cancel()
+	if err != nil {
+		log.Error().Err(err).Msg("HTTP server error")
+		return
 	}
 	log.Info().Msg("Server has been stopped")
 }
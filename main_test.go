@@ -0,0 +1,19 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/rs/zerolog/log"
+)
+
+func TestMain(m *testing.M) {
+	cfg := defaultConfig()
+	if err := LoadCatalog(cfg.CatalogPath); err != nil {
+		log.Fatal().Err(err).Msg("Unable to load product catalog")
+	}
+	if err := LoadTemplates(cfg.TemplatesDir); err != nil {
+		log.Fatal().Err(err).Msg("Unable to load templates")
+	}
+	os.Exit(m.Run())
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "shop"
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_requests_total",
+		Help:      "Number of HTTP requests by route pattern and status code.",
+	}, []string{"method", "route", "code"})
+
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of HTTP requests by route pattern.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	rateFetchFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rates_fetch_failures_total",
+		Help:      "Number of failed currency rates fetches.",
+	})
+
+	conversions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "currency_conversions_total",
+		Help:      "Number of money conversions by target currency.",
+	}, []string{"currency"})
+
+	cartOperations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cart_operations_total",
+		Help:      "Number of cart operations by operation and outcome.",
+	}, []string{"operation", "outcome"})
+
+	checkouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "checkouts_total",
+		Help:      "Number of checkouts by outcome.",
+	}, []string{"outcome"})
+
+	rateLimitRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rate_limit_requests_total",
+		Help:      "Number of rate limited route requests by group and outcome.",
+	}, []string{"group", "outcome"})
+
+	webhookDeliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "webhook_deliveries_total",
+		Help:      "Number of webhook delivery attempts by event and outcome.",
+	}, []string{"event", "outcome"})
+
+	mailsSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "emails_total",
+		Help:      "Number of emails by outcome: sent, retried, failed or dropped.",
+	}, []string{"outcome"})
+
+	rateLimitKeys = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "rate_limit_tracked_clients",
+		Help:      "Number of clients with a rate limit bucket by group and limit.",
+	}, []string{"group", "limit"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequests,
+		httpDuration,
+		rateFetchFailures,
+		conversions,
+		cartOperations,
+		checkouts,
+		rateLimitRequests,
+		webhookDeliveries,
+		mailsSent,
+		rateLimitKeys,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "rates_age_seconds",
+			Help:      "Seconds since the currency rates were refreshed, -1 if they never were.",
+		}, func() float64 {
+			at := RatesUpdatedAt()
+			if at.IsZero() {
+				return -1
+			}
+			return time.Since(at).Seconds()
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "catalog_products",
+			Help:      "Number of products in the catalog.",
+		}, func() float64 { return float64(len(catalog())) }),
+	)
+}
+
+// MetricsHandler exposes the registered metrics for scraping.
+func MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// instrumentHandler counts requests and observes their latency labelled
+// with the matched chi route pattern, unmatched requests share a single
+// label to keep the cardinality bounded.
+func instrumentHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		method := methodLabel(r.Method)
+		httpRequests.WithLabelValues(method, route, strconv.Itoa(status)).Inc()
+		httpDuration.WithLabelValues(method, route).Observe(time.Since(start).Seconds())
+	})
+}
+
+// methodLabel bounds method label values to the standard HTTP methods.
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodOptions:
+		return method
+	}
+	return "other"
+}
+
+// currencyLabel bounds currency label values to the supported currencies.
+func currencyLabel(currency string) string {
+	if whitelistedCurrencies[currency] {
+		return currency
+	}
+	return "other"
+}
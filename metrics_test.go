@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestInstrumentHandlerUsesRoutePatterns(t *testing.T) {
+	r := chi.NewRouter()
+	r.Use(instrumentHandler)
+	r.Get("/things/{id}", func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusTeapot) })
+
+	for _, url := range []string{"/things/1", "/things/2", "/missing/1"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, url, nil))
+	}
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("BREW", "/things/1", nil))
+
+	tests := []struct {
+		method, route, code string
+		want                float64
+	}{
+		{"GET", "/things/{id}", "418", 2},
+		{"GET", "unmatched", "404", 1},
+		{"other", "unmatched", "405", 1},
+	}
+	for _, tt := range tests {
+		if got := testutil.ToFloat64(httpRequests.WithLabelValues(tt.method, tt.route, tt.code)); got != tt.want {
+			t.Errorf("requests{%s %s %s} = %v, want %v", tt.method, tt.route, tt.code, got, tt.want)
+		}
+	}
+	if n := testutil.CollectAndCount(httpDuration, "shop_http_request_duration_seconds"); n == 0 {
+		t.Error("no request latency observed")
+	}
+}
+
+func TestMetricsHandlerExposesDomainMetrics(t *testing.T) {
+	Convert(NewMoney(1, "USD"), "USD")
+
+	w := httptest.NewRecorder()
+	MetricsHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	for _, name := range []string{
+		"shop_catalog_products",
+		"shop_rates_age_seconds",
+		"shop_rates_fetch_failures_total",
+		`shop_currency_conversions_total{currency="USD"}`,
+	} {
+		if !strings.Contains(w.Body.String(), name) {
+			t.Errorf("metrics output has no %s", name)
+		}
+	}
+}
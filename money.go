@@ -2,12 +2,15 @@ package main
 
 import (
 	"errors"
+	"math"
 )
 
 const (
 	nanosMin = -999999999
 	nanosMax = +999999999
 	nanosMod = 1000000000
+
+	centNanos = nanosMod / 100
 )
 
 var (
@@ -78,6 +81,23 @@ func AreEquals(l, r Money) bool {
 		l.Units == r.Units && l.Nanos == r.Nanos
 }
 
+// Compare returns -1, 0 or +1 when l is less than, equal to or greater than
+// r. Returns an error if one of the values is invalid or currency codes are
+// not matching.
+func Compare(l, r Money) (int, error) {
+	d, err := Sum(l, Negate(r))
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case IsNegative(d):
+		return -1, nil
+	case IsZero(d):
+		return 0, nil
+	}
+	return 1, nil
+}
+
 // Negate returns the same amount with the sign negated.
 func Negate(m Money) Money {
 	return Money{
@@ -107,8 +127,8 @@ func Sum(l, r Money) (Money, error) {
 	units := l.Units + r.Units
 	nanos := l.Nanos + r.Nanos
 
-	if (units == 0 && nanos == 0) || (units > 0 && nanos >= 0) || (units < 0 && nanos <= 0) {
-		// same sign <units, nanos>
+	if units == 0 || (units > 0 && nanos >= 0) || (units < 0 && nanos <= 0) {
+		// same sign <units, nanos> or no units to borrow from
 		units += int64(nanos / nanosMod)
 		nanos = nanos % nanosMod
 	} else {
@@ -138,3 +158,13 @@ func MultiplySlow(m Money, n uint32) Money {
 	}
 	return out
 }
+
+// MultiplyRate multiplies the value by a fractional rate, such as a tax
+// rate, and rounds the result to the nearest cent.
+func MultiplyRate(m Money, rate float64) Money {
+	cents := int64(math.Round((float64(m.Units)*nanosMod + float64(m.Nanos)) * rate / centNanos))
+	return Money{
+		Units:        cents / 100,
+		Nanos:        int32(cents%100) * centNanos,
+		CurrencyCode: m.CurrencyCode}
+}
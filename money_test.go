@@ -214,6 +214,8 @@ func TestSum(t *testing.T) {
 		{"mixed (larger negative, with borrow)", args{mm(-11, -100000000), mm(2, 9000000 /*.09*/)}, mm(-9, -91000000 /*.091*/), nil},
 		{"0+negative", args{mm(0, 0), mm(-2, -100000000)}, mm(-2, -100000000), nil},
 		{"negative+0", args{mm(-2, -100000000), mm(0, 0)}, mm(-2, -100000000), nil},
+		{"mixed (units cancel, negative nanos)", args{mm(10, 500000000), mm(-10, -500000001)}, mm(0, -1), nil},
+		{"mixed (units cancel, positive nanos)", args{mm(-10, -500000000), mm(10, 500000001)}, mm(0, 1), nil},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -227,3 +229,50 @@ func TestSum(t *testing.T) {
 		})
 	}
 }
+
+func TestMultiplyRate(t *testing.T) {
+	tests := []struct {
+		name string
+		in   Money
+		rate float64
+		want Money
+	}{
+		{"zero", mmc(0, 0, "USD"), 0.2, mmc(0, 0, "USD")},
+		{"whole", mmc(100, 0, "USD"), 0.2, mmc(20, 0, "USD")},
+		{"round down", mmc(67, 990000000, "USD"), 0.0725, mmc(4, 930000000, "USD")},
+		{"round up", mmc(10, 50000000, "USD"), 0.05, mmc(0, 500000000, "USD")},
+		{"inclusive share", mmc(119, 0, "EUR"), 0.19 / 1.19, mmc(19, 0, "EUR")},
+		{"negative", mmc(-10, -500000000, "USD"), 0.1, mmc(-1, -50000000, "USD")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := MultiplyRate(tt.in, tt.rate); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("MultiplyRate(%v, %v) = %v, want %v", tt.in, tt.rate, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		name    string
+		l, r    Money
+		want    int
+		wantErr error
+	}{
+		{"equal", mmc(1, 500000000, "USD"), mmc(1, 500000000, "USD"), 0, nil},
+		{"less by nanos", mmc(1, 499999999, "USD"), mmc(1, 500000000, "USD"), -1, nil},
+		{"greater by units", mmc(2, 0, "USD"), mmc(1, 999999999, "USD"), 1, nil},
+		{"negative less", mmc(-1, 0, "USD"), mmc(0, 0, "USD"), -1, nil},
+		{"Error: currency mismatch", mmc(1, 0, "USD"), mmc(1, 0, "EUR"), 0, ErrMismatchingCurrency},
+		{"Error: invalid", mmc(1, -1, "USD"), mmc(1, 0, "USD"), 0, ErrInvalidValue},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Compare(tt.l, tt.r)
+			if err != tt.wantErr || got != tt.want {
+				t.Errorf("Compare(%v, %v) = %d, %v, want %d, %v", tt.l, tt.r, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
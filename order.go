@@ -0,0 +1,323 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/xid"
+)
+
+// OrderStatus is a state of the order lifecycle.
+type OrderStatus string
+
+const (
+	OrderPending   OrderStatus = "pending"
+	OrderPaid      OrderStatus = "paid"
+	OrderShipped   OrderStatus = "shipped"
+	OrderDelivered OrderStatus = "delivered"
+	OrderCancelled OrderStatus = "cancelled"
+	OrderRefunded  OrderStatus = "refunded"
+)
+
+// orderTransitions lists the states reachable from every state. Partial
+// refunds are allowed wherever a full refund is and keep the current state.
+var orderTransitions = map[OrderStatus][]OrderStatus{
+	OrderPending:   {OrderPaid, OrderCancelled},
+	OrderPaid:      {OrderShipped, OrderCancelled, OrderRefunded},
+	OrderShipped:   {OrderDelivered, OrderRefunded},
+	OrderDelivered: {OrderRefunded},
+}
+
+var (
+	ErrInvalidTransition  = errors.New("order status transition is not allowed")
+	ErrOrderNotFound      = errors.New("order not found")
+	ErrInvalidPayment     = errors.New("payment amount does not match order total")
+	ErrInvalidRefund      = errors.New("refund amount must be positive and in the order currency")
+	ErrRefundExceedsPaid  = errors.New("refund amount exceeds the paid total")
+	ErrMissingTrackingID  = errors.New("shipping tracking id is required")
+	ErrOrderHasNoPayments = errors.New("order has no payments to refund")
+)
+
+// Address is a shipping address collected on checkout.
+type Address struct {
+	StreetAddress string `json:"streetAddress,omitempty"`
+	City          string `json:"city,omitempty"`
+	State         string `json:"state,omitempty"`
+	Country       string `json:"country,omitempty"`
+	ZipCode       string `json:"zipCode,omitempty"`
+}
+
+// OrderItem is a single order line priced in the order currency.
+type OrderItem struct {
+	Item Product `json:"item"`
+	// Variant of the product ordered, nil for products without variants.
+	Variant  *Variant `json:"variant,omitempty"`
+	Quantity int      `json:"quantity"`
+	Cost     Money    `json:"cost"`
+	// Discount of the promotions applied to the line.
+	Discount Money `json:"discount"`
+}
+
+// Net returns the line cost after discounts.
+func (i OrderItem) Net() (Money, error) {
+	if i.Discount.CurrencyCode == "" {
+		return i.Cost, nil
+	}
+	return Sum(i.Cost, Negate(i.Discount))
+}
+
+// SKU returns the stock keeping unit of the line: the variant, or else the
+// product.
+func (i OrderItem) SKU() string {
+	if i.Variant != nil {
+		return i.Variant.Sku
+	}
+	return i.Item.Id
+}
+
+// Price returns the unit price of the line in the currency.
+func (i OrderItem) Price(currency string) Money {
+	return i.Item.PriceIn(i.Variant, currency)
+}
+
+// CartItems returns the products and quantities of the order.
+func (o *Order) CartItems() []CartItem {
+	return cartItems(o.Items)
+}
+
+func cartItems(lines []OrderItem) []CartItem {
+	items := make([]CartItem, len(lines))
+	for i, it := range lines {
+		items[i] = CartItem{ProductId: it.Item.Id, Quantity: it.Quantity}
+		if it.Variant != nil {
+			items[i].VariantSku = it.Variant.Sku
+		}
+	}
+	return items
+}
+
+// OrderEvent is an audit trail record of a single order transition.
+type OrderEvent struct {
+	At     time.Time   `json:"at"`
+	Action string      `json:"action"`
+	From   OrderStatus `json:"from,omitempty"`
+	To     OrderStatus `json:"to"`
+	// Amount is the paid or refunded amount, if any.
+	Amount *Money `json:"amount,omitempty"`
+	Note   string `json:"note,omitempty"`
+}
+
+// Order is a placed order together with its lifecycle history.
+type Order struct {
+	OrderId   string `json:"orderId"`
+	SessionId string `json:"-"`
+	Email     string `json:"email,omitempty"`
+	// Locale is the language of the checkout, the emails are sent in.
+	Locale             string       `json:"locale,omitempty"`
+	ShippingTrackingId string       `json:"shippingTrackingId,omitempty"`
+	ShippingCost       Money        `json:"shippingCost"`
+	ShippingAddress    Address      `json:"shippingAddress"`
+	Items              []OrderItem  `json:"items"`
+	Discounts          []Discount   `json:"discounts,omitempty"`
+	Tax                TaxBreakdown `json:"tax"`
+	Total              Money        `json:"total"`
+	Paid               Money        `json:"paid"`
+	Refunded           Money        `json:"refunded"`
+	Status             OrderStatus  `json:"status"`
+	History            []OrderEvent `json:"history"`
+	CreatedAt          time.Time    `json:"createdAt"`
+}
+
+// NewOrder creates a pending order for the given total.
+func NewOrder(sessionID string, total Money) *Order {
+	o := &Order{
+		OrderId:   xid.New().String(),
+		SessionId: sessionID,
+		Total:     total,
+		Paid:      Money{CurrencyCode: total.CurrencyCode},
+		Refunded:  Money{CurrencyCode: total.CurrencyCode},
+		Status:    OrderPending,
+		CreatedAt: time.Now(),
+	}
+	o.History = append(o.History, OrderEvent{At: o.CreatedAt, Action: "place", To: OrderPending})
+	return o
+}
+
+// CanTransition reports whether the order may move to the given state.
+func (o *Order) CanTransition(to OrderStatus) bool {
+	for _, s := range orderTransitions[o.Status] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *Order) transition(to OrderStatus, action string, amount Money, note string) error {
+	if !o.CanTransition(to) {
+		return errors.Wrapf(ErrInvalidTransition, "%s: %s -> %s", action, o.Status, to)
+	}
+	o.record(to, action, amount, note)
+	return nil
+}
+
+func (o *Order) record(to OrderStatus, action string, amount Money, note string) {
+	e := OrderEvent{
+		At:     time.Now(),
+		Action: action,
+		From:   o.Status,
+		To:     to,
+		Note:   note,
+	}
+	if amount.CurrencyCode != "" {
+		e.Amount = &amount
+	}
+	o.History = append(o.History, e)
+	o.Status = to
+}
+
+// Pay records the payment of the whole order total.
+func (o *Order) Pay(amount Money) error {
+	if !AreEquals(amount, o.Total) {
+		return ErrInvalidPayment
+	}
+	if err := o.transition(OrderPaid, "pay", amount, ""); err != nil {
+		return err
+	}
+	o.Paid = amount
+	return nil
+}
+
+// Ship marks the order as handed over to the carrier.
+func (o *Order) Ship(trackingID string) error {
+	if trackingID == "" {
+		return ErrMissingTrackingID
+	}
+	if err := o.transition(OrderShipped, "ship", Money{}, trackingID); err != nil {
+		return err
+	}
+	o.ShippingTrackingId = trackingID
+	return nil
+}
+
+// Deliver marks the order as received by the customer.
+func (o *Order) Deliver() error {
+	return o.transition(OrderDelivered, "deliver", Money{}, "")
+}
+
+// Cancel cancels the order. A paid order is refunded in full.
+func (o *Order) Cancel(reason string) error {
+	if !o.CanTransition(OrderCancelled) {
+		return errors.Wrapf(ErrInvalidTransition, "cancel: %s -> %s", o.Status, OrderCancelled)
+	}
+	refund := o.Refundable()
+	if IsPositive(refund) {
+		o.Refunded = Must(Sum(o.Refunded, refund))
+	} else {
+		refund = Money{}
+	}
+	return o.transition(OrderCancelled, "cancel", refund, reason)
+}
+
+// Refundable returns the paid amount which has not been refunded yet.
+func (o *Order) Refundable() Money {
+	return Must(Sum(o.Paid, Negate(o.Refunded)))
+}
+
+// Refund returns the given amount to the customer. Refunding the whole
+// remaining amount moves the order to the refunded state, a partial refund
+// keeps the current state.
+func (o *Order) Refund(amount Money, reason string) error {
+	if !o.CanTransition(OrderRefunded) {
+		return errors.Wrapf(ErrInvalidTransition, "refund: %s -> %s", o.Status, OrderRefunded)
+	}
+	if !IsPositive(amount) || !AreSameCurrency(amount, o.Paid) {
+		return ErrInvalidRefund
+	}
+	remaining := o.Refundable()
+	if !IsPositive(remaining) {
+		return ErrOrderHasNoPayments
+	}
+	left, err := Sum(remaining, Negate(amount))
+	if err != nil {
+		return errors.Wrap(err, "unable to calculate refund")
+	}
+	if IsNegative(left) {
+		return errors.Wrapf(ErrRefundExceedsPaid, "requested %s, refundable %s", renderMoney(amount), renderMoney(remaining))
+	}
+
+	if IsZero(left) {
+		o.record(OrderRefunded, "refund", amount, reason)
+	} else {
+		o.record(o.Status, "partial_refund", amount, reason)
+	}
+	o.Refunded = Must(Sum(o.Refunded, amount))
+	return nil
+}
+
+// orderStore keeps placed orders in memory.
+type orderStore struct {
+	mu     sync.RWMutex
+	orders map[string]*Order
+}
+
+var orders = newOrderStore()
+
+func newOrderStore() *orderStore {
+	return &orderStore{orders: map[string]*Order{}}
+}
+
+// Add stores a new order.
+func (s *orderStore) Add(o *Order) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.orders[o.OrderId] = o
+}
+
+// Get returns a copy of the order with the given ID.
+func (s *orderStore) Get(id string) (Order, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	o, ok := s.orders[id]
+	if !ok {
+		return Order{}, errors.Wrap(ErrOrderNotFound, id)
+	}
+	return o.copy(), nil
+}
+
+// Update applies fn to the stored order atomically. Changes made by fn are
+// discarded when it returns an error.
+func (s *orderStore) Update(id string, fn func(o *Order) error) (Order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.orders[id]
+	if !ok {
+		return Order{}, errors.Wrap(ErrOrderNotFound, id)
+	}
+	updated := o.copy()
+	if err := fn(&updated); err != nil {
+		return Order{}, err
+	}
+	*o = updated
+	return updated.copy(), nil
+}
+
+// Ping reports whether the store can serve requests.
+func (s *orderStore) Ping() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.orders == nil {
+		return errors.New("order store is not initialized")
+	}
+	return nil
+}
+
+func (o *Order) copy() Order {
+	c := *o
+	c.Items = append([]OrderItem(nil), o.Items...)
+	c.History = append([]OrderEvent(nil), o.History...)
+	c.Discounts = append([]Discount(nil), o.Discounts...)
+	c.Tax.Lines = append([]TaxLine(nil), o.Tax.Lines...)
+	return c
+}
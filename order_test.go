@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"github.com/pkg/errors"
+)
+
+func paidOrder(t *testing.T, total Money) *Order {
+	t.Helper()
+	o := NewOrder("session", total)
+	if err := o.Pay(total); err != nil {
+		t.Fatalf("Pay(%v) = %v", total, err)
+	}
+	return o
+}
+
+func TestOrderTransitions(t *testing.T) {
+	tests := []struct {
+		name    string
+		actions func(o *Order) error
+		want    OrderStatus
+		wantErr error
+	}{
+		{"pay", func(o *Order) error { return o.Pay(o.Total) }, OrderPaid, nil},
+		{"pay wrong amount", func(o *Order) error { return o.Pay(mmc(1, 0, "USD")) }, OrderPending, ErrInvalidPayment},
+		{"ship unpaid", func(o *Order) error { return o.Ship("T1") }, OrderPending, ErrInvalidTransition},
+		{"deliver unpaid", func(o *Order) error { return o.Deliver() }, OrderPending, ErrInvalidTransition},
+		{"cancel pending", func(o *Order) error { return o.Cancel("changed mind") }, OrderCancelled, nil},
+		{"full lifecycle", func(o *Order) error {
+			if err := o.Pay(o.Total); err != nil {
+				return err
+			}
+			if err := o.Ship("T1"); err != nil {
+				return err
+			}
+			return o.Deliver()
+		}, OrderDelivered, nil},
+		{"ship without tracking", func(o *Order) error {
+			if err := o.Pay(o.Total); err != nil {
+				return err
+			}
+			return o.Ship("")
+		}, OrderPaid, ErrMissingTrackingID},
+		{"cancel shipped", func(o *Order) error {
+			if err := o.Pay(o.Total); err != nil {
+				return err
+			}
+			if err := o.Ship("T1"); err != nil {
+				return err
+			}
+			return o.Cancel("too late")
+		}, OrderShipped, ErrInvalidTransition},
+		{"pay cancelled", func(o *Order) error {
+			if err := o.Cancel(""); err != nil {
+				return err
+			}
+			return o.Pay(o.Total)
+		}, OrderCancelled, ErrInvalidTransition},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := NewOrder("session", mmc(10, 500000000, "USD"))
+			err := tt.actions(o)
+			if errors.Cause(err) != tt.wantErr {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+			if o.Status != tt.want {
+				t.Errorf("got status %q, want %q", o.Status, tt.want)
+			}
+		})
+	}
+}
+
+func TestOrderCancelPaidRefundsEverything(t *testing.T) {
+	total := mmc(10, 500000000, "USD")
+	o := paidOrder(t, total)
+	if err := o.Cancel("out of stock"); err != nil {
+		t.Fatalf("Cancel() = %v", err)
+	}
+	if !AreEquals(o.Refunded, total) {
+		t.Errorf("refunded %v, want %v", o.Refunded, total)
+	}
+	if got := len(o.History); got != 3 {
+		t.Errorf("history has %d events, want 3", got)
+	}
+}
+
+func TestOrderEventAmountJSON(t *testing.T) {
+	o := paidOrder(t, usd(10, 0))
+	if err := o.Ship("KS-1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range o.History {
+		b, err := json.Marshal(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := strings.Contains(string(b), `"amount"`), e.Action == "pay"; got != want {
+			t.Errorf("%s event = %s, want amount %v", e.Action, b, want)
+		}
+	}
+}
+
+func TestOrderRefund(t *testing.T) {
+	tests := []struct {
+		name         string
+		refunds      []Money
+		wantStatus   OrderStatus
+		wantRefunded Money
+		wantErr      error
+	}{
+		{"partial", []Money{mmc(3, 250000000, "USD")}, OrderPaid, mmc(3, 250000000, "USD"), nil},
+		{"full", []Money{mmc(10, 500000000, "USD")}, OrderRefunded, mmc(10, 500000000, "USD"), nil},
+		{"partials up to full", []Money{mmc(5, 0, "USD"), mmc(5, 500000000, "USD")}, OrderRefunded, mmc(10, 500000000, "USD"), nil},
+		{"exceeds paid", []Money{mmc(10, 500000001, "USD")}, OrderPaid, mmc(0, 0, "USD"), ErrRefundExceedsPaid},
+		{"exceeds remaining", []Money{mmc(6, 0, "USD"), mmc(5, 0, "USD")}, OrderPaid, mmc(6, 0, "USD"), ErrRefundExceedsPaid},
+		{"after full refund", []Money{mmc(10, 500000000, "USD"), mmc(0, 1, "USD")}, OrderRefunded, mmc(10, 500000000, "USD"), ErrInvalidTransition},
+		{"zero", []Money{mmc(0, 0, "USD")}, OrderPaid, mmc(0, 0, "USD"), ErrInvalidRefund},
+		{"negative", []Money{mmc(-1, 0, "USD")}, OrderPaid, mmc(0, 0, "USD"), ErrInvalidRefund},
+		{"other currency", []Money{mmc(1, 0, "EUR")}, OrderPaid, mmc(0, 0, "USD"), ErrInvalidRefund},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := paidOrder(t, mmc(10, 500000000, "USD"))
+			var err error
+			for _, r := range tt.refunds {
+				if err = o.Refund(r, "test"); err != nil {
+					break
+				}
+			}
+			if errors.Cause(err) != tt.wantErr {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+			if o.Status != tt.wantStatus {
+				t.Errorf("got status %q, want %q", o.Status, tt.wantStatus)
+			}
+			if !AreEquals(o.Refunded, tt.wantRefunded) {
+				t.Errorf("refunded %v, want %v", o.Refunded, tt.wantRefunded)
+			}
+		})
+	}
+}
+
+func TestOrderRefundUnpaid(t *testing.T) {
+	o := NewOrder("session", mmc(10, 0, "USD"))
+	if err := o.Refund(mmc(1, 0, "USD"), ""); errors.Cause(err) != ErrInvalidTransition {
+		t.Errorf("got error %v, want %v", err, ErrInvalidTransition)
+	}
+}
+
+func TestOrderStoreUpdateDiscardsOnError(t *testing.T) {
+	s := newOrderStore()
+	o := NewOrder("session", mmc(10, 0, "USD"))
+	s.Add(o)
+
+	_, err := s.Update(o.OrderId, func(o *Order) error {
+		if err := o.Pay(o.Total); err != nil {
+			return err
+		}
+		return o.Ship("")
+	})
+	if errors.Cause(err) != ErrMissingTrackingID {
+		t.Fatalf("got error %v, want %v", err, ErrMissingTrackingID)
+	}
+	got, _ := s.Get(o.OrderId)
+	if got.Status != OrderPending || len(got.History) != 1 {
+		t.Errorf("failed update leaked: status %q, %d events", got.Status, len(got.History))
+	}
+}
+
+func TestOrderAdminHandlers(t *testing.T) {
+	router := chi.NewRouter()
+	router.Post("/admin/orders/{id}/deliver", deliverOrderHandler)
+	router.Post("/admin/orders/{id}/refund", refundOrderHandler)
+	do := func(target, contentType, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+		if contentType != "" {
+			r.Header.Set("Content-Type", contentType)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+	const formType = "application/x-www-form-urlencoded"
+
+	templates, err := parseMailTemplates(emailFS(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeMailer{}
+	oldQueue, oldTemplates := mails, emailTemplates
+	mails, emailTemplates = newMailQueue(f, defaultMailFrom), templates
+	defer func() { mails, emailTemplates = oldQueue, oldTemplates }()
+
+	shipped := paidOrder(t, Money{CurrencyCode: "EUR", Units: 30})
+	shipped.Email = "jane@example.com"
+	if err := shipped.Ship("TRACK-1"); err != nil {
+		t.Fatal(err)
+	}
+	orders.Add(shipped)
+	paid := paidOrder(t, Money{CurrencyCode: "EUR", Units: 30})
+	orders.Add(paid)
+
+	steps := []struct {
+		name, target, contentType, body string
+		wantCode                        int
+	}{
+		{"deliver", "/admin/orders/" + shipped.OrderId + "/deliver", "", "", http.StatusOK},
+		{"deliver twice", "/admin/orders/" + shipped.OrderId + "/deliver", "", "", http.StatusConflict},
+		{"deliver unshipped", "/admin/orders/" + paid.OrderId + "/deliver", "", "", http.StatusConflict},
+		{"deliver missing", "/admin/orders/nope/deliver", "", "", http.StatusNotFound},
+		{"refund part", "/admin/orders/" + shipped.OrderId + "/refund", formType, "amount=10.50&reason=damaged", http.StatusOK},
+		{"refund invalid amount", "/admin/orders/" + shipped.OrderId + "/refund", formType, "amount=ten", http.StatusBadRequest},
+		{"refund too much", "/admin/orders/" + shipped.OrderId + "/refund", "application/json", `{"amount":"20"}`, http.StatusBadRequest},
+		{"refund invalid JSON", "/admin/orders/" + shipped.OrderId + "/refund", "application/json", `{"amount":`, http.StatusBadRequest},
+		{"refund the rest", "/admin/orders/" + shipped.OrderId + "/refund", "application/json", `{"reason":"returned"}`, http.StatusOK},
+		{"refund refunded", "/admin/orders/" + shipped.OrderId + "/refund", "", "", http.StatusConflict},
+		{"refund missing", "/admin/orders/nope/refund", "", "", http.StatusNotFound},
+	}
+	for _, s := range steps {
+		if w := do(s.target, s.contentType, s.body); w.Code != s.wantCode {
+			t.Errorf("%s: code = %d, want %d: %s", s.name, w.Code, s.wantCode, w.Body.String())
+		}
+	}
+
+	o, err := orders.Get(shipped.OrderId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Money{CurrencyCode: "EUR", Units: 30}); o.Status != OrderRefunded || o.Refunded != want {
+		t.Errorf("order = %s refunded %v, want refunded %v", o.Status, o.Refunded, want)
+	}
+	var actions []string
+	for _, e := range o.History {
+		actions = append(actions, e.Action)
+	}
+	if got, want := strings.Join(actions, ","), "place,pay,ship,deliver,partial_refund,refund"; got != want {
+		t.Errorf("history = %s, want %s", got, want)
+	}
+
+	mails.Close(context.Background())
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.sent) != 2 {
+		t.Fatalf("emails sent = %d, want one per refund", len(f.sent))
+	}
+	for i, want := range []string{"EUR 10.50", "EUR 30.00"} {
+		if m := f.sent[i]; m.To != shipped.Email || !strings.Contains(m.Subject, "refunded") || !strings.Contains(m.Text, want) {
+			t.Errorf("email %d = %q to %q, want the refund of %s to %s:\n%s", i, m.Subject, m.To, want, shipped.Email, m.Text)
+		}
+	}
+}
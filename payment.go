@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/xid"
+)
+
+var (
+	ErrInvalidCard = errors.New("credit card number is invalid")
+	ErrCardExpired = errors.New("credit card is expired")
+)
+
+// CreditCard is the payment method collected on checkout.
+type CreditCard struct {
+	Number          string
+	CVV             string
+	ExpirationYear  int
+	ExpirationMonth int
+}
+
+// Charge validates the card and charges the amount. Returns the payment
+// transaction ID.
+func Charge(card CreditCard, amount Money) (string, error) {
+	if !IsValid(amount) || IsNegative(amount) {
+		return "", ErrInvalidValue
+	}
+	number := strings.Replace(strings.Replace(card.Number, "-", "", -1), " ", "", -1)
+	if len(number) < 12 || !luhnValid(number) {
+		return "", ErrInvalidCard
+	}
+	now := time.Now()
+	if card.ExpirationYear < now.Year() ||
+		card.ExpirationYear == now.Year() && card.ExpirationMonth < int(now.Month()) {
+		return "", errors.Wrapf(ErrCardExpired, "%02d/%d", card.ExpirationMonth, card.ExpirationYear)
+	}
+	return xid.New().String(), nil
+}
+
+// luhnValid checks the card number checksum.
+func luhnValid(number string) bool {
+	sum := 0
+	for i := range number {
+		d := int(number[len(number)-1-i] - '0')
+		if d < 0 || d > 9 {
+			return false
+		}
+		if i%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
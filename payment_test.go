@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestCharge(t *testing.T) {
+	next := time.Now().Year() + 1
+	tests := []struct {
+		name    string
+		card    CreditCard
+		wantErr error
+	}{
+		{"valid", CreditCard{Number: "4432-8015-6152-0454", ExpirationYear: next, ExpirationMonth: 1}, nil},
+		{"valid without dashes", CreditCard{Number: "4432801561520454", ExpirationYear: next, ExpirationMonth: 1}, nil},
+		{"bad checksum", CreditCard{Number: "4432-8015-6152-0455", ExpirationYear: next, ExpirationMonth: 1}, ErrInvalidCard},
+		{"not a number", CreditCard{Number: "4432-8015-6152-04a4", ExpirationYear: next, ExpirationMonth: 1}, ErrInvalidCard},
+		{"too short", CreditCard{Number: "0", ExpirationYear: next, ExpirationMonth: 1}, ErrInvalidCard},
+		{"expired", CreditCard{Number: "4432-8015-6152-0454", ExpirationYear: next - 2, ExpirationMonth: 12}, ErrCardExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := Charge(tt.card, usd(10, 0))
+			if errors.Cause(err) != tt.wantErr {
+				t.Errorf("Charge() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && id == "" {
+				t.Error("Charge() returned no transaction ID")
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// Rounding is the charm rounding of the prices converted to a currency: the
+// nearest amount with the ending in steps of the increment, such as 12.99
+// for an increment of 1 and an ending of 0.99, or 7600 for an increment of
+// 100. Prices are never rounded down to zero.
+type Rounding struct {
+	Increment float64 `json:"increment"`
+	Ending    float64 `json:"ending,omitempty"`
+}
+
+func (r Rounding) validate() error {
+	if !(r.Increment > 0) || r.Ending < 0 || r.Ending >= r.Increment {
+		return errors.Errorf("increment %v must be positive and ending %v in [0, increment)", r.Increment, r.Ending)
+	}
+	return nil
+}
+
+// Apply rounds the amount, amounts which are not positive are returned as
+// is.
+func (r Rounding) Apply(m Money) Money {
+	if !IsPositive(m) {
+		return m
+	}
+	inc, end := int64(math.Round(r.Increment*nanosMod)), int64(math.Round(r.Ending*nanosMod))
+	n := m.Units*nanosMod + int64(m.Nanos)
+	// n-end > -inc as the ending is below the increment, so k >= 0
+	n = (n-end+inc/2)/inc*inc + end
+	if n == 0 {
+		n = inc
+	}
+	return Money{CurrencyCode: m.CurrencyCode, Units: n / nanosMod, Nanos: int32(n % nanosMod)}
+}
+
+// roundPrice applies the charm rounding of its currency to the converted
+// price.
+func roundPrice(m Money) Money {
+	catalogMu.RLock()
+	r, ok := roundings[m.CurrencyCode]
+	catalogMu.RUnlock()
+	if !ok {
+		return m
+	}
+	return r.Apply(m)
+}
+
+// PriceIn returns the price of the variant in the currency: the one of its
+// price list, or else its USD price converted and rounded for the currency.
+// A variant without a price of its own, or none, has the product prices.
+func (p Product) PriceIn(v *Variant, currency string) Money {
+	usd, list := p.PriceUsd, p.Prices
+	if v != nil && v.PriceUsd != nil {
+		usd, list = *v.PriceUsd, v.Prices
+	}
+	if m, ok := list[currency]; ok {
+		return m
+	}
+	if currency == defaultCurrency {
+		return usd
+	}
+	return roundPrice(Convert(usd, currency))
+}
+
+// validatePrices checks the price list of a product or variant, the USD
+// price is not part of it.
+func validatePrices(prices map[string]Money) []string {
+	var problems []string
+	for cur, m := range prices {
+		switch {
+		case cur == defaultCurrency:
+			problems = append(problems, fmt.Sprintf("the %s price is not part of the price list", cur))
+		case m.CurrencyCode != cur || !IsValid(m) || IsNegative(m):
+			problems = append(problems, fmt.Sprintf("%s price must be a valid non-negative %s amount", cur, cur))
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
@@ -0,0 +1,68 @@
+package main
+
+import "testing"
+
+func TestRoundingApply(t *testing.T) {
+	charm := Rounding{Increment: 1, Ending: 0.99}
+	hundreds := Rounding{Increment: 100}
+	tests := []struct {
+		name     string
+		rounding Rounding
+		in, want Money
+	}{
+		{"charm down", charm, mmc(12, 340000000, "EUR"), mmc(11, 990000000, "EUR")},
+		{"charm up", charm, mmc(12, 600000000, "EUR"), mmc(12, 990000000, "EUR")},
+		{"charm exact", charm, mmc(12, 990000000, "EUR"), mmc(12, 990000000, "EUR")},
+		{"charm below the ending", charm, mmc(0, 300000000, "EUR"), mmc(0, 990000000, "EUR")},
+		{"hundreds down", hundreds, mmc(7623, 0, "JPY"), mmc(7600, 0, "JPY")},
+		{"hundreds half up", hundreds, mmc(7650, 0, "JPY"), mmc(7700, 0, "JPY")},
+		{"never free", hundreds, mmc(30, 0, "JPY"), mmc(100, 0, "JPY")},
+		{"zero", hundreds, mmc(0, 0, "JPY"), mmc(0, 0, "JPY")},
+		{"quarters", Rounding{Increment: 0.25}, mmc(3, 100000000, "CAD"), mmc(3, 0, "CAD")},
+	}
+	for _, tt := range tests {
+		if got := tt.rounding.Apply(tt.in); got != tt.want {
+			t.Errorf("%s: Apply(%v) = %v, want %v", tt.name, tt.in, got, tt.want)
+		}
+	}
+
+	for _, r := range []Rounding{{}, {Increment: -1}, {Increment: 1, Ending: 1}, {Increment: 1, Ending: -0.01}} {
+		if r.validate() == nil {
+			t.Errorf("rounding %+v is valid", r)
+		}
+	}
+}
+
+func TestPriceIn(t *testing.T) {
+	savedRates, savedRoundings := rates, roundings
+	defer func() { rates, roundings = savedRates, savedRoundings }()
+	rates = map[string]float64{"EUR": 1, "USD": 2, "JPY": 160, "GBP": 0.8}
+	roundings = map[string]Rounding{"EUR": {Increment: 1, Ending: 0.99}, "JPY": {Increment: 100}}
+
+	own := usd(20, 0)
+	p := Product{
+		PriceUsd: usd(12, 340000000),
+		Prices:   map[string]Money{"GBP": mmc(4, 500000000, "GBP")},
+		Variants: []Variant{{Sku: "a"}, {Sku: "b", PriceUsd: &own}},
+	}
+	tests := []struct {
+		name     string
+		variant  *Variant
+		currency string
+		want     Money
+	}{
+		{"usd", nil, "USD", usd(12, 340000000)},
+		{"converted and rounded", nil, "EUR", mmc(5, 990000000, "EUR")},
+		{"rounded to hundreds", nil, "JPY", mmc(1000, 0, "JPY")},
+		{"price list", nil, "GBP", mmc(4, 500000000, "GBP")},
+		{"variant without a price", &p.Variants[0], "GBP", mmc(4, 500000000, "GBP")},
+		{"variant price", &p.Variants[1], "USD", usd(20, 0)},
+		{"variant price converted", &p.Variants[1], "EUR", mmc(9, 990000000, "EUR")},
+		{"variant price not in the product price list", &p.Variants[1], "GBP", mmc(8, 0, "GBP")},
+	}
+	for _, tt := range tests {
+		if got := p.PriceIn(tt.variant, tt.currency); got != tt.want {
+			t.Errorf("%s: PriceIn(%s) = %v, want %v", tt.name, tt.currency, got, tt.want)
+		}
+	}
+}
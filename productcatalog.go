@@ -1,28 +1,91 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
+	"regexp"
 	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	ErrProductNotFound = errors.New("no such product")
+	ErrProductExists   = errors.New("a product with this ID already exists")
+	ErrInvalidProduct  = errors.New("invalid product")
+	ErrVariantNotFound = errors.New("no such product variant")
+	ErrSkuExists       = errors.New("a product or variant with this SKU already exists")
 )
 
+// The catalog is never modified in place: a change replaces prodList, so
+// the slices and products handed out stay valid.
 var (
-	prodList []Product
+	catalogMu   sync.RWMutex
+	prodList    []Product
+	attributes  map[string][]Attribute
+	roundings   map[string]Rounding
+	catalogPath string
 )
 
-func init() {
-	c, err := ioutil.ReadFile("products.json")
+// catalogFile is the format of the catalog file.
+type catalogFile struct {
+	// Attributes of the variants by product category.
+	Attributes map[string][]Attribute `json:"attributes,omitempty"`
+	// Rounding of the converted prices by currency.
+	Rounding map[string]Rounding `json:"rounding,omitempty"`
+	Products []Product           `json:"products"`
+}
+
+var productIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// LoadCatalog reads the product catalog from the JSON file, the changes
+// made to the catalog are saved to it. Without a file the embedded catalog
+// is read and the changes are lost on restart. It must be called before
+// serving requests.
+func LoadCatalog(path string) error {
+	var (
+		c   []byte
+		err error
+	)
+	if path != "" {
+		c, err = ioutil.ReadFile(path)
+	} else {
+		c, err = embedded.ReadFile("products.json")
+	}
 	if err != nil {
-		log.Fatalf("failed to open product catalog json file: %v", err)
+		return fmt.Errorf("failed to open product catalog json file: %v", err)
 	}
-	pl := map[string][]Product{}
-	if err := json.Unmarshal(c, &pl); err != nil {
-		log.Fatalf("failed to parse the catalog JSON: %v", err)
+	var cf catalogFile
+	if err := json.Unmarshal(c, &cf); err != nil {
+		return fmt.Errorf("failed to parse the catalog JSON: %v", err)
 	}
-	prodList = pl["products"]
-	log.Printf("successfully parsed %d products catalog from json\n", len(prodList))
+	if err := validateAttributes(cf.Attributes); err != nil {
+		return fmt.Errorf("invalid catalog attributes: %v", err)
+	}
+	for cur, r := range cf.Rounding {
+		if err := r.validate(); err != nil {
+			return fmt.Errorf("invalid %s rounding: %v", cur, err)
+		}
+	}
+	catalogMu.Lock()
+	prodList, attributes, roundings, catalogPath = cf.Products, cf.Attributes, cf.Rounding, path
+	catalogMu.Unlock()
+	log.Info().Int("products", len(cf.Products)).Msg("successfully parsed product catalog from json")
+	return nil
+}
+
+// catalog returns the current products.
+func catalog() []Product {
+	catalogMu.RLock()
+	defer catalogMu.RUnlock()
+	return prodList
 }
 
 // Product
@@ -30,38 +93,425 @@ type Product struct {
 	Id          string `json:"id,omitempty"`
 	Name        string `json:"name,omitempty"`
 	Description string `json:"description,omitempty"`
-	Picture     string `json:"picture,omitempty"`
-	PriceUsd    Money  `json:"priceUsd,omitempty"`
+	// Translations of the name and description by locale, such as "de".
+	// Missing texts fall back to Name and Description.
+	Translations map[string]ProductText `json:"translations,omitempty"`
+	Picture      string                 `json:"picture,omitempty"`
+	PriceUsd     Money                  `json:"priceUsd,omitempty"`
+	// Prices by currency, used instead of converting the USD price.
+	Prices map[string]Money `json:"prices,omitempty"`
+	// Shipping weight in grams.
+	WeightGrams int `json:"weightGrams,omitempty"`
 	// Categories such as "vintage" or "gardening" that can be used to look up
 	// other related products.
 	Categories []string `json:"categories,omitempty"`
+	// Variants are sold instead of the product itself when there are any.
+	Variants []Variant `json:"variants,omitempty"`
 }
 
-func ListProducts() []Product {
-	return prodList
+// Variant is a version of a product, such as a size or a color, sold as its
+// own SKU with its own stock.
+type Variant struct {
+	Sku string `json:"sku"`
+	// Attributes have a value for every attribute of the product
+	// categories, such as {"size": "M"}.
+	Attributes map[string]string `json:"attributes"`
+	// PriceUsd and Prices override the prices of the product when set.
+	PriceUsd *Money           `json:"priceUsd,omitempty"`
+	Prices   map[string]Money `json:"prices,omitempty"`
 }
 
-func GetProduct(pid string) (*Product, error) {
-	var found *Product
-	for i := 0; i < len(prodList); i++ {
-		if pid == prodList[i].Id {
-			found = &prodList[i]
+// Attribute is a property in which the variants of the products of a
+// category differ, such as the size, with the values it can take.
+type Attribute struct {
+	Name   string   `json:"name"`
+	Values []string `json:"values"`
+}
+
+// ProductText is the name and description of a product in a language.
+type ProductText struct {
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// Localized returns the product with the name and description in the
+// language, falling back to the default ones, and without the
+// translations.
+func (p Product) Localized(lang string) Product {
+	if t, ok := p.Translations[lang]; ok {
+		if t.Name != "" {
+			p.Name = t.Name
+		}
+		if t.Description != "" {
+			p.Description = t.Description
 		}
 	}
-	if found == nil {
-		return nil, errors.New("no product with ID " + pid)
+	p.Translations = nil
+	return p
+}
+
+// FindVariant returns the variant of the SKU, nil for the empty SKU of a
+// product without variants.
+func (p Product) FindVariant(sku string) (*Variant, error) {
+	if sku == "" {
+		if len(p.Variants) > 0 {
+			return nil, errors.Wrapf(ErrVariantNotFound, "product %s must be ordered by variant", p.Id)
+		}
+		return nil, nil
+	}
+	for _, v := range p.Variants {
+		if v.Sku == sku {
+			return &v, nil
+		}
 	}
-	return found, nil
+	return nil, errors.Wrapf(ErrVariantNotFound, "product %s variant %s", p.Id, sku)
 }
 
-func SearchProducts(query string) ([]Product, error) {
-	// Intepret query as a substring match in name or description.
+// Price returns the USD price of the variant, that of the product when the
+// variant is nil or does not override it.
+func (p Product) Price(v *Variant) Money {
+	if v != nil && v.PriceUsd != nil {
+		return *v.PriceUsd
+	}
+	return p.PriceUsd
+}
+
+// skus returns the SKUs the product is sold as: its variants, or else its
+// ID.
+func (p Product) skus() []string {
+	if len(p.Variants) == 0 {
+		return []string{p.Id}
+	}
+	skus := make([]string, len(p.Variants))
+	for i, v := range p.Variants {
+		skus[i] = v.Sku
+	}
+	return skus
+}
+
+// localizeProducts returns the products in the locale of the request.
+func localizeProducts(ctx context.Context, ps []Product) []Product {
+	lang := requestLocale(ctx).tag.String()
+	localized := make([]Product, len(ps))
+	for i, p := range ps {
+		localized[i] = p.Localized(lang)
+	}
+	return localized
+}
+
+func ListProducts(ctx context.Context) []Product {
+	_, span := tracer.Start(ctx, "catalog.ListProducts")
+	defer span.End()
+	ps := catalog()
+	span.SetAttributes(attribute.Int("catalog.products", len(ps)))
+	return ps
+}
+
+func GetProduct(ctx context.Context, pid string) (*Product, error) {
+	_, span := tracer.Start(ctx, "catalog.GetProduct", trace.WithAttributes(attribute.String("product.id", pid)))
+	defer span.End()
+
+	ps := catalog()
+	for i := range ps {
+		if pid == ps[i].Id {
+			return &ps[i], nil
+		}
+	}
+	err := errors.Wrapf(ErrProductNotFound, "product %s", pid)
+	spanError(span, err)
+	return nil, err
+}
+
+func SearchProducts(ctx context.Context, query string) ([]Product, error) {
+	_, span := tracer.Start(ctx, "catalog.SearchProducts", trace.WithAttributes(attribute.String("catalog.query", query)))
+	defer span.End()
+
+	// Intepret query as a substring match in name or description, in the
+	// locale of the request.
+	query = strings.ToLower(query)
 	var ps []Product
-	for _, p := range prodList {
-		if strings.Contains(strings.ToLower(p.Name), strings.ToLower(query)) ||
-			strings.Contains(strings.ToLower(p.Description), strings.ToLower(query)) {
+	for _, p := range localizeProducts(ctx, catalog()) {
+		if strings.Contains(strings.ToLower(p.Name), query) ||
+			strings.Contains(strings.ToLower(p.Description), query) {
 			ps = append(ps, p)
 		}
 	}
+	span.SetAttributes(attribute.Int("catalog.products", len(ps)))
 	return ps, nil
 }
+
+// RecommendProducts returns up to n products sharing a category with the
+// given products, the given products themselves are left out.
+func RecommendProducts(ctx context.Context, pids []string, n int) []Product {
+	_, span := tracer.Start(ctx, "catalog.RecommendProducts")
+	defer span.End()
+
+	all := catalog()
+	exclude := map[string]bool{}
+	categories := map[string]bool{}
+	for _, pid := range pids {
+		exclude[pid] = true
+		for i := range all {
+			if all[i].Id == pid {
+				for _, c := range all[i].Categories {
+					categories[c] = true
+				}
+			}
+		}
+	}
+	var ps []Product
+	for _, p := range all {
+		if len(ps) == n {
+			break
+		}
+		if exclude[p.Id] {
+			continue
+		}
+		for _, c := range p.Categories {
+			if categories[c] {
+				ps = append(ps, p)
+				break
+			}
+		}
+	}
+	span.SetAttributes(attribute.Int("catalog.products", len(ps)))
+	return ps
+}
+
+// catalogPictures lists the pictures of the products once.
+func catalogPictures(ps []Product) []string {
+	seen := map[string]bool{}
+	var pictures []string
+	for _, p := range ps {
+		if p.Picture != "" && !seen[p.Picture] {
+			seen[p.Picture] = true
+			pictures = append(pictures, p.Picture)
+		}
+	}
+	return pictures
+}
+
+// validateProduct checks the product before it is saved, the picture must
+// be one of the static files.
+func validateProduct(p Product) error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+	check(productIDPattern.MatchString(p.Id), "id %q must be letters, digits, - or _", p.Id)
+	check(strings.TrimSpace(p.Name) != "", "name is required")
+	check(p.PriceUsd.CurrencyCode == defaultCurrency, "price must be in %s", defaultCurrency)
+	check(IsValid(p.PriceUsd) && !IsNegative(p.PriceUsd), "price of %d units and %d nanos is not a valid amount",
+		p.PriceUsd.Units, p.PriceUsd.Nanos)
+	problems = append(problems, validatePrices(p.Prices)...)
+	check(p.WeightGrams >= 0, "weight must not be negative")
+	for _, c := range p.Categories {
+		check(strings.TrimSpace(c) != "", "categories must not be empty")
+	}
+	for lang := range p.Translations {
+		check(lang != defaultLocale && findLocale(lang) != nil, "translation locale %q is not supported", lang)
+	}
+
+	attrs := productAttributes(p.Categories)
+	check(len(p.Variants) == 0 || len(attrs) > 0, "variants need a category with attributes")
+	skus, combinations := map[string]bool{}, map[string]string{}
+	for _, v := range p.Variants {
+		check(productIDPattern.MatchString(v.Sku) && v.Sku != p.Id, "variant sku %q must be letters, digits, - or _ and differ from the id", v.Sku)
+		check(!skus[v.Sku], "variant sku %s is listed twice", v.Sku)
+		skus[v.Sku] = true
+		values := make([]string, len(attrs))
+		for i, a := range attrs {
+			values[i] = v.Attributes[a.Name]
+			check(a.allows(values[i]), "variant %s %s %q is not one of %s", v.Sku, a.Name, values[i], strings.Join(a.Values, ", "))
+		}
+		check(len(v.Attributes) == len(attrs), "variant %s has attributes the product categories do not define", v.Sku)
+		combination := strings.Join(values, "\x00")
+		other, dup := combinations[combination]
+		check(!dup, "variants %s and %s have the same attributes", other, v.Sku)
+		if !dup {
+			combinations[combination] = v.Sku
+		}
+		if v.PriceUsd != nil {
+			check(v.PriceUsd.CurrencyCode == defaultCurrency && IsValid(*v.PriceUsd) && !IsNegative(*v.PriceUsd),
+				"variant %s price must be a valid non-negative %s amount", v.Sku, defaultCurrency)
+		}
+		check(v.PriceUsd != nil || len(v.Prices) == 0, "variant %s has a price list without a %s price", v.Sku, defaultCurrency)
+		for _, problem := range validatePrices(v.Prices) {
+			problems = append(problems, "variant "+v.Sku+" "+problem)
+		}
+	}
+
+	rel := strings.TrimPrefix(p.Picture, assetsPrefix)
+	_, err := assets.lookup(rel)
+	check(rel != p.Picture && err == nil, "picture %q is not a file under /static/", p.Picture)
+
+	if len(problems) > 0 {
+		return errors.Wrap(ErrInvalidProduct, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// productAttributes returns the attributes of the categories, once each.
+func productAttributes(categories []string) []Attribute {
+	catalogMu.RLock()
+	defer catalogMu.RUnlock()
+	var attrs []Attribute
+	seen := map[string]bool{}
+	for _, c := range categories {
+		for _, a := range attributes[c] {
+			if !seen[a.Name] {
+				seen[a.Name] = true
+				attrs = append(attrs, a)
+			}
+		}
+	}
+	return attrs
+}
+
+func (a Attribute) allows(value string) bool {
+	for _, v := range a.Values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// validateAttributes checks the attribute definitions of the catalog file.
+func validateAttributes(defs map[string][]Attribute) error {
+	for category, attrs := range defs {
+		names := map[string]bool{}
+		for _, a := range attrs {
+			if a.Name == "" || names[a.Name] {
+				return errors.Errorf("category %s: attribute name %q is empty or listed twice", category, a.Name)
+			}
+			names[a.Name] = true
+			if len(a.Values) == 0 {
+				return errors.Errorf("category %s: attribute %s has no values", category, a.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// checkSkus makes sure no other product is sold as one of the SKUs of the
+// product.
+func checkSkus(ps []Product, p Product) error {
+	own := map[string]bool{p.Id: true}
+	for _, sku := range p.skus() {
+		own[sku] = true
+	}
+	for _, other := range ps {
+		if other.Id == p.Id {
+			continue
+		}
+		for _, sku := range append(other.skus(), other.Id) {
+			if own[sku] {
+				return errors.Wrapf(ErrSkuExists, "sku %s of product %s", sku, other.Id)
+			}
+		}
+	}
+	return nil
+}
+
+// CreateProduct adds the product to the catalog and saves it.
+func CreateProduct(ctx context.Context, p Product) error {
+	_, span := tracer.Start(ctx, "catalog.CreateProduct", trace.WithAttributes(attribute.String("product.id", p.Id)))
+	defer span.End()
+
+	err := updateCatalog(func(ps []Product) ([]Product, error) {
+		for _, existing := range ps {
+			if existing.Id == p.Id {
+				return nil, errors.Wrapf(ErrProductExists, "product %s", p.Id)
+			}
+		}
+		if err := checkSkus(ps, p); err != nil {
+			return nil, err
+		}
+		return append(ps, p), nil
+	})
+	if err != nil {
+		spanError(span, err)
+		return err
+	}
+	webhooks.Publish(EventProductCreated, p)
+	return nil
+}
+
+// UpdateProduct replaces the product of the same ID and saves the catalog.
+func UpdateProduct(ctx context.Context, p Product) error {
+	_, span := tracer.Start(ctx, "catalog.UpdateProduct", trace.WithAttributes(attribute.String("product.id", p.Id)))
+	defer span.End()
+
+	err := updateCatalog(func(ps []Product) ([]Product, error) {
+		for i := range ps {
+			if ps[i].Id == p.Id {
+				if err := checkSkus(ps, p); err != nil {
+					return nil, err
+				}
+				ps[i] = p
+				return ps, nil
+			}
+		}
+		return nil, errors.Wrapf(ErrProductNotFound, "product %s", p.Id)
+	})
+	if err != nil {
+		spanError(span, err)
+		return err
+	}
+	webhooks.Publish(EventProductUpdated, p)
+	return nil
+}
+
+// DeleteProduct removes the product and saves the catalog.
+func DeleteProduct(ctx context.Context, pid string) error {
+	_, span := tracer.Start(ctx, "catalog.DeleteProduct", trace.WithAttributes(attribute.String("product.id", pid)))
+	defer span.End()
+
+	err := updateCatalog(func(ps []Product) ([]Product, error) {
+		for i := range ps {
+			if ps[i].Id == pid {
+				return append(ps[:i], ps[i+1:]...), nil
+			}
+		}
+		return nil, errors.Wrapf(ErrProductNotFound, "product %s", pid)
+	})
+	if err != nil {
+		spanError(span, err)
+		return err
+	}
+	webhooks.Publish(EventProductDeleted, map[string]string{"id": pid})
+	return nil
+}
+
+// updateCatalog applies the change to a copy of the products, saves it and
+// then serves it. The catalog is left unchanged when saving fails.
+func updateCatalog(change func([]Product) ([]Product, error)) error {
+	catalogMu.Lock()
+	defer catalogMu.Unlock()
+	ps, err := change(append([]Product(nil), prodList...))
+	if err != nil {
+		return err
+	}
+	if catalogPath != "" {
+		if err := saveCatalog(catalogPath, catalogFile{Attributes: attributes, Rounding: roundings, Products: ps}); err != nil {
+			return err
+		}
+	}
+	prodList = ps
+	return nil
+}
+
+// saveCatalog writes the catalog file.
+func saveCatalog(path string, cf catalogFile) error {
+	b, err := json.MarshalIndent(cf, "", "    ")
+	if err != nil {
+		return errors.Wrap(err, "could not encode the catalog")
+	}
+	return errors.Wrap(writeFileAtomic(path, func(w io.Writer) error {
+		_, err := w.Write(append(b, '\n'))
+		return err
+	}), "could not save the catalog")
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	promotionPercentage = "percentage"
+	promotionFixed      = "fixed"
+	promotionBuyXGetY   = "buy_x_get_y"
+)
+
+var (
+	ErrUnknownCoupon     = errors.New("coupon code is not valid")
+	ErrCouponExpired     = errors.New("coupon code is not active")
+	ErrCouponExhausted   = errors.New("coupon code has reached its usage limit")
+	ErrCouponNotEligible = errors.New("coupon code does not apply to the cart")
+)
+
+// Promotion is a discount applied automatically or with a coupon code.
+type Promotion struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	// Type is one of "percentage", "fixed" or "buy_x_get_y".
+	Type string `json:"type"`
+	// Code makes the promotion a coupon, promotions without a code apply
+	// automatically.
+	Code string `json:"code,omitempty"`
+	// Percent off the eligible lines, 10 stands for 10%.
+	Percent float64 `json:"percent,omitempty"`
+	// Amount off the eligible lines in the base currency.
+	Amount Money `json:"amount,omitempty"`
+	// Every BuyQuantity items of a line get FreeQuantity more items free.
+	BuyQuantity  int `json:"buyQuantity,omitempty"`
+	FreeQuantity int `json:"freeQuantity,omitempty"`
+	// Categories limits the promotion to products of the categories.
+	Categories []string `json:"categories,omitempty"`
+	// StartsAt and EndsAt limit the validity window when set.
+	StartsAt time.Time `json:"startsAt,omitempty"`
+	EndsAt   time.Time `json:"endsAt,omitempty"`
+	// UsageLimit is the number of orders the promotion may be used in, zero
+	// means unlimited.
+	UsageLimit int `json:"usageLimit,omitempty"`
+}
+
+// Discount is a promotion applied to a cart or an order.
+type Discount struct {
+	PromotionId string `json:"promotionId"`
+	Name        string `json:"name"`
+	Code        string `json:"code,omitempty"`
+	Amount      Money  `json:"amount"`
+}
+
+// promotionStore keeps the promotions and counts their usage.
+type promotionStore struct {
+	mu         sync.Mutex
+	promotions []Promotion
+	used       map[string]int
+}
+
+var promotions = newPromotionStore(nil)
+
+func newPromotionStore(ps []Promotion) *promotionStore {
+	return &promotionStore{promotions: ps, used: map[string]int{}}
+}
+
+func init() {
+	c, err := embedded.ReadFile("promotions.json")
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to open promotions json file")
+	}
+	pl := map[string][]Promotion{}
+	if err := json.Unmarshal(c, &pl); err != nil {
+		log.Fatal().Err(err).Msg("failed to parse the promotions JSON")
+	}
+	for _, p := range pl["promotions"] {
+		if err := p.validate(); err != nil {
+			log.Fatal().Err(err).Str("promotion", p.Id).Msg("invalid promotion")
+		}
+	}
+	promotions = newPromotionStore(pl["promotions"])
+	log.Info().Int("promotions", len(pl["promotions"])).Msg("successfully parsed promotions from json")
+}
+
+func (p Promotion) validate() error {
+	switch p.Type {
+	case promotionPercentage:
+		if p.Percent <= 0 || p.Percent > 100 {
+			return errors.Errorf("percent %v is out of range (0, 100]", p.Percent)
+		}
+	case promotionFixed:
+		if !IsPositive(p.Amount) || p.Amount.CurrencyCode != defaultCurrency {
+			return errors.Errorf("amount must be a positive %s value", defaultCurrency)
+		}
+	case promotionBuyXGetY:
+		if p.BuyQuantity <= 0 || p.FreeQuantity <= 0 {
+			return errors.New("buy and free quantities must be positive")
+		}
+	default:
+		return errors.Errorf("unknown promotion type %q", p.Type)
+	}
+	if !p.EndsAt.IsZero() && p.EndsAt.Before(p.StartsAt) {
+		return errors.New("promotion ends before it starts")
+	}
+	return nil
+}
+
+func (p Promotion) active(now time.Time) bool {
+	return (p.StartsAt.IsZero() || !now.Before(p.StartsAt)) &&
+		(p.EndsAt.IsZero() || now.Before(p.EndsAt))
+}
+
+func (p Promotion) eligible(item Product) bool {
+	if len(p.Categories) == 0 {
+		return true
+	}
+	for _, c := range item.Categories {
+		if containsFold(p.Categories, c) {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply discounts the order lines with the active automatic promotions and
+// the coupon. The discount of every line is added to its Discount and
+// never exceeds its cost. A coupon which can not be used is reported with
+// an error, the automatic promotions are applied regardless.
+func (s *promotionStore) Apply(lines []OrderItem, code string, currency string, now time.Time) ([]Discount, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var (
+		discounts []Discount
+		couponErr error
+	)
+	if code != "" {
+		couponErr = ErrUnknownCoupon
+	}
+	for _, p := range s.promotions {
+		if p.Code != "" && !strings.EqualFold(p.Code, code) {
+			continue
+		}
+		var err error
+		switch {
+		case !p.active(now):
+			err = ErrCouponExpired
+		case p.UsageLimit > 0 && s.used[p.Id] >= p.UsageLimit:
+			err = ErrCouponExhausted
+		}
+		if err != nil {
+			if p.Code != "" {
+				couponErr = err
+			}
+			continue
+		}
+
+		d, err := p.apply(lines, currency)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not apply promotion %q", p.Id)
+		}
+		if p.Code != "" {
+			couponErr = nil
+			if IsZero(d.Amount) {
+				couponErr = ErrCouponNotEligible
+				continue
+			}
+		}
+		if !IsZero(d.Amount) {
+			discounts = append(discounts, d)
+		}
+	}
+	return discounts, couponErr
+}
+
+// apply adds the promotion discount to the eligible lines.
+func (p Promotion) apply(lines []OrderItem, currency string) (Discount, error) {
+	d := Discount{PromotionId: p.Id, Name: p.Name, Code: p.Code, Amount: Money{CurrencyCode: currency}}
+
+	// amounts which are still left to discount on every eligible line
+	left := make([]Money, len(lines))
+	eligible := Money{CurrencyCode: currency}
+	for i, l := range lines {
+		if !p.eligible(l.Item) {
+			continue
+		}
+		var err error
+		if left[i], err = Sum(l.Cost, Negate(l.Discount)); err != nil {
+			return Discount{}, err
+		}
+		if eligible, err = Sum(eligible, left[i]); err != nil {
+			return Discount{}, err
+		}
+	}
+	if !IsPositive(eligible) {
+		return d, nil
+	}
+
+	off := make([]Money, len(lines))
+	switch p.Type {
+	case promotionPercentage:
+		for i := range lines {
+			if IsPositive(left[i]) {
+				off[i] = MultiplyRate(left[i], p.Percent/100)
+			}
+		}
+	case promotionBuyXGetY:
+		for i, l := range lines {
+			if free := l.Quantity / (p.BuyQuantity + p.FreeQuantity) * p.FreeQuantity; free > 0 && IsPositive(left[i]) {
+				off[i] = MultiplySlow(l.Price(currency), uint32(free))
+			}
+		}
+	case promotionFixed:
+		amount := Convert(p.Amount, currency)
+		if c, err := Compare(amount, eligible); err != nil {
+			return Discount{}, err
+		} else if c > 0 {
+			amount = eligible
+		}
+		// split the amount proportionally, the last line takes the rest
+		rest, last := amount, -1
+		for i := range lines {
+			if IsPositive(left[i]) {
+				last = i
+			}
+		}
+		for i := range lines {
+			if !IsPositive(left[i]) {
+				continue
+			}
+			off[i] = rest
+			if i != last {
+				off[i] = MultiplyRate(amount, moneyRatio(left[i], eligible))
+			}
+			rest = Must(Sum(rest, Negate(off[i])))
+		}
+	}
+
+	for i := range lines {
+		if IsZero(off[i]) || off[i].CurrencyCode == "" {
+			continue
+		}
+		if c, err := Compare(off[i], left[i]); err != nil {
+			return Discount{}, err
+		} else if c > 0 {
+			off[i] = left[i]
+		}
+		lines[i].Discount = Must(Sum(lines[i].Discount, off[i]))
+		d.Amount = Must(Sum(d.Amount, off[i]))
+	}
+	return d, nil
+}
+
+// Redeem counts a use of the discounts' promotions. Nothing is counted if
+// one of the promotions has reached its usage limit.
+func (s *promotionStore) Redeem(discounts []Discount) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range discounts {
+		for _, p := range s.promotions {
+			if p.Id == d.PromotionId && p.UsageLimit > 0 && s.used[p.Id] >= p.UsageLimit {
+				return errors.Wrap(ErrCouponExhausted, p.Id)
+			}
+		}
+	}
+	for _, d := range discounts {
+		s.used[d.PromotionId]++
+	}
+	return nil
+}
+
+// Release takes back a use of the discounts' promotions, e.g. of an order
+// which could not be paid.
+func (s *promotionStore) Release(discounts []Discount) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range discounts {
+		if s.used[d.PromotionId] > 0 {
+			s.used[d.PromotionId]--
+		}
+	}
+}
+
+func isCouponError(err error) bool {
+	switch errors.Cause(err) {
+	case ErrUnknownCoupon, ErrCouponExpired, ErrCouponExhausted, ErrCouponNotEligible:
+		return true
+	}
+	return false
+}
+
+// moneyRatio returns l/r of two values in the same currency.
+func moneyRatio(l, r Money) float64 {
+	return (float64(l.Units)*nanosMod + float64(l.Nanos)) / (float64(r.Units)*nanosMod + float64(r.Nanos))
+}
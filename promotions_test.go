@@ -0,0 +1,227 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/pkg/errors"
+)
+
+func promoLine(id string, categories []string, unit Money, qty int) OrderItem {
+	return OrderItem{
+		Item:     Product{Id: id, Categories: categories, PriceUsd: unit},
+		Quantity: qty,
+		Cost:     MultiplySlow(unit, uint32(qty)),
+		Discount: Money{CurrencyCode: unit.CurrencyCode},
+	}
+}
+
+func promoLines() []OrderItem {
+	return []OrderItem{
+		promoLine("camera", []string{"photography", "vintage"}, usd(30, 0), 1),
+		promoLine("mug", []string{"cookware"}, usd(10, 0), 3),
+	}
+}
+
+func TestPromotionApply(t *testing.T) {
+	now := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name          string
+		promotions    []Promotion
+		code          string
+		wantDiscounts []Money
+		wantLines     []Money
+		wantErr       error
+	}{
+		{"percentage", []Promotion{{Id: "p", Type: promotionPercentage, Percent: 10}}, "",
+			[]Money{usd(6, 0)}, []Money{usd(3, 0), usd(3, 0)}, nil},
+		{"category percentage", []Promotion{{Id: "p", Type: promotionPercentage, Percent: 15, Categories: []string{"vintage"}}}, "",
+			[]Money{usd(4, 500000000)}, []Money{usd(4, 500000000), usd(0, 0)}, nil},
+		{"fixed split proportionally", []Promotion{{Id: "f", Type: promotionFixed, Amount: usd(6, 0)}}, "",
+			[]Money{usd(6, 0)}, []Money{usd(3, 0), usd(3, 0)}, nil},
+		{"fixed capped at eligible", []Promotion{{Id: "f", Type: promotionFixed, Amount: usd(50, 0), Categories: []string{"cookware"}}}, "",
+			[]Money{usd(30, 0)}, []Money{usd(0, 0), usd(30, 0)}, nil},
+		{"buy 2 get 1", []Promotion{{Id: "b", Type: promotionBuyXGetY, BuyQuantity: 2, FreeQuantity: 1, Categories: []string{"cookware"}}}, "",
+			[]Money{usd(10, 0)}, []Money{usd(0, 0), usd(10, 0)}, nil},
+		{"stacked on discounted lines", []Promotion{
+			{Id: "b", Type: promotionBuyXGetY, BuyQuantity: 2, FreeQuantity: 1},
+			{Id: "p", Type: promotionPercentage, Percent: 50},
+		}, "", []Money{usd(10, 0), usd(25, 0)}, []Money{usd(15, 0), usd(20, 0)}, nil},
+		{"coupon", []Promotion{{Id: "c", Type: promotionPercentage, Percent: 10, Code: "SAVE"}}, "save",
+			[]Money{usd(6, 0)}, []Money{usd(3, 0), usd(3, 0)}, nil},
+		{"coupon not entered", []Promotion{{Id: "c", Type: promotionPercentage, Percent: 10, Code: "SAVE"}}, "",
+			nil, []Money{usd(0, 0), usd(0, 0)}, nil},
+		{"unknown coupon", []Promotion{{Id: "c", Type: promotionPercentage, Percent: 10, Code: "SAVE"}}, "FREE",
+			nil, []Money{usd(0, 0), usd(0, 0)}, ErrUnknownCoupon},
+		{"expired coupon", []Promotion{{Id: "c", Type: promotionPercentage, Percent: 10, Code: "SAVE", EndsAt: now}}, "SAVE",
+			nil, []Money{usd(0, 0), usd(0, 0)}, ErrCouponExpired},
+		{"future promotion", []Promotion{{Id: "p", Type: promotionPercentage, Percent: 10, StartsAt: now.Add(time.Hour)}}, "",
+			nil, []Money{usd(0, 0), usd(0, 0)}, nil},
+		{"coupon out of scope", []Promotion{{Id: "c", Type: promotionPercentage, Percent: 10, Code: "SAVE", Categories: []string{"cycling"}}}, "SAVE",
+			nil, []Money{usd(0, 0), usd(0, 0)}, ErrCouponNotEligible},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lines := promoLines()
+			got, err := newPromotionStore(tt.promotions).Apply(lines, tt.code, "USD", now)
+			if errors.Cause(err) != tt.wantErr {
+				t.Errorf("Apply() error = %v, want %v", err, tt.wantErr)
+			}
+			var amounts []Money
+			for _, d := range got {
+				amounts = append(amounts, d.Amount)
+			}
+			if !reflect.DeepEqual(amounts, tt.wantDiscounts) {
+				t.Errorf("Apply() discounts = %v, want %v", amounts, tt.wantDiscounts)
+			}
+			for i, l := range lines {
+				if !AreEquals(l.Discount, tt.wantLines[i]) {
+					t.Errorf("line %d discount = %v, want %v", i, l.Discount, tt.wantLines[i])
+				}
+			}
+		})
+	}
+}
+
+func TestPromotionFixedConverts(t *testing.T) {
+	saved := rates
+	defer func() { rates = saved }()
+	rates = map[string]float64{"EUR": 1, "USD": 2}
+
+	lines := []OrderItem{promoLine("mug", nil, mmc(10, 0, "EUR"), 1)}
+	got, err := newPromotionStore([]Promotion{{Id: "f", Type: promotionFixed, Amount: usd(5, 0)}}).Apply(lines, "", "EUR", time.Now())
+	if err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	if want := mmc(2, 500000000, "EUR"); len(got) != 1 || !AreEquals(got[0].Amount, want) {
+		t.Errorf("Apply() = %v, want a discount of %v", got, want)
+	}
+}
+
+func TestPromotionUsageLimit(t *testing.T) {
+	s := newPromotionStore([]Promotion{{Id: "c", Type: promotionPercentage, Percent: 10, Code: "ONCE", UsageLimit: 1}})
+
+	d, err := s.Apply(promoLines(), "ONCE", "USD", time.Now())
+	if err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	if err := s.Redeem(d); err != nil {
+		t.Fatalf("Redeem() error = %v", err)
+	}
+	if err := s.Redeem(d); errors.Cause(err) != ErrCouponExhausted {
+		t.Errorf("second Redeem() error = %v, want %v", err, ErrCouponExhausted)
+	}
+	if _, err := s.Apply(promoLines(), "ONCE", "USD", time.Now()); errors.Cause(err) != ErrCouponExhausted {
+		t.Errorf("Apply() after the limit error = %v, want %v", err, ErrCouponExhausted)
+	}
+}
+
+func TestCancelReleasesPromotionUse(t *testing.T) {
+	const session = "cancel-coupon-test"
+	old := promotions
+	promotions = newPromotionStore([]Promotion{{Id: "c", Type: promotionPercentage, Percent: 10, Code: "ONCE", UsageLimit: 1}})
+	defer func() { promotions = old }()
+
+	d, err := promotions.Apply(promoLines(), "ONCE", "USD", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := promotions.Redeem(d); err != nil {
+		t.Fatal(err)
+	}
+	o := NewOrder(session, usd(10, 0))
+	o.Discounts = d
+	if err := o.Pay(o.Total); err != nil {
+		t.Fatal(err)
+	}
+	orders.Add(o)
+
+	r := httptest.NewRequest(http.MethodPost, "/order/"+o.OrderId+"/cancel", nil)
+	r.AddCookie(&http.Cookie{Name: cookieSessionID, Value: signCookie(cookieSessionID, session)})
+	w := httptest.NewRecorder()
+	RegisterRouter(defaultConfig()).ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("cancel code = %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	if err := promotions.Redeem(d); err != nil {
+		t.Errorf("Redeem() after the order was cancelled error = %v, want the use released", err)
+	}
+}
+
+func TestFullRefundReleasesStockAndPromotionUse(t *testing.T) {
+	old := promotions
+	promotions = newPromotionStore([]Promotion{{Id: "r", Type: promotionPercentage, Percent: 10, Code: "REFUND", UsageLimit: 1}})
+	defer func() { promotions = old }()
+	router := chi.NewRouter()
+	router.Post("/admin/orders/{id}/refund", refundOrderHandler)
+	refund := func(id, amount string) {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodPost, "/admin/orders/"+id+"/refund", strings.NewReader(url.Values{"amount": {amount}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("refund code = %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	lines := []OrderItem{promoLine("66VCHSJNUP", nil, usd(5, 0), 2)}
+	d, err := promotions.Apply(lines, "REFUND", "USD", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := promotions.Redeem(d); err != nil {
+		t.Fatal(err)
+	}
+	o := NewOrder("refund-release-test", usd(10, 0))
+	o.Items, o.Discounts = lines, d
+	if err := o.Pay(o.Total); err != nil {
+		t.Fatal(err)
+	}
+	orders.Add(o)
+	sku := lines[0].SKU()
+	before, _ := inventory.Available(sku)
+
+	refund(o.OrderId, "4")
+	if got, _ := inventory.Available(sku); got != before {
+		t.Errorf("stock after a partial refund = %d, want %d", got, before)
+	}
+	refund(o.OrderId, "")
+	if got, _ := inventory.Available(sku); got != before+lines[0].Quantity {
+		t.Errorf("stock after the full refund = %d, want %d", got, before+lines[0].Quantity)
+	}
+	if err := promotions.Redeem(d); err != nil {
+		t.Errorf("Redeem() after the full refund error = %v, want the use released", err)
+	}
+}
+
+func TestPromotionValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		p     Promotion
+		valid bool
+	}{
+		{"percentage", Promotion{Type: promotionPercentage, Percent: 10}, true},
+		{"percentage over 100", Promotion{Type: promotionPercentage, Percent: 110}, false},
+		{"fixed in base currency", Promotion{Type: promotionFixed, Amount: usd(5, 0)}, true},
+		{"fixed in other currency", Promotion{Type: promotionFixed, Amount: mmc(5, 0, "EUR")}, false},
+		{"buy x get y", Promotion{Type: promotionBuyXGetY, BuyQuantity: 2, FreeQuantity: 1}, true},
+		{"buy x get nothing", Promotion{Type: promotionBuyXGetY, BuyQuantity: 2}, false},
+		{"unknown type", Promotion{Type: "bogo"}, false},
+		{"ends before start", Promotion{Type: promotionPercentage, Percent: 10,
+			StartsAt: time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC), EndsAt: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.p.validate(); (err == nil) != tt.valid {
+				t.Errorf("validate() = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
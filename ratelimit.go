@@ -0,0 +1,295 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/hlog"
+	"golang.org/x/time/rate"
+)
+
+// Route groups sharing rate limits.
+const (
+	rateGroupPages    = "pages"
+	rateGroupAPI      = "api"
+	rateGroupCheckout = "checkout"
+	rateGroupAdmin    = "admin"
+
+	rateKeyIP      = "ip"
+	rateKeySession = "session"
+
+	// rateBucketIdleTTL is how long the bucket of a client is kept after its
+	// last request, a new bucket starts full.
+	rateBucketIdleTTL = 10 * time.Minute
+)
+
+// RateLimit is a token bucket refilled with Rate tokens per second up to
+// Burst tokens, every request takes one token. A zero rate disables it.
+type RateLimit struct {
+	Rate  float64 `yaml:"rate" json:"rate"`
+	Burst int     `yaml:"burst" json:"burst"`
+}
+
+// RateLimitGroup limits the requests to a group of routes per client IP and
+// per session.
+type RateLimitGroup struct {
+	PerIP      RateLimit `yaml:"per_ip" json:"perIp"`
+	PerSession RateLimit `yaml:"per_session" json:"perSession"`
+}
+
+func (l RateLimit) valid() bool {
+	return l.Rate == 0 || l.Rate > 0 && l.Burst >= 1
+}
+
+// defaultRateLimits returns the limits of the groups which are not
+// configured. The per IP limits are only on behind trusted proxies, else all
+// the clients behind a proxy would share the bucket of its address. The admin
+// group is always limited per IP, it has few clients and guards the admin
+// password.
+func defaultRateLimits(perIP bool) map[string]RateLimitGroup {
+	groups := map[string]RateLimitGroup{
+		rateGroupPages:    {PerIP: RateLimit{Rate: 20, Burst: 40}, PerSession: RateLimit{Rate: 10, Burst: 20}},
+		rateGroupAPI:      {PerIP: RateLimit{Rate: 10, Burst: 20}, PerSession: RateLimit{Rate: 5, Burst: 10}},
+		rateGroupCheckout: {PerIP: RateLimit{Rate: 1, Burst: 5}, PerSession: RateLimit{Rate: 0.2, Burst: 3}},
+		rateGroupAdmin:    {PerIP: RateLimit{Rate: 5, Burst: 20}, PerSession: RateLimit{Rate: 5, Burst: 20}},
+	}
+	if !perIP {
+		for name, g := range groups {
+			if name == rateGroupAdmin {
+				continue
+			}
+			g.PerIP = RateLimit{}
+			groups[name] = g
+		}
+	}
+	return groups
+}
+
+// limitsPerIP reports whether any group but admin is limited per client IP.
+func limitsPerIP(groups map[string]RateLimitGroup) bool {
+	for name, g := range groups {
+		if name != rateGroupAdmin && g.PerIP.Rate > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func validateRateLimits(groups map[string]RateLimitGroup) error {
+	for name, g := range groups {
+		switch name {
+		case rateGroupPages, rateGroupAPI, rateGroupCheckout, rateGroupAdmin:
+		default:
+			return errors.Errorf("unknown rate limit group %q", name)
+		}
+		if !g.PerIP.valid() {
+			return errors.Errorf("rate limit %s per %s needs a positive rate and burst", name, rateKeyIP)
+		}
+		if !g.PerSession.valid() {
+			return errors.Errorf("rate limit %s per %s needs a positive rate and burst", name, rateKeySession)
+		}
+	}
+	return nil
+}
+
+// parseTrustedProxies parses IP addresses and CIDR ranges.
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(proxies))
+	for _, p := range proxies {
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, errors.Errorf("invalid trusted proxy %q", p)
+			}
+			bits := 8 * len(ip)
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid trusted proxy %q", p)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// clientIP returns the address of the client. The X-Forwarded-For header is
+// only trusted when the request comes from a trusted proxy, the client is
+// then the right-most address which is not a trusted proxy.
+func clientIP(r *http.Request, trusted []*net.IPNet) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !isTrusted(host, trusted) {
+		return host
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		host = hop
+		if !isTrusted(hop, trusted) {
+			break
+		}
+	}
+	return host
+}
+
+func isTrusted(addr string, trusted []*net.IPNet) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// rateLimiter holds a token bucket per client.
+type rateLimiter struct {
+	group, key string
+	limit      RateLimit
+	now        func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*rateBucket
+	sweptAt time.Time
+}
+
+type rateBucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newRateLimiter(group, key string, limit RateLimit) *rateLimiter {
+	return &rateLimiter{group: group, key: key, limit: limit, now: time.Now, buckets: map[string]*rateBucket{}}
+}
+
+// rateToken is a token taken from a bucket.
+type rateToken struct {
+	res *rate.Reservation
+	at  time.Time
+}
+
+// giveBack returns the token to its bucket. The reservation is cancelled at
+// the time it was made, a reservation which already acted cannot be
+// cancelled later.
+func (t rateToken) giveBack() {
+	t.res.CancelAt(t.at)
+}
+
+// reserve takes a token of the client bucket. It returns how long the client
+// has to wait for a token when there is none, nothing is taken then.
+func (l *rateLimiter) reserve(client string) (*rateToken, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if now.Sub(l.sweptAt) >= rateBucketIdleTTL {
+		l.sweep(now)
+	}
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &rateBucket{limiter: rate.NewLimiter(rate.Limit(l.limit.Rate), l.limit.Burst)}
+		l.buckets[client] = b
+		rateLimitKeys.WithLabelValues(l.group, l.key).Set(float64(len(l.buckets)))
+	}
+	b.lastSeen = now
+
+	res := b.limiter.ReserveN(now, 1)
+	if delay := res.DelayFrom(now); delay > 0 {
+		res.CancelAt(now)
+		return nil, delay
+	}
+	return &rateToken{res: res, at: now}, 0
+}
+
+// sweep forgets the clients which were idle for a while. Must be called
+// with the lock held.
+func (l *rateLimiter) sweep(now time.Time) {
+	for client, b := range l.buckets {
+		if now.Sub(b.lastSeen) >= rateBucketIdleTTL {
+			delete(l.buckets, client)
+		}
+	}
+	l.sweptAt = now
+	rateLimitKeys.WithLabelValues(l.group, l.key).Set(float64(len(l.buckets)))
+}
+
+// rateLimits limits the route groups.
+type rateLimits struct {
+	trusted []*net.IPNet
+	groups  map[string][]*rateLimiter
+}
+
+func newRateLimits(groups map[string]RateLimitGroup, trusted []*net.IPNet) *rateLimits {
+	rl := &rateLimits{trusted: trusted, groups: map[string][]*rateLimiter{}}
+	for name, g := range groups {
+		if g.PerIP.Rate > 0 {
+			rl.groups[name] = append(rl.groups[name], newRateLimiter(name, rateKeyIP, g.PerIP))
+		}
+		if g.PerSession.Rate > 0 {
+			rl.groups[name] = append(rl.groups[name], newRateLimiter(name, rateKeySession, g.PerSession))
+		}
+	}
+	return rl
+}
+
+// Handler limits the requests to the routes of the group. A request over
+// any of the limits is rejected with 429 and the Retry-After header, it
+// must run after ensureSessionID. The requests without a session cookie are
+// limited per session by the client IP, else a client dropping the cookie
+// would get a new bucket with every request.
+func (rl *rateLimits) Handler(group string) func(http.Handler) http.Handler {
+	limiters := rl.groups[group]
+	return func(next http.Handler) http.Handler {
+		if len(limiters) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var taken []*rateToken
+			for _, l := range limiters {
+				var client string
+				switch {
+				case l.key == rateKeyIP:
+					client = clientIP(r, rl.trusted)
+				case isNewSession(r):
+					client = rateKeyIP + ":" + clientIP(r, rl.trusted)
+				default:
+					client = sessionID(r)
+				}
+				token, delay := l.reserve(client)
+				if token == nil {
+					// give back the tokens of the other limits
+					for _, t := range taken {
+						t.giveBack()
+					}
+					rateLimitRequests.WithLabelValues(group, "limited_"+l.key).Inc()
+					hlog.FromRequest(r).Debug().Str("group", group).Str("limit", l.key).Str("client", client).
+						Dur("retry_after", delay).Msg("rate limited")
+					w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+					http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+					return
+				}
+				taken = append(taken, token)
+			}
+			rateLimitRequests.WithLabelValues(group, "allowed").Inc()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, remote, xff, want string
+	}{
+		{"direct", "203.0.113.7:1234", "", "203.0.113.7"},
+		{"spoofed header from untrusted client", "203.0.113.7:1234", "198.51.100.1", "203.0.113.7"},
+		{"trusted proxy", "10.1.2.3:80", "198.51.100.1", "198.51.100.1"},
+		{"chain of trusted proxies", "10.1.2.3:80", "198.51.100.1, 192.168.1.1, 10.9.9.9", "198.51.100.1"},
+		{"client spoofing behind proxy", "10.1.2.3:80", "1.1.1.1, 198.51.100.1", "198.51.100.1"},
+		{"garbage hop", "10.1.2.3:80", "junk, 198.51.100.1", "198.51.100.1"},
+		{"only proxies", "[::1]:80", "10.0.0.1", "10.0.0.1"},
+		{"trusted proxy without header", "192.168.1.1:80", "", "192.168.1.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remote
+			if tt.xff != "" {
+				r.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			if got := clientIP(r, trusted); got != tt.want {
+				t.Errorf("clientIP() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := parseTrustedProxies([]string{"proxy.local"}); err == nil {
+		t.Error("parseTrustedProxies() accepted a host name")
+	}
+}
+
+func TestRateLimitsHandler(t *testing.T) {
+	limits := newRateLimits(map[string]RateLimitGroup{
+		rateGroupAPI: {PerIP: RateLimit{Rate: 0.01, Burst: 3}, PerSession: RateLimit{Rate: 0.01, Burst: 2}},
+	}, nil)
+	h := ensureSessionID(limits.Handler(rateGroupAPI)(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})))
+
+	session := &http.Cookie{Name: cookieSessionID, Value: signCookie(cookieSessionID, "limited")}
+	get := func(ip string, withSession bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/rate", nil)
+		r.RemoteAddr = ip + ":1234"
+		if withSession {
+			r.AddCookie(session)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	before := testutil.ToFloat64(rateLimitRequests.WithLabelValues(rateGroupAPI, "limited_"+rateKeySession))
+	for i := 0; i < 2; i++ {
+		if w := get("203.0.113.1", true); w.Code != http.StatusOK {
+			t.Fatalf("request %d code = %d", i, w.Code)
+		}
+	}
+	w := get("203.0.113.1", true)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("session over its limit code = %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if s, err := strconv.Atoi(w.Header().Get("Retry-After")); err != nil || s < 1 {
+		t.Errorf("Retry-After = %q", w.Header().Get("Retry-After"))
+	}
+	if got := testutil.ToFloat64(rateLimitRequests.WithLabelValues(rateGroupAPI, "limited_"+rateKeySession)); got != before+1 {
+		t.Errorf("limited requests = %v, want %v", got, before+1)
+	}
+
+	// the rejected request gave its IP token back, a new session gets one
+	if w := get("203.0.113.1", false); w.Code != http.StatusOK {
+		t.Errorf("new session code = %d, want %d", w.Code, http.StatusOK)
+	}
+	if w := get("203.0.113.1", false); w.Code != http.StatusTooManyRequests {
+		t.Errorf("IP over its limit code = %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if w := get("203.0.113.2", false); w.Code != http.StatusOK {
+		t.Errorf("other IP code = %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestRateLimitsHandlerWithoutSessionCookie(t *testing.T) {
+	limits := newRateLimits(map[string]RateLimitGroup{
+		rateGroupAdmin: {PerSession: RateLimit{Rate: 0.01, Burst: 2}},
+	}, nil)
+	h := ensureSessionID(limits.Handler(rateGroupAdmin)(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})))
+
+	get := func(ip string) int {
+		r := httptest.NewRequest(http.MethodGet, "/admin/orders", nil)
+		r.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	for i := 0; i < 2; i++ {
+		if code := get("203.0.113.1"); code != http.StatusOK {
+			t.Fatalf("request %d code = %d", i, code)
+		}
+	}
+	if code := get("203.0.113.1"); code != http.StatusTooManyRequests {
+		t.Errorf("client without a cookie over its limit code = %d, want %d", code, http.StatusTooManyRequests)
+	}
+	if code := get("203.0.113.2"); code != http.StatusOK {
+		t.Errorf("other IP code = %d, want %d", code, http.StatusOK)
+	}
+	if n := len(limits.groups[rateGroupAdmin][0].buckets); n != 2 {
+		t.Errorf("%d buckets, want one per IP", n)
+	}
+}
+
+func TestRateLimiterForgetsIdleClients(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	l := newRateLimiter("test", rateKeyIP, RateLimit{Rate: 0.001, Burst: 1})
+	l.now = func() time.Time { return now }
+
+	if res, _ := l.reserve("a"); res == nil {
+		t.Fatal("first request limited")
+	}
+	if res, delay := l.reserve("a"); res != nil || delay <= 0 {
+		t.Fatalf("reserve() = %v, %v, want a delay", res, delay)
+	}
+	l.reserve("b")
+
+	now = now.Add(rateBucketIdleTTL)
+	if res, _ := l.reserve("a"); res == nil {
+		t.Error("idle client still limited")
+	}
+	if len(l.buckets) != 1 {
+		t.Errorf("%d buckets kept, want 1", len(l.buckets))
+	}
+}
+
+func TestValidateRateLimits(t *testing.T) {
+	for _, perIP := range []bool{false, true} {
+		if err := validateRateLimits(defaultRateLimits(perIP)); err != nil {
+			t.Errorf("default limits are invalid: %v", err)
+		}
+	}
+	for _, groups := range []map[string]RateLimitGroup{
+		{"static": {}},
+		{rateGroupAPI: {PerIP: RateLimit{Rate: -1, Burst: 1}}},
+		{rateGroupAPI: {PerSession: RateLimit{Rate: 1}}},
+	} {
+		if err := validateRateLimits(groups); err == nil {
+			t.Errorf("validateRateLimits(%v) is valid", groups)
+		}
+	}
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/pkg/errors"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog/hlog"
+	"github.com/rs/zerolog/log"
+)
+
+// ReviewStatus is the moderation state of a review, only approved reviews
+// are shown and rated.
+type ReviewStatus string
+
+const (
+	ReviewPending  ReviewStatus = "pending"
+	ReviewApproved ReviewStatus = "approved"
+	ReviewRejected ReviewStatus = "rejected"
+)
+
+const (
+	maxReviewTitle  = 100
+	maxReviewBody   = 2000
+	maxReviewAuthor = 50
+	// maxReviewRequest bounds the review request body, well above the
+	// longest valid review.
+	maxReviewRequest = 16 << 10
+
+	// Reviews pending moderation are capped so that a client can not fill
+	// the reviews file faster than the admins moderate it.
+	maxPendingReviewsPerSession = 3
+	maxPendingReviewsPerProduct = 100
+)
+
+var (
+	ErrReviewNotFound = errors.New("no such review")
+	ErrInvalidReview  = errors.New("invalid review")
+	ErrTooManyReviews = errors.New("too many reviews pending moderation")
+	ErrNoSession      = errors.New("reviews are submitted from a session, reload the page")
+)
+
+// Review is the rating and opinion of a customer on a product.
+type Review struct {
+	Id        string    `json:"id"`
+	ProductId string    `json:"productId"`
+	Rating    int       `json:"rating"`
+	Title     string    `json:"title"`
+	Body      string    `json:"body,omitempty"`
+	Author    string    `json:"author"`
+	CreatedAt time.Time `json:"createdAt"`
+
+	Status      ReviewStatus `json:"status"`
+	ModeratedAt *time.Time   `json:"moderatedAt,omitempty"`
+	// ModeratedBy is the admin who approved or rejected the review.
+	ModeratedBy string `json:"moderatedBy,omitempty"`
+
+	// SessionId is the session which submitted the review, it is neither
+	// shown nor saved.
+	SessionId string `json:"-"`
+}
+
+// Rating is the average of the approved reviews of a product.
+type Rating struct {
+	Average float64 `json:"average"`
+	Count   int     `json:"count"`
+}
+
+// Stars returns the average rounded to whole stars.
+func (r Rating) Stars() int {
+	return int(math.Round(r.Average))
+}
+
+// reviewStore keeps the reviews in memory and saves them to the reviews
+// file on every change when there is one.
+type reviewStore struct {
+	mu      sync.RWMutex
+	reviews []Review
+	ratings map[string]Rating
+	path    string
+	now     func() time.Time
+}
+
+var reviews = newReviewStore(nil, "")
+
+func newReviewStore(rs []Review, path string) *reviewStore {
+	s := &reviewStore{reviews: rs, path: path, now: time.Now}
+	s.ratings = rateReviews(rs)
+	return s
+}
+
+// LoadReviews reads the reviews from the JSON file, which is created with
+// the first review when it does not exist. Without a file the reviews are
+// lost on restart. It must be called before serving requests.
+func LoadReviews(path string) error {
+	var f struct {
+		Reviews []Review `json:"reviews"`
+	}
+	if path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "could not read the reviews")
+		}
+		if err == nil {
+			if err := json.Unmarshal(b, &f); err != nil {
+				return errors.Wrap(err, "could not parse the reviews")
+			}
+		}
+	}
+	reviews = newReviewStore(f.Reviews, path)
+	log.Info().Int("reviews", len(f.Reviews)).Msg("successfully loaded product reviews")
+	return nil
+}
+
+// validateReview checks a review written by a customer.
+func validateReview(r Review) error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+	check(1 <= r.Rating && r.Rating <= 5, "rating %d must be between 1 and 5", r.Rating)
+	check(r.Title != "", "title is required")
+	check(utf8.RuneCountInString(r.Title) <= maxReviewTitle, "title must be at most %d characters", maxReviewTitle)
+	check(utf8.RuneCountInString(r.Body) <= maxReviewBody, "review must be at most %d characters", maxReviewBody)
+	check(r.Author != "", "name is required")
+	check(utf8.RuneCountInString(r.Author) <= maxReviewAuthor, "name must be at most %d characters", maxReviewAuthor)
+	if len(problems) > 0 {
+		return errors.Wrap(ErrInvalidReview, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Add saves the review pending moderation and returns it with its ID. It
+// fails with ErrTooManyReviews when the session or the product has too many
+// reviews pending.
+func (s *reviewStore) Add(r Review) (Review, error) {
+	r.Title, r.Body, r.Author = strings.TrimSpace(r.Title), strings.TrimSpace(r.Body), strings.TrimSpace(r.Author)
+	if err := validateReview(r); err != nil {
+		return Review{}, err
+	}
+	r.Id, r.Status, r.CreatedAt = xid.New().String(), ReviewPending, s.now()
+	r.ModeratedAt, r.ModeratedBy = nil, ""
+
+	err := s.update(func(rs []Review) ([]Review, error) {
+		bySession, byProduct := 0, 0
+		for _, pending := range rs {
+			if pending.Status != ReviewPending {
+				continue
+			}
+			if r.SessionId != "" && pending.SessionId == r.SessionId {
+				bySession++
+			}
+			if pending.ProductId == r.ProductId {
+				byProduct++
+			}
+		}
+		if bySession >= maxPendingReviewsPerSession {
+			return nil, errors.Wrapf(ErrTooManyReviews, "%d by the session", bySession)
+		}
+		if byProduct >= maxPendingReviewsPerProduct {
+			return nil, errors.Wrapf(ErrTooManyReviews, "%d of product #%s", byProduct, r.ProductId)
+		}
+		return append(rs, r), nil
+	})
+	if err != nil {
+		return Review{}, err
+	}
+	return r, nil
+}
+
+// Moderate approves or rejects the review, which can be moderated again.
+func (s *reviewStore) Moderate(id string, status ReviewStatus, admin string) (Review, error) {
+	if status != ReviewApproved && status != ReviewRejected {
+		return Review{}, errors.Wrapf(ErrInvalidReview, "status %q is not %s or %s", status, ReviewApproved, ReviewRejected)
+	}
+	var moderated Review
+	err := s.update(func(rs []Review) ([]Review, error) {
+		for i := range rs {
+			if rs[i].Id == id {
+				now := s.now()
+				rs[i].Status, rs[i].ModeratedAt, rs[i].ModeratedBy = status, &now, admin
+				moderated = rs[i]
+				return rs, nil
+			}
+		}
+		return nil, errors.Wrapf(ErrReviewNotFound, "review %s", id)
+	})
+	return moderated, err
+}
+
+// List returns the reviews of the product, or of all products when the
+// product ID is empty, with the status, or any when it is empty. The
+// newest come first.
+func (s *reviewStore) List(productID string, status ReviewStatus) []Review {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var rs []Review
+	for _, r := range s.reviews {
+		if (productID == "" || r.ProductId == productID) && (status == "" || r.Status == status) {
+			rs = append(rs, r)
+		}
+	}
+	sort.SliceStable(rs, func(i, j int) bool { return rs[i].CreatedAt.After(rs[j].CreatedAt) })
+	return rs
+}
+
+// Rating returns the average rating of the product.
+func (s *reviewStore) Rating(productID string) Rating {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.ratings[productID]
+}
+
+// update applies the change to a copy of the reviews, saves it and then
+// serves it. The reviews are left unchanged when saving fails.
+func (s *reviewStore) update(change func([]Review) ([]Review, error)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rs, err := change(append([]Review(nil), s.reviews...))
+	if err != nil {
+		return err
+	}
+	if s.path != "" {
+		if err := saveReviews(s.path, rs); err != nil {
+			return err
+		}
+	}
+	s.reviews, s.ratings = rs, rateReviews(rs)
+	return nil
+}
+
+// saveReviews writes the reviews file.
+func saveReviews(path string, rs []Review) error {
+	b, err := json.MarshalIndent(map[string][]Review{"reviews": rs}, "", "    ")
+	if err != nil {
+		return errors.Wrap(err, "could not encode the reviews")
+	}
+	return errors.Wrap(writeFileAtomic(path, func(w io.Writer) error {
+		_, err := w.Write(append(b, '\n'))
+		return err
+	}), "could not save the reviews")
+}
+
+// rateReviews averages the approved reviews by product.
+func rateReviews(rs []Review) map[string]Rating {
+	sums := map[string]int{}
+	ratings := map[string]Rating{}
+	for _, r := range rs {
+		if r.Status != ReviewApproved {
+			continue
+		}
+		sums[r.ProductId] += r.Rating
+		ratings[r.ProductId] = Rating{Count: ratings[r.ProductId].Count + 1}
+	}
+	for pid, rt := range ratings {
+		rt.Average = float64(sums[pid]) / float64(rt.Count)
+		ratings[pid] = rt
+	}
+	return ratings
+}
+
+// stars draws a rating of 0 to 5 stars.
+func stars(n int) string {
+	if n < 0 {
+		n = 0
+	} else if n > 5 {
+		n = 5
+	}
+	return strings.Repeat("★", n) + strings.Repeat("☆", 5-n)
+}
+
+func reviewErrorCode(err error) int {
+	switch errors.Cause(err) {
+	case ErrProductNotFound, ErrReviewNotFound:
+		return http.StatusNotFound
+	case ErrInvalidReview:
+		return http.StatusBadRequest
+	case ErrTooManyReviews:
+		return http.StatusTooManyRequests
+	}
+	return http.StatusInternalServerError
+}
+
+// addReviewHandler saves the review of the product given with the form or
+// as JSON, it is shown once approved. The request must come with a session
+// cookie, else a client dropping it would not be held to the pending reviews
+// cap of a session.
+func addReviewHandler(w http.ResponseWriter, r *http.Request) {
+	l := hlog.FromRequest(r)
+	pid := chi.URLParam(r, "id")
+	if isNewSession(r) {
+		renderError(l, r, w, ErrNoSession, http.StatusForbidden)
+		return
+	}
+	if _, err := GetProduct(r.Context(), pid); err != nil {
+		renderError(l, r, w, err, reviewErrorCode(err))
+		return
+	}
+
+	var rv Review
+	r.Body = http.MaxBytesReader(w, r.Body, maxReviewRequest)
+	if isJSONBody(r) {
+		if err := json.NewDecoder(r.Body).Decode(&rv); err != nil {
+			renderError(l, r, w, errors.Wrap(err, "could not parse the review"), http.StatusBadRequest)
+			return
+		}
+	} else {
+		if err := r.ParseForm(); err != nil {
+			renderError(l, r, w, errors.Wrap(err, "could not parse the review"), http.StatusBadRequest)
+			return
+		}
+		rv.Rating, _ = strconv.Atoi(r.FormValue("rating"))
+		rv.Title, rv.Body, rv.Author = r.FormValue("title"), r.FormValue("body"), r.FormValue("author")
+	}
+	rv.ProductId, rv.SessionId = pid, sessionID(r)
+	rv, err := reviews.Add(rv)
+	if err != nil {
+		renderError(l, r, w, err, reviewErrorCode(err))
+		return
+	}
+	l.Info().Str("product", pid).Str("review", rv.Id).Int("rating", rv.Rating).Msg("review submitted")
+	if wantsJSON(r) {
+		render.Status(r, http.StatusCreated)
+		render.JSON(w, r, rv)
+		return
+	}
+	http.Redirect(w, r, "/product/"+pid+"?review=submitted#reviews", http.StatusFound)
+}
+
+// reviewsAdminHandler lists the reviews of a status, the pending ones by
+// default, to approve or reject them.
+func reviewsAdminHandler(w http.ResponseWriter, r *http.Request) {
+	l := hlog.FromRequest(r)
+	status := ReviewStatus(r.URL.Query().Get("status"))
+	switch status {
+	case "":
+		status = ReviewPending
+	case ReviewPending, ReviewApproved, ReviewRejected:
+	default:
+		renderError(l, r, w, errors.Wrapf(ErrInvalidReview, "unknown status %q", status), http.StatusBadRequest)
+		return
+	}
+	rs := reviews.List("", status)
+	if wantsJSON(r) {
+		render.JSON(w, r, rs)
+		return
+	}
+	rid, _ := hlog.IDFromRequest(r)
+	if err := executeTemplate(r.Context(), w, "admin_reviews", map[string]interface{}{
+		"request_id": rid.String(),
+		"reviews":    rs,
+		"status":     status,
+		"statuses":   []ReviewStatus{ReviewPending, ReviewApproved, ReviewRejected},
+	}); err != nil {
+		l.Info().Err(err).Msg("unable to parse admin_reviews template")
+	}
+}
+
+// moderateReviewHandler approves or rejects the review.
+func moderateReviewHandler(status ReviewStatus) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		l := hlog.FromRequest(r)
+		rv, err := reviews.Moderate(chi.URLParam(r, "id"), status, adminUser(r))
+		if err != nil {
+			renderError(l, r, w, err, reviewErrorCode(err))
+			return
+		}
+		l.Info().Str("review", rv.Id).Str("product", rv.ProductId).Str("status", string(status)).
+			Str("admin", adminUser(r)).Msg("review moderated")
+		if wantsJSON(r) {
+			render.JSON(w, r, rv)
+			return
+		}
+		http.Redirect(w, r, "/admin/reviews", http.StatusSeeOther)
+	}
+}
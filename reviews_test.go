@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestValidateReview(t *testing.T) {
+	valid := Review{ProductId: "OLJCESPC7Z", Rating: 4, Title: "Nice", Body: "Works well.", Author: "Ada"}
+	tests := []struct {
+		name    string
+		change  func(r *Review)
+		wantErr bool
+	}{
+		{"valid", func(r *Review) {}, false},
+		{"no body", func(r *Review) { r.Body = "" }, false},
+		{"longest title", func(r *Review) { r.Title = strings.Repeat("ü", maxReviewTitle) }, false},
+		{"no rating", func(r *Review) { r.Rating = 0 }, true},
+		{"rating above 5", func(r *Review) { r.Rating = 6 }, true},
+		{"no title", func(r *Review) { r.Title = "" }, true},
+		{"title too long", func(r *Review) { r.Title = strings.Repeat("a", maxReviewTitle+1) }, true},
+		{"body too long", func(r *Review) { r.Body = strings.Repeat("a", maxReviewBody+1) }, true},
+		{"no author", func(r *Review) { r.Author = "" }, true},
+		{"author too long", func(r *Review) { r.Author = strings.Repeat("a", maxReviewAuthor+1) }, true},
+	}
+	for _, tt := range tests {
+		r := valid
+		tt.change(&r)
+		err := validateReview(r)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: validateReview() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+		if err != nil && errors.Cause(err) != ErrInvalidReview {
+			t.Errorf("%s: validateReview() error = %v, want ErrInvalidReview", tt.name, err)
+		}
+	}
+}
+
+func TestReviewStoreModeration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reviews.json")
+	s := newReviewStore(nil, path)
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { now = now.Add(time.Minute); return now }
+
+	add := func(pid string, rating int) Review {
+		r, err := s.Add(Review{ProductId: pid, Rating: rating, Title: " Title ", Author: "Ada"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	a, b, c := add("A", 5), add("A", 2), add("B", 3)
+	if a.Status != ReviewPending || a.Title != "Title" || a.Id == "" {
+		t.Errorf("Add() = %+v, want a pending review with a trimmed title and an ID", a)
+	}
+	if got := s.Rating("A"); got.Count != 0 {
+		t.Errorf("Rating() = %+v before moderation, want no reviews", got)
+	}
+
+	for _, m := range []struct {
+		id     string
+		status ReviewStatus
+	}{{a.Id, ReviewApproved}, {b.Id, ReviewApproved}, {c.Id, ReviewRejected}} {
+		r, err := s.Moderate(m.id, m.status, "admin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Status != m.status || r.ModeratedBy != "admin" || r.ModeratedAt == nil {
+			t.Errorf("Moderate() = %+v, want %s by admin", r, m.status)
+		}
+	}
+	if _, err := s.Moderate("nope", ReviewApproved, "admin"); errors.Cause(err) != ErrReviewNotFound {
+		t.Errorf("Moderate() of a missing review error = %v, want ErrReviewNotFound", err)
+	}
+	if _, err := s.Moderate(a.Id, ReviewPending, "admin"); errors.Cause(err) != ErrInvalidReview {
+		t.Errorf("Moderate() back to pending error = %v, want ErrInvalidReview", err)
+	}
+
+	if got, want := s.Rating("A"), (Rating{Average: 3.5, Count: 2}); got != want {
+		t.Errorf("Rating(A) = %+v, want %+v", got, want)
+	}
+	if got := s.Rating("B"); got.Count != 0 {
+		t.Errorf("Rating(B) = %+v, want the rejected review left out", got)
+	}
+	if got := s.List("A", ReviewApproved); len(got) != 2 || got[0].Id != b.Id {
+		t.Errorf("List(A, approved) = %+v, want the 2 reviews newest first", got)
+	}
+
+	saved := reviews
+	defer func() { reviews = saved }()
+	if err := LoadReviews(path); err != nil {
+		t.Fatal(err)
+	}
+	if got := reviews.List("", ""); len(got) != 3 {
+		t.Errorf("LoadReviews() loaded %d reviews, want 3", len(got))
+	}
+	if got := reviews.Rating("A"); got.Count != 2 {
+		t.Errorf("Rating(A) after LoadReviews() = %+v, want 2 reviews", got)
+	}
+}
+
+func TestReviewStoreCapsPendingReviews(t *testing.T) {
+	s := newReviewStore(nil, "")
+	add := func(pid, session string) error {
+		_, err := s.Add(Review{ProductId: pid, Rating: 4, Title: "Nice", Author: "Ada", SessionId: session})
+		return err
+	}
+
+	for i := 0; i < maxPendingReviewsPerSession; i++ {
+		if err := add("A", "spammer"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := add("B", "spammer"); errors.Cause(err) != ErrTooManyReviews {
+		t.Errorf("Add() over the session cap error = %v, want ErrTooManyReviews", err)
+	}
+	if err := add("A", "other"); err != nil {
+		t.Errorf("Add() by another session error = %v", err)
+	}
+
+	// moderated reviews no longer count
+	for _, r := range s.List("A", ReviewPending) {
+		if r.SessionId == "spammer" {
+			if _, err := s.Moderate(r.Id, ReviewRejected, "admin"); err != nil {
+				t.Fatal(err)
+			}
+			break
+		}
+	}
+	if err := add("B", "spammer"); err != nil {
+		t.Errorf("Add() after moderation error = %v", err)
+	}
+
+	for i := 0; len(s.List("C", ReviewPending)) < maxPendingReviewsPerProduct; i++ {
+		if err := add("C", strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := add("C", "new"); errors.Cause(err) != ErrTooManyReviews {
+		t.Errorf("Add() over the product cap error = %v, want ErrTooManyReviews", err)
+	}
+	if got := reviewErrorCode(errors.Wrap(ErrTooManyReviews, "test")); got != http.StatusTooManyRequests {
+		t.Errorf("reviewErrorCode() = %d, want %d", got, http.StatusTooManyRequests)
+	}
+}
+
+func TestReviewHandlers(t *testing.T) {
+	saved := reviews
+	defer func() { reviews = saved }()
+	reviews = newReviewStore(nil, "")
+
+	cfg := defaultConfig()
+	cfg.AdminPassword = "s3cret"
+	cfg.RateLimits[rateGroupCheckout] = RateLimitGroup{}
+	router := RegisterRouter(cfg)
+	var session *http.Cookie
+	do := func(method, target string, form url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if strings.HasPrefix(target, "/admin") {
+			r.SetBasicAuth("admin", "s3cret")
+		}
+		if session != nil {
+			r.AddCookie(session)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+	review := url.Values{"rating": {"4"}, "title": {"Great lamp"}, "author": {"Ada"}}
+
+	// a client without a session cookie is not held to the session cap
+	if got := do(http.MethodPost, "/product/OLJCESPC7Z/reviews", review).Code; got != http.StatusForbidden {
+		t.Errorf("submit without a session cookie: code = %d, want %d", got, http.StatusForbidden)
+	}
+	session = &http.Cookie{Name: cookieSessionID, Value: signCookie(cookieSessionID, "reviewer")}
+
+	tests := []struct {
+		name, target string
+		form         url.Values
+		want         int
+	}{
+		{"unknown product", "/product/NOPE/reviews", review, http.StatusNotFound},
+		{"invalid", "/product/OLJCESPC7Z/reviews", url.Values{"rating": {"9"}, "title": {"x"}, "author": {"Ada"}}, http.StatusBadRequest},
+		{"too large", "/product/OLJCESPC7Z/reviews", url.Values{"rating": {"4"}, "title": {"x"}, "author": {"Ada"}, "body": {strings.Repeat("a", maxReviewRequest)}}, http.StatusBadRequest},
+		{"submit", "/product/OLJCESPC7Z/reviews", review, http.StatusFound},
+		{"submit JSON", "/product/OLJCESPC7Z/reviews?json=1", url.Values{"rating": {"2"}, "title": {"Meh"}, "author": {"Bob"}}, http.StatusCreated},
+	}
+	for _, tt := range tests {
+		if got := do(http.MethodPost, tt.target, tt.form).Code; got != tt.want {
+			t.Errorf("%s: code = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	if body := do(http.MethodGet, "/product/OLJCESPC7Z", nil).Body.String(); strings.Contains(body, "Great lamp") {
+		t.Error("product page shows a review pending moderation")
+	}
+	pending := reviews.List("", ReviewPending)
+	if len(pending) != 2 {
+		t.Fatalf("%d pending reviews, want 2", len(pending))
+	}
+	if body := do(http.MethodGet, "/admin/reviews", nil).Body.String(); !strings.Contains(body, "Great lamp") {
+		t.Error("admin page does not list the pending review")
+	}
+	if got := do(http.MethodGet, "/admin/reviews?status=spam", nil).Code; got != http.StatusBadRequest {
+		t.Errorf("unknown status code = %d, want %d", got, http.StatusBadRequest)
+	}
+	for _, r := range pending {
+		if got := do(http.MethodPost, "/admin/reviews/"+r.Id+"/approve", nil).Code; got != http.StatusSeeOther {
+			t.Errorf("approve code = %d, want %d", got, http.StatusSeeOther)
+		}
+	}
+	if got := do(http.MethodPost, "/admin/reviews/nope/reject", nil).Code; got != http.StatusNotFound {
+		t.Errorf("reject missing review code = %d, want %d", got, http.StatusNotFound)
+	}
+
+	if body := do(http.MethodGet, "/product/OLJCESPC7Z", nil).Body.String(); !strings.Contains(body, "Great lamp") || !strings.Contains(body, "3.0 out of 5") {
+		t.Error("product page does not show the approved reviews and their rating")
+	}
+	var p struct {
+		Rating  Rating   `json:"rating"`
+		Reviews []Review `json:"reviews"`
+	}
+	if err := json.Unmarshal(do(http.MethodGet, "/product/OLJCESPC7Z?json=1", nil).Body.Bytes(), &p); err != nil {
+		t.Fatal(err)
+	}
+	if want := (Rating{Average: 3, Count: 2}); p.Rating != want || len(p.Reviews) != 2 {
+		t.Errorf("product JSON rating = %+v with %d reviews, want %+v with 2", p.Rating, len(p.Reviews), want)
+	}
+}
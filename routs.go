@@ -3,9 +3,6 @@ package main
 import (
 	"fmt"
 	"net/http"
-	"os"
-	"path/filepath"
-	"strings"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
@@ -13,52 +10,104 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
-func RegisterRouter() chi.Router {
+func RegisterRouter(cfg config) chi.Router {
 	r := chi.NewRouter()
 
-	r.Use(hlog.NewHandler(log.Logger))
+	r.Use(instrumentHandler)
+	r.Use(traceHandler)
+	r.Use(hlog.NewHandler(requestLogger(log.Logger, cfg.LogSampleBurst, cfg.LogSampleRate)))
 	r.Use(hlog.URLHandler("url"))
 	r.Use(hlog.RemoteAddrHandler("ip"))
 	r.Use(hlog.UserAgentHandler("user_agent"))
 	r.Use(hlog.RefererHandler("referer"))
 	r.Use(hlog.RequestIDHandler("cid", ""))
+	r.Use(traceLogHandler)
 	r.Use(middleware.Recoverer)
 	r.Use(middleware.GetHead)
 	r.Use(middleware.StripSlashes)
+	r.Use(ensureSessionID)
+	r.Use(featureFlagsHandler)
+	r.Use(localeHandler)
 
-	r.Get("/", homeHandler)
-	r.Get("/product/{id}", productHandler)
-	r.Get("/rate", ratesHandler)
-	r.Get("/convert/{currency_id}/{price}", convertHandler)
-	r.Post("/setCurrency", setCurrencyHandler)
+	// the configuration is validated on load
+	trusted, _ := parseTrustedProxies(cfg.TrustedProxies)
+	limits := newRateLimits(cfg.RateLimits, trusted)
 
-	workDir, _ := os.Getwd()
-	filesDir := filepath.Join(workDir, "static")
-	FileServer(r, "/static/", http.Dir(filesDir))
+	r.Group(func(r chi.Router) {
+		r.Use(limits.Handler(rateGroupPages))
+		r.Get("/", homeHandler)
+		r.Get("/product/{id}", productHandler)
+		r.Get("/wishlist", wishlistHandler)
+		r.Post("/wishlist", addToWishlistHandler)
+		r.Post("/wishlist/remove", removeFromWishlistHandler)
+		r.Get("/recently-viewed", recentlyViewedHandler)
+		r.Post("/setCurrency", setCurrencyHandler)
+		r.Post("/setLocale", setLocaleHandler)
+		r.Get("/cart", viewCartHandler)
+		r.Post("/cart", addToCartHandler)
+		r.Post("/cart/empty", emptyCartHandler)
+		r.Get("/order/{id}", orderHandler)
+		r.Post("/order/{id}/cancel", cancelOrderHandler)
+	})
+	r.Group(func(r chi.Router) {
+		r.Use(limits.Handler(rateGroupAPI))
+		r.Get("/rate", ratesHandler)
+		r.Get("/convert/{currency_id}/{price}", convertHandler)
+	})
+	r.Group(func(r chi.Router) {
+		r.Use(limits.Handler(rateGroupCheckout))
+		r.Post("/cart/coupon", applyCouponHandler)
+		r.Post("/cart/checkout", placeOrderHandler)
+		r.Post("/product/{id}/reviews", addReviewHandler)
+	})
+
+	r.Get(assetsPrefix+"*", func(w http.ResponseWriter, r *http.Request) { assets.ServeHTTP(w, r) })
 
 	r.Get("/robots.txt", func(w http.ResponseWriter, _ *http.Request) { fmt.Fprint(w, "User-agent: *\nDisallow: /") })
 
-	r.Get("/_healthz", func(w http.ResponseWriter, _ *http.Request) { fmt.Fprint(w, "ok") })
+	r.Method(http.MethodGet, "/metrics", MetricsHandler())
+	r.Get("/livez", livezHandler)
+	// the former health check, kept for the existing probes
+	r.Get("/_healthz", livezHandler)
+	r.Get("/readyz", readyzHandler)
 
-	return r
-}
+	if cfg.AdminPassword != "" {
+		r.Route("/admin", func(r chi.Router) {
+			r.Use(limits.Handler(rateGroupAdmin))
+			r.Use(adminAuth(cfg.AdminUser, cfg.AdminPassword))
+			r.Use(sameOrigin)
+			r.Get("/", http.RedirectHandler("/admin/products", http.StatusFound).ServeHTTP)
+			r.Get("/log-level", logLevelHandler)
+			r.Put("/log-level", setLogLevelHandler)
+			r.Get("/flags", flagsHandler)
 
-// FileServer conveniently sets up a http.FileServer handler to serve
-// static files from a http.FileSystem.
-func FileServer(r chi.Router, path string, root http.FileSystem) {
-	if strings.ContainsAny(path, "{}*") {
-		panic("FileServer does not permit URL parameters.")
-	}
+			admin := catalogAdmin{uploads: cfg.StaticDir != ""}
+			r.Get("/products", admin.listProductsHandler)
+			r.Post("/products", admin.createProductHandler)
+			r.Get("/products/{id}", admin.productHandler)
+			r.Put("/products/{id}", admin.updateProductHandler)
+			r.Delete("/products/{id}", admin.deleteProductHandler)
+			// HTML forms can only POST
+			r.Post("/products/{id}", admin.updateProductHandler)
+			r.Post("/products/{id}/delete", admin.deleteProductHandler)
+			if admin.uploads {
+				r.Post("/images", admin.uploadImageHandler)
+			}
+
+			r.Post("/orders/{id}/ship", shipOrderHandler)
+			r.Post("/orders/{id}/deliver", deliverOrderHandler)
+			r.Post("/orders/{id}/refund", refundOrderHandler)
 
-	fs := http.StripPrefix(path, http.FileServer(root))
+			r.Get("/webhooks", listWebhooksHandler)
+			r.Post("/webhooks", registerWebhookHandler)
+			r.Get("/webhooks/dead-letters", deadLettersHandler)
+			r.Delete("/webhooks/{id}", unregisterWebhookHandler)
 
-	if path != "/" && path[len(path)-1] != '/' {
-		r.Get(path, http.RedirectHandler(path+"/", 301).ServeHTTP)
-		path += "/"
+			r.Get("/reviews", reviewsAdminHandler)
+			r.Post("/reviews/{id}/approve", moderateReviewHandler(ReviewApproved))
+			r.Post("/reviews/{id}/reject", moderateReviewHandler(ReviewRejected))
+		})
 	}
-	path += "*"
 
-	r.Get(path, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fs.ServeHTTP(w, r)
-	}))
+	return r
 }
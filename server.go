@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// certCheckInterval is how often the TLS certificate files are checked for
+// changes.
+const certCheckInterval = 10 * time.Second
+
+// newServer builds the HTTP server with the configured limits.
+func newServer(cfg config, h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              cfg.Addr(),
+		Handler:           h,
+		ReadTimeout:       cfg.ReadTimeout,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+	}
+}
+
+// serve handles the connections of the listener until the context is done.
+// It then fails the readiness checks of the registry and keeps serving for
+// the drain period, so that the load balancer stops routing traffic to the
+// server before it closes the listener and waits for the requests in flight.
+// The server uses TLS when it has a TLS config.
+func serve(ctx context.Context, srv *http.Server, l net.Listener, h *healthRegistry, drainPeriod, shutdownTimeout time.Duration) error {
+	errc := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			errc <- srv.ServeTLS(l, "", "")
+		} else {
+			errc <- srv.Serve(l)
+		}
+	}()
+
+	select {
+	case err := <-errc:
+		return errors.Wrap(err, "server failed")
+	case <-ctx.Done():
+	}
+
+	h.SetShuttingDown()
+	log.Info().Dur("drain_period", drainPeriod).Msg("Draining, readiness is failing")
+	select {
+	case err := <-errc:
+		return errors.Wrap(err, "server failed")
+	case <-time.After(drainPeriod):
+	}
+
+	log.Info().Msg("Shutting down...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return errors.Wrap(err, "shutdown failed")
+	}
+	return nil
+}
+
+// certReloader serves the TLS certificate from files and loads it again
+// when they change, e.g. when the certificate is renewed.
+type certReloader struct {
+	certFile, keyFile string
+	interval          time.Duration
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+func newCertReloader(certFile, keyFile string, interval time.Duration) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile, interval: interval}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// TLSConfig returns a TLS config serving the current certificate.
+func (c *certReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: c.GetCertificate,
+	}
+}
+
+// GetCertificate returns the certificate, loading it again when the files
+// were modified. The previous certificate is kept when loading fails.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.checkedAt) >= c.interval {
+		if err := c.reload(); err != nil {
+			log.Error().Err(err).Msg("Unable to reload TLS certificate, serving the previous one")
+		}
+	}
+	return c.cert, nil
+}
+
+// reload loads the certificate when the files changed since the last load.
+// Must be called with the lock held.
+func (c *certReloader) reload() error {
+	c.checkedAt = time.Now()
+	var modTime time.Time
+	for _, f := range []string{c.certFile, c.keyFile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return errors.Wrap(err, "could not stat TLS certificate")
+		}
+		if fi.ModTime().After(modTime) {
+			modTime = fi.ModTime()
+		}
+	}
+	if c.cert != nil && modTime.Equal(c.modTime) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return errors.Wrap(err, "could not load TLS certificate")
+	}
+	c.cert, c.modTime = &cert, modTime
+	log.Info().Str("cert", c.certFile).Time("modified", modTime).Msg("TLS certificate loaded")
+	return nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServeDrainsBeforeShutdown(t *testing.T) {
+	h := newHealthRegistry(time.Second)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, _ *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if h.Check(r.Context()).Status != healthOK {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "http://" + l.Addr().String()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- serve(ctx, newServer(defaultConfig(), mux), l, h, 300*time.Millisecond, time.Second) }()
+
+	get := func(path string) (int, error) {
+		res, err := http.Get(url + path)
+		if err != nil {
+			return 0, err
+		}
+		res.Body.Close()
+		return res.StatusCode, nil
+	}
+	if code, err := get("/readyz"); err != nil || code != http.StatusOK {
+		t.Fatalf("GET /readyz = %d, %v before shutdown", code, err)
+	}
+
+	slow := make(chan int, 1)
+	go func() {
+		code, _ := get("/slow")
+		slow <- code
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+
+	if code, err := get("/readyz"); err != nil || code != http.StatusServiceUnavailable {
+		t.Errorf("GET /readyz = %d, %v while draining, want %d", code, err, http.StatusServiceUnavailable)
+	}
+	if code := <-slow; code != http.StatusNoContent {
+		t.Errorf("request in flight finished with %d", code)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("serve() error = %v", err)
+	}
+	if _, err := get("/readyz"); err == nil {
+		t.Error("server still accepts connections after shutdown")
+	}
+}
+
+func TestCertReloaderReloadsChangedFiles(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeTestCert(t, certFile, keyFile, "first", time.Now().Add(-time.Minute))
+
+	c, err := newCertReloader(certFile, keyFile, 0)
+	if err != nil {
+		t.Fatalf("newCertReloader() error = %v", err)
+	}
+	if got := servedCertName(t, c); got != "first" {
+		t.Fatalf("serving %q, want first", got)
+	}
+
+	writeTestCert(t, certFile, keyFile, "renewed", time.Now())
+	if got := servedCertName(t, c); got != "renewed" {
+		t.Errorf("serving %q after renewal, want renewed", got)
+	}
+
+	// a broken renewal keeps the previous certificate
+	if err := os.WriteFile(certFile, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	if got := servedCertName(t, c); got != "renewed" {
+		t.Errorf("serving %q after a broken renewal, want renewed", got)
+	}
+
+	if _, err := newCertReloader(certFile, keyFile, 0); err == nil {
+		t.Error("newCertReloader() loaded a broken certificate")
+	}
+}
+
+func TestServeTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeTestCert(t, certFile, keyFile, "shop", time.Now())
+	c, err := newCertReloader(certFile, keyFile, certCheckInterval)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := newServer(defaultConfig(), http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+	srv.TLSConfig = c.TLSConfig()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- serve(ctx, srv, l, newHealthRegistry(time.Second), 0, time.Second) }()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	res, err := client.Get("https://" + l.Addr().String())
+	if err != nil {
+		t.Fatalf("HTTPS request error = %v", err)
+	}
+	res.Body.Close()
+	if name := res.TLS.PeerCertificates[0].Subject.CommonName; name != "shop" {
+		t.Errorf("served certificate %q, want shop", name)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("serve() error = %v", err)
+	}
+}
+
+// writeTestCert writes a self-signed certificate for the common name and
+// sets the modification time of the files.
+func writeTestCert(t *testing.T, certFile, keyFile, name string, modTime time.Time) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{certFile, keyFile} {
+		if err := os.Chtimes(f, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func servedCertName(t *testing.T, c *certReloader) string {
+	t.Helper()
+	cert, err := c.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return x.Subject.CommonName
+}
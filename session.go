@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+)
+
+// cookieKeys sign the session cookie, the first key signs and all of them
+// verify. A random key is used until SetCookieKeys is called.
+var cookieKeys = [][]byte{randomKey()}
+
+// SetCookieKeys replaces the session cookie keys, a random key is used when
+// there are none. It must be called before serving requests.
+func SetCookieKeys(keys []string) {
+	if len(keys) == 0 {
+		cookieKeys = [][]byte{randomKey()}
+		return
+	}
+	cookieKeys = make([][]byte, len(keys))
+	for i, k := range keys {
+		cookieKeys[i] = []byte(k)
+	}
+}
+
+func randomKey() []byte {
+	k := make([]byte, minCookieKeyLen)
+	if _, err := rand.Read(k); err != nil {
+		panic(err)
+	}
+	return k
+}
+
+// signCookie appends the signature of the named cookie value to it.
+func signCookie(name, value string) string {
+	return value + "." + cookieSignature(cookieKeys[0], name, value)
+}
+
+// verifyCookie returns the value of the signed cookie value and whether its
+// signature matches one of the keys.
+func verifyCookie(name, signed string) (string, bool) {
+	i := strings.LastIndexByte(signed, '.')
+	if i < 0 {
+		return "", false
+	}
+	value, sig := signed[:i], signed[i+1:]
+	for _, k := range cookieKeys {
+		if hmac.Equal([]byte(sig), []byte(cookieSignature(k, name, value))) {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+func cookieSignature(key []byte, name, value string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(name + "=" + value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
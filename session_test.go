@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCookieSignatureRotation(t *testing.T) {
+	defer SetCookieKeys(nil)
+	oldKey, newKey := strings.Repeat("o", minCookieKeyLen), strings.Repeat("n", minCookieKeyLen)
+
+	SetCookieKeys([]string{oldKey})
+	signed := signCookie(cookieSessionID, "abc")
+
+	SetCookieKeys([]string{newKey, oldKey})
+	if v, ok := verifyCookie(cookieSessionID, signed); !ok || v != "abc" {
+		t.Errorf("verifyCookie() with rotated key = %q, %v", v, ok)
+	}
+	if _, ok := verifyCookie(cookiePrefix+"other", signed); ok {
+		t.Error("signature is valid for another cookie")
+	}
+
+	SetCookieKeys([]string{newKey})
+	for _, v := range []string{signed, "abc", "abc.", strings.Replace(signed, "abc", "abd", 1)} {
+		if _, ok := verifyCookie(cookieSessionID, v); ok {
+			t.Errorf("verifyCookie(%q) is valid", v)
+		}
+	}
+}
+
+func TestEnsureSessionIDReplacesForgedCookie(t *testing.T) {
+	var got string
+	h := ensureSessionID(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) { got = sessionID(r) }))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(&http.Cookie{Name: cookieSessionID, Value: "someone-else"})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if got == "" || got == "someone-else" {
+		t.Fatalf("session ID = %q, want a new one", got)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("got %d cookies, want the new session cookie", len(cookies))
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookies[0])
+	issued := got
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if got != issued {
+		t.Errorf("session ID = %q, want the issued %q", got, issued)
+	}
+}
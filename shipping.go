@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	shippingFlat     = "flat"
+	shippingPerItem  = "per_item"
+	shippingPerKg    = "per_kg"
+	shippingFreeOver = "free_over"
+)
+
+var ErrNoShippingZone = errors.New("shipping to the address is not available")
+
+// ShippingRule is a single component of the shipping cost. Amounts are
+// defined in the base currency.
+type ShippingRule struct {
+	// Type is one of "flat", "per_item", "per_kg" or "free_over".
+	Type string `json:"type"`
+	// Amount charged once, per item or per started kilogram.
+	Amount Money `json:"amount,omitempty"`
+	// Threshold of the cart subtotal from which shipping is free.
+	Threshold Money `json:"threshold,omitempty"`
+}
+
+// ShippingZone groups addresses sharing the same shipping rules.
+type ShippingZone struct {
+	Name string `json:"name"`
+	// Countries of the zone, "*" matches any country.
+	Countries []string `json:"countries"`
+	// ZipPrefixes limits the zone to zip codes with one of the prefixes.
+	ZipPrefixes []string       `json:"zipPrefixes,omitempty"`
+	Rules       []ShippingRule `json:"rules"`
+}
+
+type shippingConfig struct {
+	// DefaultZone is used to estimate shipping before the address is known.
+	DefaultZone string         `json:"defaultZone"`
+	Zones       []ShippingZone `json:"zones"`
+}
+
+var shipping shippingConfig
+
+func init() {
+	c, err := embedded.ReadFile("shipping.json")
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to open shipping rules json file")
+	}
+	if err := json.Unmarshal(c, &shipping); err != nil {
+		log.Fatal().Err(err).Msg("failed to parse the shipping rules JSON")
+	}
+	if err := shipping.validate(); err != nil {
+		log.Fatal().Err(err).Msg("invalid shipping rules")
+	}
+	log.Info().Int("zones", len(shipping.Zones)).Msg("successfully parsed shipping rules from json")
+}
+
+func (c shippingConfig) validate() error {
+	for _, z := range c.Zones {
+		for _, r := range z.Rules {
+			m := r.Amount
+			switch r.Type {
+			case shippingFlat, shippingPerItem, shippingPerKg:
+			case shippingFreeOver:
+				m = r.Threshold
+			default:
+				return errors.Errorf("zone %q: unknown rule type %q", z.Name, r.Type)
+			}
+			if !IsValid(m) || IsNegative(m) || m.CurrencyCode != defaultCurrency {
+				return errors.Errorf("zone %q: rule %q must have a non-negative %s amount", z.Name, r.Type, defaultCurrency)
+			}
+		}
+	}
+	if _, err := c.zone(Address{}); err != nil {
+		return errors.Wrapf(err, "default zone %q", c.DefaultZone)
+	}
+	return nil
+}
+
+// zone returns the first zone matching the address, the default zone is
+// used for an address without a country.
+func (c shippingConfig) zone(addr Address) (*ShippingZone, error) {
+	for i, z := range c.Zones {
+		if addr.Country == "" {
+			if z.Name == c.DefaultZone {
+				return &c.Zones[i], nil
+			}
+			continue
+		}
+		if z.matches(addr) {
+			return &c.Zones[i], nil
+		}
+	}
+	return nil, ErrNoShippingZone
+}
+
+func (z ShippingZone) matches(addr Address) bool {
+	if !containsFold(z.Countries, addr.Country) {
+		return false
+	}
+	if len(z.ZipPrefixes) == 0 {
+		return true
+	}
+	for _, p := range z.ZipPrefixes {
+		if strings.HasPrefix(strings.TrimSpace(addr.ZipCode), p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Quote calculates the shipping cost of the cart lines, priced in the
+// requested currency, to the address. The cost is computed in the base
+// currency and converted to the requested one, the free shipping thresholds
+// are converted to it to compare them with the subtotal of the lines.
+func (c shippingConfig) Quote(addr Address, lines []OrderItem, currency string) (Money, error) {
+	z, err := c.zone(addr)
+	if err != nil {
+		return Money{}, errors.Wrapf(err, "country %q, zip %q", addr.Country, addr.ZipCode)
+	}
+
+	subtotal := Money{CurrencyCode: currency}
+	quantity, grams := 0, 0
+	for _, it := range lines {
+		if subtotal, err = Sum(subtotal, it.Cost); err != nil {
+			return Money{}, errors.Wrap(err, "could not sum cart")
+		}
+		quantity += it.Quantity
+		grams += it.Item.WeightGrams * it.Quantity
+	}
+
+	cost := Money{CurrencyCode: defaultCurrency}
+	if quantity == 0 {
+		return Convert(cost, currency), nil
+	}
+	for _, r := range z.Rules {
+		if r.Type != shippingFreeOver {
+			continue
+		}
+		if left, err := Sum(subtotal, Negate(Convert(r.Threshold, currency))); err == nil && !IsNegative(left) {
+			return Convert(cost, currency), nil
+		}
+	}
+	for _, r := range z.Rules {
+		var charge Money
+		switch r.Type {
+		case shippingFlat:
+			charge = r.Amount
+		case shippingPerItem:
+			charge = MultiplySlow(r.Amount, uint32(quantity))
+		case shippingPerKg:
+			kg := (grams + 999) / 1000
+			if kg == 0 {
+				continue
+			}
+			charge = MultiplySlow(r.Amount, uint32(kg))
+		default:
+			continue
+		}
+		if cost, err = Sum(cost, charge); err != nil {
+			return Money{}, errors.Wrapf(err, "could not apply %q rule", r.Type)
+		}
+	}
+	return Convert(cost, currency), nil
+}
+
+// QuoteShipping calculates the shipping cost with the configured rules.
+func QuoteShipping(addr Address, lines []OrderItem, currency string) (Money, error) {
+	return shipping.Quote(addr, lines, currency)
+}
+
+// NewTrackingID issues a carrier tracking ID for a shipment.
+func NewTrackingID() string {
+	return "KS-" + strings.ToUpper(xid.New().String())
+}
+
+// ShipOrder hands the order over to the carrier with a new tracking ID.
+func ShipOrder(id string) (Order, error) {
+	o, err := orders.Update(id, func(o *Order) error { return o.Ship(NewTrackingID()) })
+	if err != nil {
+		return Order{}, err
+	}
+	webhooks.Publish(EventOrderShipped, o)
+	notifyOrder(mailOrderShipped, o)
+	return o, nil
+}
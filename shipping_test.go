@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"github.com/pkg/errors"
+)
+
+func usd(u int64, n int32) Money { return mmc(u, n, "USD") }
+
+var testShipping = shippingConfig{
+	DefaultZone: "us",
+	Zones: []ShippingZone{
+		{
+			Name:        "local",
+			Countries:   []string{"US", "United States"},
+			ZipPrefixes: []string{"94"},
+			Rules:       []ShippingRule{{Type: shippingFlat, Amount: usd(5, 0)}},
+		},
+		{
+			Name:      "us",
+			Countries: []string{"US", "United States"},
+			Rules: []ShippingRule{
+				{Type: shippingFreeOver, Threshold: usd(100, 0)},
+				{Type: shippingFlat, Amount: usd(8, 0)},
+				{Type: shippingPerKg, Amount: usd(1, 0)},
+			},
+		},
+		{
+			Name:      "world",
+			Countries: []string{"*"},
+			Rules: []ShippingRule{
+				{Type: shippingFlat, Amount: usd(20, 0)},
+				{Type: shippingPerItem, Amount: usd(2, 0)},
+			},
+		},
+	},
+}
+
+// testLines prices the cart items in the currency.
+func testLines(t *testing.T, items []CartItem, currency string) []OrderItem {
+	t.Helper()
+	lines, _, err := cartLines(context.Background(), items, currency)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lines
+}
+
+func TestShippingQuote(t *testing.T) {
+	tests := []struct {
+		name  string
+		addr  Address
+		items []CartItem
+		want  Money
+	}{
+		{"zip zone", Address{Country: "united states", ZipCode: "94043"}, []CartItem{{"LS4PSXUNUM", "LS4PSXUNUM-SV", 2}}, usd(5, 0)},
+		{"default zone", Address{}, []CartItem{{"LS4PSXUNUM", "LS4PSXUNUM-SV", 1}}, usd(9, 0)},
+		{"per started kg", Address{Country: "US", ZipCode: "10001"}, []CartItem{{"L9ECAV7KIM", "", 1}}, usd(12, 0)},
+		{"free over threshold", Address{Country: "US", ZipCode: "10001"}, []CartItem{{"OLJCESPC7Z", "", 2}}, usd(0, 0)},
+		{"per item", Address{Country: "Germany", ZipCode: "10115"}, []CartItem{{"66VCHSJNUP", "", 3}}, usd(26, 0)},
+		{"empty cart", Address{Country: "US"}, nil, usd(0, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := testShipping.Quote(tt.addr, testLines(t, tt.items, "USD"), "USD")
+			if err != nil {
+				t.Fatalf("Quote() error = %v", err)
+			}
+			if !AreEquals(got, tt.want) {
+				t.Errorf("Quote() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShippingQuoteConverts(t *testing.T) {
+	saved := rates
+	defer func() { rates = saved }()
+	rates = map[string]float64{"EUR": 1, "USD": 2}
+
+	got, err := testShipping.Quote(Address{}, testLines(t, []CartItem{{"LS4PSXUNUM", "LS4PSXUNUM-SV", 1}}, "EUR"), "EUR")
+	if err != nil {
+		t.Fatalf("Quote() error = %v", err)
+	}
+	if want := mmc(4, 500000000, "EUR"); !AreEquals(got, want) {
+		t.Errorf("Quote() = %v, want %v", got, want)
+	}
+}
+
+func TestShippingFreeOverUsesTheLineCosts(t *testing.T) {
+	saved := rates
+	defer func() { rates = saved }()
+	rates = map[string]float64{"EUR": 1, "USD": 2}
+	// the price list of the product, not its USD price, gives the cost of
+	// the line
+	line := func(cost Money) []OrderItem {
+		return []OrderItem{{Item: Product{Id: "p", PriceUsd: usd(300, 0)}, Quantity: 1, Cost: cost}}
+	}
+
+	tests := []struct {
+		name string
+		cost Money
+		want Money
+	}{
+		{"under the converted threshold", mmc(49, 990000000, "EUR"), mmc(4, 0, "EUR")},
+		{"at the converted threshold", mmc(50, 0, "EUR"), mmc(0, 0, "EUR")},
+	}
+	for _, tt := range tests {
+		got, err := testShipping.Quote(Address{Country: "US", ZipCode: "10001"}, line(tt.cost), "EUR")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !AreEquals(got, tt.want) {
+			t.Errorf("%s: Quote() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestShippingQuoteNoZone(t *testing.T) {
+	c := shippingConfig{DefaultZone: "us", Zones: testShipping.Zones[:2]}
+	_, err := c.Quote(Address{Country: "Germany"}, testLines(t, []CartItem{{"LS4PSXUNUM", "LS4PSXUNUM-SV", 1}}, "USD"), "USD")
+	if errors.Cause(err) != ErrNoShippingZone {
+		t.Errorf("got error %v, want %v", err, ErrNoShippingZone)
+	}
+}
+
+func TestShippingValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     shippingConfig
+		wantErr string
+	}{
+		{"valid", testShipping, ""},
+		{"unknown type", shippingConfig{DefaultZone: "a", Zones: []ShippingZone{
+			{Name: "a", Countries: []string{"*"}, Rules: []ShippingRule{{Type: "express", Amount: usd(1, 0)}}}}}, "unknown rule type"},
+		{"foreign currency", shippingConfig{DefaultZone: "a", Zones: []ShippingZone{
+			{Name: "a", Countries: []string{"*"}, Rules: []ShippingRule{{Type: shippingFlat, Amount: mmc(1, 0, "EUR")}}}}}, "non-negative USD amount"},
+		{"missing default zone", shippingConfig{DefaultZone: "b", Zones: []ShippingZone{
+			{Name: "a", Countries: []string{"*"}}}}, "default zone"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.validate()
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("validate() = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestShipOrderIssuesTrackingID(t *testing.T) {
+	o := NewOrder("session", usd(10, 0))
+	if err := o.Pay(o.Total); err != nil {
+		t.Fatal(err)
+	}
+	orders.Add(o)
+
+	shipped, err := ShipOrder(o.OrderId)
+	if err != nil {
+		t.Fatalf("ShipOrder() error = %v", err)
+	}
+	if shipped.Status != OrderShipped || !strings.HasPrefix(shipped.ShippingTrackingId, "KS-") {
+		t.Errorf("got status %q, tracking %q", shipped.Status, shipped.ShippingTrackingId)
+	}
+	if _, err := ShipOrder(o.OrderId); errors.Cause(err) != ErrInvalidTransition {
+		t.Errorf("second ShipOrder() error = %v, want %v", err, ErrInvalidTransition)
+	}
+}
+
+func TestShipOrderHandler(t *testing.T) {
+	router := chi.NewRouter()
+	router.Post("/admin/orders/{id}/ship", shipOrderHandler)
+	ship := func(id string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/orders/"+id+"/ship", nil))
+		return w
+	}
+
+	paid := NewOrder("ship-test", Money{CurrencyCode: "USD", Units: 10})
+	if err := paid.Pay(paid.Total); err != nil {
+		t.Fatal(err)
+	}
+	orders.Add(paid)
+	pending := NewOrder("ship-test", Money{CurrencyCode: "USD", Units: 10})
+	orders.Add(pending)
+
+	w := ship(paid.OrderId)
+	if w.Code != http.StatusOK {
+		t.Fatalf("ship code = %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	var shipped Order
+	if err := json.Unmarshal(w.Body.Bytes(), &shipped); err != nil {
+		t.Fatal(err)
+	}
+	if shipped.Status != OrderShipped || shipped.ShippingTrackingId == "" {
+		t.Errorf("shipped order = %+v, want shipped with a tracking ID", shipped)
+	}
+
+	tests := []struct {
+		name, id string
+		wantCode int
+	}{
+		{"shipped twice", paid.OrderId, http.StatusConflict},
+		{"not paid", pending.OrderId, http.StatusConflict},
+		{"missing", "nope", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if w := ship(tt.id); w.Code != tt.wantCode {
+			t.Errorf("%s: code = %d, want %d: %s", tt.name, w.Code, tt.wantCode, w.Body.String())
+		}
+	}
+}
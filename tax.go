@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// TaxJurisdiction holds the tax rates of a country or of its states.
+type TaxJurisdiction struct {
+	Name      string   `json:"name"`
+	Countries []string `json:"countries"`
+	// States limits the jurisdiction to the listed states of the countries.
+	States []string `json:"states,omitempty"`
+	// Rate is the standard rate, 0.2 stands for 20%.
+	Rate float64 `json:"rate"`
+	// Categories overrides the standard rate for product categories.
+	Categories map[string]float64 `json:"categories,omitempty"`
+}
+
+// TaxLine is the tax of a single cart or order line.
+type TaxLine struct {
+	ProductId string  `json:"productId"`
+	Rate      float64 `json:"rate"`
+	Tax       Money   `json:"tax"`
+}
+
+// TaxBreakdown is the tax of a cart or an order. Inclusive taxes are
+// already part of the line costs, exclusive ones are added to the total.
+type TaxBreakdown struct {
+	Jurisdiction string    `json:"jurisdiction,omitempty"`
+	Inclusive    bool      `json:"inclusive"`
+	Lines        []TaxLine `json:"lines"`
+	Total        Money     `json:"total"`
+}
+
+type taxConfig struct {
+	// DefaultJurisdiction is used to estimate taxes before the address is
+	// known.
+	DefaultJurisdiction string `json:"defaultJurisdiction"`
+	// InclusiveCurrencies lists currencies whose prices include taxes.
+	InclusiveCurrencies []string          `json:"inclusiveCurrencies"`
+	Jurisdictions       []TaxJurisdiction `json:"jurisdictions"`
+}
+
+var taxes taxConfig
+
+func init() {
+	c, err := embedded.ReadFile("tax.json")
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to open tax rules json file")
+	}
+	if err := json.Unmarshal(c, &taxes); err != nil {
+		log.Fatal().Err(err).Msg("failed to parse the tax rules JSON")
+	}
+	if err := taxes.validate(); err != nil {
+		log.Fatal().Err(err).Msg("invalid tax rules")
+	}
+	log.Info().Int("jurisdictions", len(taxes.Jurisdictions)).Msg("successfully parsed tax rules from json")
+}
+
+func (c taxConfig) validate() error {
+	for _, j := range c.Jurisdictions {
+		if j.Rate < 0 || j.Rate >= 1 {
+			return errors.Errorf("jurisdiction %q: rate %v is out of range [0, 1)", j.Name, j.Rate)
+		}
+		for cat, r := range j.Categories {
+			if r < 0 || r >= 1 {
+				return errors.Errorf("jurisdiction %q: category %q rate %v is out of range [0, 1)", j.Name, cat, r)
+			}
+		}
+	}
+	if c.DefaultJurisdiction != "" && c.jurisdiction(Address{}) == nil {
+		return errors.Errorf("default jurisdiction %q is not defined", c.DefaultJurisdiction)
+	}
+	return nil
+}
+
+// jurisdiction returns the first jurisdiction matching the address or nil
+// when the address is not taxed. The default jurisdiction is used for an
+// address without a country.
+func (c taxConfig) jurisdiction(addr Address) *TaxJurisdiction {
+	for i, j := range c.Jurisdictions {
+		if addr.Country == "" {
+			if j.Name == c.DefaultJurisdiction {
+				return &c.Jurisdictions[i]
+			}
+			continue
+		}
+		if j.matches(addr) {
+			return &c.Jurisdictions[i]
+		}
+	}
+	return nil
+}
+
+func (j TaxJurisdiction) matches(addr Address) bool {
+	if !containsFold(j.Countries, addr.Country) {
+		return false
+	}
+	return len(j.States) == 0 || containsFold(j.States, addr.State)
+}
+
+// rate returns the rate of the first product category with an override or
+// the standard rate.
+func (j TaxJurisdiction) rate(p Product) float64 {
+	for _, cat := range p.Categories {
+		if r, ok := j.Categories[cat]; ok {
+			return r
+		}
+	}
+	return j.Rate
+}
+
+func (c taxConfig) inclusive(currency string) bool {
+	return containsFold(c.InclusiveCurrencies, currency)
+}
+
+// Calculate returns the tax of the order lines priced in the currency for
+// shipping to the address.
+func (c taxConfig) Calculate(addr Address, lines []OrderItem, currency string) (TaxBreakdown, error) {
+	tb := TaxBreakdown{
+		Inclusive: c.inclusive(currency),
+		Lines:     make([]TaxLine, 0, len(lines)),
+		Total:     Money{CurrencyCode: currency},
+	}
+	j := c.jurisdiction(addr)
+	if j != nil {
+		tb.Jurisdiction = j.Name
+	}
+
+	for _, l := range lines {
+		tl := TaxLine{ProductId: l.Item.Id, Tax: Money{CurrencyCode: currency}}
+		net, err := l.Net()
+		if err != nil {
+			return TaxBreakdown{}, errors.Wrapf(err, "could not discount product #%s", l.Item.Id)
+		}
+		if j != nil {
+			tl.Rate = j.rate(l.Item)
+			if tb.Inclusive {
+				tl.Tax = MultiplyRate(net, tl.Rate/(1+tl.Rate))
+			} else {
+				tl.Tax = MultiplyRate(net, tl.Rate)
+			}
+		}
+		if tb.Total, err = Sum(tb.Total, tl.Tax); err != nil {
+			return TaxBreakdown{}, errors.Wrapf(err, "could not sum tax of product #%s", l.Item.Id)
+		}
+		tb.Lines = append(tb.Lines, tl)
+	}
+	return tb, nil
+}
+
+// CalculateTax returns the tax of the order lines with the configured rules.
+func CalculateTax(addr Address, lines []OrderItem, currency string) (TaxBreakdown, error) {
+	return taxes.Calculate(addr, lines, currency)
+}
+
+func containsFold(list []string, s string) bool {
+	s = strings.TrimSpace(s)
+	for _, v := range list {
+		if v == "*" || strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
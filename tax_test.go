@@ -0,0 +1,85 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+var testTaxes = taxConfig{
+	DefaultJurisdiction: "US-CA",
+	InclusiveCurrencies: []string{"EUR"},
+	Jurisdictions: []TaxJurisdiction{
+		{Name: "US-CA", Countries: []string{"US"}, States: []string{"CA"}, Rate: 0.1, Categories: map[string]float64{"gardening": 0}},
+		{Name: "DE", Countries: []string{"DE", "Germany"}, Rate: 0.19, Categories: map[string]float64{"gardening": 0.07}},
+	},
+}
+
+func taxLine(id string, categories []string, cost Money) OrderItem {
+	return OrderItem{Item: Product{Id: id, Categories: categories}, Quantity: 1, Cost: cost}
+}
+
+func TestTaxCalculate(t *testing.T) {
+	lines := func(c string) []OrderItem {
+		return []OrderItem{
+			taxLine("mug", []string{"cookware"}, mmc(119, 0, c)),
+			taxLine("plant", []string{"vintage", "gardening"}, mmc(10, 700000000, c)),
+		}
+	}
+	tests := []struct {
+		name     string
+		addr     Address
+		currency string
+		want     TaxBreakdown
+	}{
+		{"exclusive with category override", Address{Country: "US", State: "ca"}, "USD", TaxBreakdown{
+			Jurisdiction: "US-CA",
+			Lines:        []TaxLine{{"mug", 0.1, mmc(11, 900000000, "USD")}, {"plant", 0, mmc(0, 0, "USD")}},
+			Total:        mmc(11, 900000000, "USD"),
+		}},
+		{"default jurisdiction", Address{}, "USD", TaxBreakdown{
+			Jurisdiction: "US-CA",
+			Lines:        []TaxLine{{"mug", 0.1, mmc(11, 900000000, "USD")}, {"plant", 0, mmc(0, 0, "USD")}},
+			Total:        mmc(11, 900000000, "USD"),
+		}},
+		{"inclusive", Address{Country: "Germany"}, "EUR", TaxBreakdown{
+			Jurisdiction: "DE",
+			Inclusive:    true,
+			Lines:        []TaxLine{{"mug", 0.19, mmc(19, 0, "EUR")}, {"plant", 0.07, mmc(0, 700000000, "EUR")}},
+			Total:        mmc(19, 700000000, "EUR"),
+		}},
+		{"exclusive currency abroad", Address{Country: "DE"}, "USD", TaxBreakdown{
+			Jurisdiction: "DE",
+			Lines:        []TaxLine{{"mug", 0.19, mmc(22, 610000000, "USD")}, {"plant", 0.07, mmc(0, 750000000, "USD")}},
+			Total:        mmc(23, 360000000, "USD"),
+		}},
+		{"untaxed", Address{Country: "US", State: "OR"}, "USD", TaxBreakdown{
+			Lines: []TaxLine{{"mug", 0, mmc(0, 0, "USD")}, {"plant", 0, mmc(0, 0, "USD")}},
+			Total: mmc(0, 0, "USD"),
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := testTaxes.Calculate(tt.addr, lines(tt.currency), tt.currency)
+			if err != nil {
+				t.Fatalf("Calculate() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Calculate() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTaxValidate(t *testing.T) {
+	if err := testTaxes.validate(); err != nil {
+		t.Errorf("validate() = %v", err)
+	}
+	bad := taxConfig{Jurisdictions: []TaxJurisdiction{{Name: "X", Rate: 19}}}
+	if err := bad.validate(); err == nil {
+		t.Error("validate() accepted a rate of 1900%")
+	}
+	missing := taxConfig{DefaultJurisdiction: "Y", Jurisdictions: testTaxes.Jurisdictions}
+	if err := missing.validate(); err == nil {
+		t.Error("validate() accepted an undefined default jurisdiction")
+	}
+}
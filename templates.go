@@ -0,0 +1,133 @@
+package main
+
+import (
+	"html/template"
+	"io"
+	"io/fs"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// templateCheckInterval is how often the templates loaded from a directory
+// are checked for changes.
+const templateCheckInterval = time.Second
+
+// templateStore holds the page templates, with a copy for every locale
+// translating to it. The templates of a directory are parsed again when
+// they change, which is meant for development.
+type templateStore struct {
+	fsys fs.FS
+	// interval is zero for the embedded templates, which do not change.
+	interval time.Duration
+
+	mu sync.Mutex
+	// t is never executed so that it can be cloned for the locales.
+	t         *template.Template
+	localized map[*locale]*template.Template
+	modTime   time.Time
+	files     int
+	checkedAt time.Time
+}
+
+var templates *templateStore
+
+// LoadTemplates parses the page templates of the directory, or the
+// embedded ones when it is empty. It must be called before serving
+// requests.
+func LoadTemplates(dir string) error {
+	s := &templateStore{fsys: contentFS(dir, "templates")}
+	if dir != "" {
+		s.interval = templateCheckInterval
+	}
+	if err := s.reload(); err != nil {
+		return err
+	}
+	templates = s
+	return nil
+}
+
+// parseTemplates parses the templates and clones them for every locale.
+func parseTemplates(fsys fs.FS) (*template.Template, map[*locale]*template.Template, error) {
+	t, err := template.New("").
+		Funcs(template.FuncMap{
+			"renderAmount": formatAmount,
+			"imageSet":     func(picture string) imageSet { return images.Set(picture) },
+			"asset":        func(url string) string { return assets.URL(url) },
+			"stars":        stars,
+		}).
+		Funcs(locales[0].funcs()).
+		ParseFS(fsys, "*.html")
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not parse the templates")
+	}
+	localized := make(map[*locale]*template.Template, len(locales))
+	for _, l := range locales {
+		c, err := t.Clone()
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "could not clone the templates")
+		}
+		localized[l] = c.Funcs(l.funcs())
+	}
+	return t, localized, nil
+}
+
+// current returns the templates, parsing them again when the files were
+// modified. The previous templates are kept when parsing fails.
+func (s *templateStore) current() (*template.Template, map[*locale]*template.Template) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.interval > 0 && time.Since(s.checkedAt) >= s.interval {
+		if err := s.reload(); err != nil {
+			log.Error().Err(err).Msg("Unable to reload templates, serving the previous ones")
+		}
+	}
+	return s.t, s.localized
+}
+
+// reload parses the templates when the files changed since the last parse.
+// Must be called with the lock held.
+func (s *templateStore) reload() error {
+	s.checkedAt = time.Now()
+	names, err := fs.Glob(s.fsys, "*.html")
+	if err != nil {
+		return errors.Wrap(err, "could not list the templates")
+	}
+	var modTime time.Time
+	for _, name := range names {
+		fi, err := fs.Stat(s.fsys, name)
+		if err != nil {
+			return errors.Wrap(err, "could not stat the templates")
+		}
+		if fi.ModTime().After(modTime) {
+			modTime = fi.ModTime()
+		}
+	}
+	if s.t != nil && modTime.Equal(s.modTime) && len(names) == s.files {
+		return nil
+	}
+
+	t, localized, err := parseTemplates(s.fsys)
+	if err != nil {
+		return err
+	}
+	if s.t != nil {
+		log.Info().Int("templates", len(names)).Msg("templates reloaded")
+	}
+	s.t, s.localized, s.modTime, s.files = t, localized, modTime, len(names)
+	return nil
+}
+
+// Lookup returns the named template, nil when there is none.
+func (s *templateStore) Lookup(name string) *template.Template {
+	t, _ := s.current()
+	return t.Lookup(name)
+}
+
+// ExecuteTemplate renders the named template translated to the locale.
+func (s *templateStore) ExecuteTemplate(w io.Writer, l *locale, name string, data interface{}) error {
+	_, localized := s.current()
+	return localized[l].ExecuteTemplate(w, name, data)
+}
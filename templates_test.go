@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEmbeddedContent(t *testing.T) {
+	s := &templateStore{fsys: contentFS("", "templates")}
+	if err := s.reload(); err != nil {
+		t.Fatalf("embedded templates: %v", err)
+	}
+	for _, name := range []string{"home", "product", "cart", "order", "error", "admin"} {
+		if s.Lookup(name) == nil {
+			t.Errorf("template %q is not embedded", name)
+		}
+	}
+
+	static := newAssetStore(contentFS("", "static"))
+	for _, picture := range catalogPictures(ListProducts(context.Background())) {
+		if got := static.URL(picture); got == picture {
+			t.Errorf("picture %s is not embedded", picture)
+		}
+	}
+	for _, name := range []string{"products.json", "shipping.json", "tax.json", "promotions.json", "inventory.json"} {
+		if _, err := embedded.ReadFile(name); err != nil {
+			t.Errorf("%s is not embedded: %v", name, err)
+		}
+	}
+}
+
+func TestTemplatesReload(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "home.html")
+	write := func(content string, modTime time.Time) {
+		t.Helper()
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	render := func(s *templateStore) string {
+		t.Helper()
+		var buf bytes.Buffer
+		if err := s.ExecuteTemplate(&buf, locales[0], "home", nil); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+
+	now := time.Now()
+	write(`{{ define "home" }}v1{{ end }}`, now)
+	s := &templateStore{fsys: os.DirFS(dir), interval: time.Nanosecond}
+	if err := s.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := render(s); got != "v1" {
+		t.Fatalf("home = %q, want v1", got)
+	}
+
+	write(`{{ define "home" }}v2{{ end }}`, now.Add(time.Second))
+	if got := render(s); got != "v2" {
+		t.Errorf("home = %q after the change, want v2", got)
+	}
+
+	// a broken template keeps the previous ones
+	write(`{{ define "home" }}{{ if }}{{ end }}`, now.Add(2*time.Second))
+	if got := render(s); got != "v2" {
+		t.Errorf("home = %q after a broken change, want v2", got)
+	}
+
+	// the embedded templates are never parsed again
+	e := &templateStore{fsys: contentFS("", "templates")}
+	if err := e.reload(); err != nil {
+		t.Fatal(err)
+	}
+	parsed := e.t
+	e.current()
+	if e.t != parsed {
+		t.Error("embedded templates were parsed again")
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/hlog"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracerName         = "github.com/arbrix/kubertron-demo"
+	defaultServiceName = "kuberton-demo"
+
+	tracesExporterNone   = "none"
+	tracesExporterStdout = "stdout"
+	tracesExporterOTLP   = "otlp"
+)
+
+var (
+	// tracer delegates to the tracer provider installed by setupTracing,
+	// spans are dropped until then.
+	tracer = otel.Tracer(tracerName)
+
+	// outboundClient traces the requests made to other services and
+	// propagates the trace context to them.
+	outboundClient = &http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)}
+)
+
+// setupTracing installs the global tracer provider exporting spans with the
+// named exporter and the W3C trace context propagator. The OTLP exporter is
+// configured with the standard OTEL_EXPORTER_OTLP_* variables. The returned
+// function flushes the pending spans and must be called before exiting.
+func setupTracing(ctx context.Context, exporter string, out io.Writer) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+
+	var (
+		exp sdktrace.SpanExporter
+		err error
+	)
+	switch exporter {
+	case "", tracesExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case tracesExporterStdout:
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(out))
+	case tracesExporterOTLP:
+		exp, err = otlptracehttp.New(ctx)
+	default:
+		return nil, errors.Errorf("unknown traces exporter %q", exporter)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not create %s exporter", exporter)
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the defaults
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", defaultServiceName)),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not describe the service")
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// traceHandler starts a server span for every request, continuing the trace
+// of the caller if it sent a traceparent header. The span is named after the
+// matched chi route pattern once the request has been routed.
+func traceHandler(next http.Handler) http.Handler {
+	name := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r)
+			route := "unmatched"
+			if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+				route = rctx.RoutePattern()
+			}
+			span := trace.SpanFromContext(r.Context())
+			span.SetName(r.Method + " " + route)
+			span.SetAttributes(attribute.String("http.route", route))
+		})
+	}
+	return otelhttp.NewHandler(name(next), "HTTP request")
+}
+
+// traceLogHandler adds the trace and span IDs of the request to its logger
+// so that the log lines can be correlated with the trace.
+func traceLogHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+			hlog.FromRequest(r).UpdateContext(func(c zerolog.Context) zerolog.Context {
+				return c.Str("trace_id", sc.TraceID().String()).Str("span_id", sc.SpanID().String())
+			})
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// spanError marks the span as failed with the error.
+func spanError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// executeTemplate renders the named template within its own span.
+func executeTemplate(ctx context.Context, w io.Writer, name string, data interface{}) error {
+	_, span := tracer.Start(ctx, "template "+name, trace.WithAttributes(attribute.String("template.name", name)))
+	defer span.End()
+	if err := templates.ExecuteTemplate(w, requestLocale(ctx), name, data); err != nil {
+		spanError(span, err)
+		return err
+	}
+	return nil
+}
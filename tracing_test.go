@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTraceHandlerContinuesTraceAcrossRouteAndLookups(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	const (
+		traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		parent  = "00f067aa0ba902b7"
+	)
+	req := httptest.NewRequest(http.MethodGet, "/product/OLJCESPC7Z", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-"+parent+"-01")
+	w := httptest.NewRecorder()
+	RegisterRouter(defaultConfig()).ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /product/OLJCESPC7Z code = %d", w.Code)
+	}
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range sr.Ended() {
+		if got := s.SpanContext().TraceID().String(); got != traceID {
+			t.Errorf("span %q trace ID = %s, want %s", s.Name(), got, traceID)
+		}
+		spans[s.Name()] = s
+	}
+
+	server, ok := spans["GET /product/{id}"]
+	if !ok {
+		t.Fatalf("no server span named after the route, got %v", spans)
+	}
+	if got := server.Parent().SpanID().String(); got != parent {
+		t.Errorf("server span parent = %s, want %s", got, parent)
+	}
+	for _, name := range []string{"catalog.GetProduct", "template product"} {
+		s, ok := spans[name]
+		if !ok {
+			t.Errorf("no %q span", name)
+			continue
+		}
+		if s.Parent().SpanID() != server.SpanContext().SpanID() {
+			t.Errorf("span %q is not a child of the server span", name)
+		}
+	}
+}
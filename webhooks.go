@@ -0,0 +1,533 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/pkg/errors"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog/hlog"
+	"github.com/rs/zerolog/log"
+)
+
+// Events sent to the webhooks.
+const (
+	EventOrderPlaced    = "order.placed"
+	EventOrderShipped   = "order.shipped"
+	EventOrderCancelled = "order.cancelled"
+	EventOrderDelivered = "order.delivered"
+	EventOrderRefunded  = "order.refunded"
+	EventProductCreated = "product.created"
+	EventProductUpdated = "product.updated"
+	EventProductDeleted = "product.deleted"
+	EventRatesRefreshed = "rates.refreshed"
+)
+
+var webhookEvents = []string{
+	EventOrderPlaced, EventOrderShipped, EventOrderCancelled, EventOrderDelivered, EventOrderRefunded,
+	EventProductCreated, EventProductUpdated, EventProductDeleted,
+	EventRatesRefreshed,
+}
+
+const (
+	headerWebhookID        = "X-Webhook-Id"
+	headerWebhookEvent     = "X-Webhook-Event"
+	headerWebhookAttempt   = "X-Webhook-Attempt"
+	headerWebhookSignature = "X-Webhook-Signature"
+
+	// minWebhookSecretLen is the minimum length of a webhook signing secret.
+	minWebhookSecretLen = 16
+	// webhookTolerance is how old a signature receivers should accept.
+	webhookTolerance = 5 * time.Minute
+
+	webhookTimeout     = 10 * time.Second
+	webhookMaxAttempts = 6
+	webhookBackoff     = time.Second
+	webhookMaxBackoff  = 5 * time.Minute
+	maxDeadLetters     = 100
+)
+
+var (
+	ErrWebhookNotFound  = errors.New("no such webhook")
+	ErrWebhookExists    = errors.New("webhook already exists")
+	ErrInvalidWebhook   = errors.New("invalid webhook")
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+)
+
+// Webhook is a subscriber notified of the events with a POST of the event
+// signed with its secret.
+type Webhook struct {
+	Id     string `yaml:"id" json:"id"`
+	URL    string `yaml:"url" json:"url"`
+	Secret string `yaml:"secret" json:"secret"`
+	// Events the subscriber is notified of, all of them when empty.
+	Events []string `yaml:"events" json:"events,omitempty"`
+}
+
+func (h Webhook) subscribes(event string) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, e := range h.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// redacted returns a copy of the webhook safe to print.
+func (h Webhook) redacted() Webhook {
+	h.Secret = redacted
+	return h
+}
+
+// WebhookEvent is the body sent to the subscribers.
+type WebhookEvent struct {
+	Id        string          `json:"id"`
+	Type      string          `json:"type"`
+	CreatedAt time.Time       `json:"createdAt"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// deadLetter is an event that could not be delivered to a subscriber.
+type deadLetter struct {
+	Webhook  string       `json:"webhook"`
+	URL      string       `json:"url"`
+	Event    WebhookEvent `json:"event"`
+	Attempts int          `json:"attempts"`
+	Error    string       `json:"error"`
+	FailedAt time.Time    `json:"failedAt"`
+}
+
+// validateWebhook checks the subscriber, the ID is checked by the caller.
+func validateWebhook(h Webhook) error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+	u, err := url.Parse(h.URL)
+	check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "url %q is not an HTTP URL", h.URL)
+	check(len(h.Secret) >= minWebhookSecretLen, "secret is shorter than %d characters", minWebhookSecretLen)
+	for _, e := range h.Events {
+		check(isWebhookEvent(e), "unknown event %q", e)
+	}
+	if len(problems) > 0 {
+		return errors.Wrapf(ErrInvalidWebhook, "webhook %s: %s", h.Id, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// validateWebhooks checks the configured subscribers.
+func validateWebhooks(hooks []Webhook) error {
+	seen := map[string]bool{}
+	for i, h := range hooks {
+		if h.Id == "" {
+			return errors.Wrapf(ErrInvalidWebhook, "webhook #%d has no id", i+1)
+		}
+		if seen[h.Id] {
+			return errors.Wrapf(ErrWebhookExists, "webhook %s is listed twice", h.Id)
+		}
+		seen[h.Id] = true
+		if err := validateWebhook(h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isWebhookEvent(event string) bool {
+	for _, e := range webhookEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// signWebhook returns the signature header of the body sent at the time:
+// the HMAC-SHA256 of the Unix time, a dot and the body.
+func signWebhook(secret string, at time.Time, body []byte) string {
+	ts := strconv.FormatInt(at.Unix(), 10)
+	return "t=" + ts + ",v1=" + webhookMAC(secret, ts, body)
+}
+
+func webhookMAC(secret, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyWebhook checks the signature header of the body, as receivers do,
+// rejecting signatures older than the tolerance to prevent replays.
+func verifyWebhook(secret, header string, body []byte, now time.Time, tolerance time.Duration) error {
+	var ts, sig string
+	for _, part := range strings.Split(header, ",") {
+		k, v, _ := strings.Cut(part, "=")
+		switch k {
+		case "t":
+			ts = v
+		case "v1":
+			sig = v
+		}
+	}
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || sig == "" {
+		return errors.Wrap(ErrInvalidSignature, "malformed header")
+	}
+	if d := now.Sub(time.Unix(sec, 0)); d > tolerance || d < -tolerance {
+		return errors.Wrap(ErrInvalidSignature, "timestamp out of tolerance")
+	}
+	if !hmac.Equal([]byte(sig), []byte(webhookMAC(secret, ts, body))) {
+		return errors.Wrap(ErrInvalidSignature, "signature mismatch")
+	}
+	return nil
+}
+
+// webhookDispatcher sends the events to the subscribers in the background,
+// retrying failed deliveries with exponential backoff. Events which can
+// still not be delivered are logged to the dead-letter file and kept for the
+// admin API.
+type webhookDispatcher struct {
+	mu    sync.RWMutex
+	hooks []Webhook
+
+	client      *http.Client
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	now         func() time.Time
+
+	deadMu         sync.Mutex
+	deadLetterPath string
+	deadLetters    []deadLetter
+
+	// closed is set under mu once Close started, later events are dropped.
+	closed bool
+
+	// ctx is cancelled to abort the deliveries left on shutdown.
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+var webhooks = newWebhookDispatcher(nil, "")
+
+func newWebhookDispatcher(hooks []Webhook, deadLetterPath string) *webhookDispatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &webhookDispatcher{
+		hooks:          append([]Webhook(nil), hooks...),
+		client:         &http.Client{Timeout: webhookTimeout},
+		maxAttempts:    webhookMaxAttempts,
+		backoff:        webhookBackoff,
+		maxBackoff:     webhookMaxBackoff,
+		now:            time.Now,
+		deadLetterPath: deadLetterPath,
+		ctx:            ctx,
+		cancel:         cancel,
+	}
+}
+
+// SetWebhooks replaces the subscribers with the configured ones, failed
+// deliveries are appended to the dead-letter file when there is one. It
+// must be called before serving requests.
+func SetWebhooks(hooks []Webhook, deadLetterPath string) {
+	webhooks = newWebhookDispatcher(hooks, deadLetterPath)
+}
+
+// List returns the subscribers with their secrets redacted.
+func (d *webhookDispatcher) List() []Webhook {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	hooks := make([]Webhook, len(d.hooks))
+	for i, h := range d.hooks {
+		hooks[i] = h.redacted()
+	}
+	return hooks
+}
+
+// Register adds the subscriber, a random ID is given to one without.
+func (d *webhookDispatcher) Register(h Webhook) (Webhook, error) {
+	if h.Id == "" {
+		h.Id = xid.New().String()
+	}
+	if err := validateWebhook(h); err != nil {
+		return Webhook{}, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, old := range d.hooks {
+		if old.Id == h.Id {
+			return Webhook{}, errors.Wrapf(ErrWebhookExists, "webhook %s", h.Id)
+		}
+	}
+	d.hooks = append(d.hooks, h)
+	return h, nil
+}
+
+// Unregister removes the subscriber, deliveries in progress go on.
+func (d *webhookDispatcher) Unregister(id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i, h := range d.hooks {
+		if h.Id == id {
+			d.hooks = append(d.hooks[:i:i], d.hooks[i+1:]...)
+			return nil
+		}
+	}
+	return errors.Wrapf(ErrWebhookNotFound, "webhook %s", id)
+}
+
+// DeadLetters returns the latest events which could not be delivered.
+func (d *webhookDispatcher) DeadLetters() []deadLetter {
+	d.deadMu.Lock()
+	defer d.deadMu.Unlock()
+	return append([]deadLetter(nil), d.deadLetters...)
+}
+
+// Publish sends the event with the data to its subscribers in the
+// background. Events published once the dispatcher is closed are dropped.
+func (d *webhookDispatcher) Publish(event string, data interface{}) {
+	// the read lock is held until the deliveries are added to the wait
+	// group, so that Close does not wait while deliveries are still added
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	var hooks []Webhook
+	for _, h := range d.hooks {
+		if h.subscribes(event) {
+			hooks = append(hooks, h)
+		}
+	}
+	if len(hooks) == 0 {
+		return
+	}
+	if d.closed {
+		webhookDeliveries.WithLabelValues(event, "dropped").Add(float64(len(hooks)))
+		log.Warn().Str("event", event).Int("webhooks", len(hooks)).Msg("webhook event dropped, shutting down")
+		return
+	}
+
+	raw, err := json.Marshal(data)
+	if err != nil {
+		log.Error().Err(err).Str("event", event).Msg("unable to encode webhook event")
+		return
+	}
+	e := WebhookEvent{Id: xid.New().String(), Type: event, CreatedAt: d.now().UTC(), Data: raw}
+	body, err := json.Marshal(e)
+	if err != nil {
+		log.Error().Err(err).Str("event", event).Msg("unable to encode webhook event")
+		return
+	}
+	for _, h := range hooks {
+		d.wg.Add(1)
+		go func(h Webhook) {
+			defer d.wg.Done()
+			d.deliver(h, e, body)
+		}(h)
+	}
+}
+
+// deliver sends the event until the subscriber accepts it, it runs out of
+// attempts or the dispatcher is closed.
+func (d *webhookDispatcher) deliver(h Webhook, e WebhookEvent, body []byte) {
+	logger := log.With().Str("webhook", h.Id).Str("event", e.Type).Str("event_id", e.Id).Logger()
+	attempt := 1
+	for ; ; attempt++ {
+		retry, err := d.send(h, e, body, attempt)
+		if err == nil {
+			webhookDeliveries.WithLabelValues(e.Type, "delivered").Inc()
+			logger.Debug().Int("attempt", attempt).Msg("webhook delivered")
+			return
+		}
+		if !retry {
+			d.deadLetter(h, e, attempt, errors.Wrap(err, "not retried"))
+			return
+		}
+		if attempt == d.maxAttempts {
+			d.deadLetter(h, e, attempt, err)
+			return
+		}
+		wait := d.backoffFor(attempt)
+		webhookDeliveries.WithLabelValues(e.Type, "retried").Inc()
+		logger.Warn().Err(err).Int("attempt", attempt).Dur("retry_in", wait).Msg("webhook delivery failed")
+		t := time.NewTimer(wait)
+		select {
+		case <-d.ctx.Done():
+			t.Stop()
+			d.deadLetter(h, e, attempt, errors.Wrap(err, "abandoned on shutdown"))
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// backoffFor returns how long to wait after the failed attempt.
+func (d *webhookDispatcher) backoffFor(attempt int) time.Duration {
+	return exponentialBackoff(d.backoff, d.maxBackoff, attempt)
+}
+
+// exponentialBackoff returns how long to wait after the failed attempt,
+// starting from base and doubling every attempt up to max.
+func exponentialBackoff(base, max time.Duration, attempt int) time.Duration {
+	wait := base
+	for i := 1; i < attempt && wait < max; i++ {
+		wait *= 2
+	}
+	if wait > max {
+		wait = max
+	}
+	return wait
+}
+
+// send posts the event once and reports whether a failure is worth
+// retrying: network errors, timeouts, rate limiting and server errors.
+func (d *webhookDispatcher) send(h Webhook, e WebhookEvent, body []byte, attempt int) (bool, error) {
+	req, err := http.NewRequestWithContext(d.ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, errors.Wrap(err, "could not create the request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(headerWebhookID, e.Id)
+	req.Header.Set(headerWebhookEvent, e.Type)
+	req.Header.Set(headerWebhookAttempt, strconv.Itoa(attempt))
+	req.Header.Set(headerWebhookSignature, signWebhook(h.Secret, d.now(), body))
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return true, errors.Wrap(err, "could not send the event")
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests ||
+		resp.StatusCode == http.StatusRequestTimeout
+	return retry, errors.Errorf("subscriber responded %s", resp.Status)
+}
+
+// deadLetter records the event which could not be delivered.
+func (d *webhookDispatcher) deadLetter(h Webhook, e WebhookEvent, attempts int, err error) {
+	webhookDeliveries.WithLabelValues(e.Type, "dead_letter").Inc()
+	log.Error().Err(err).Str("webhook", h.Id).Str("event", e.Type).Str("event_id", e.Id).
+		Int("attempts", attempts).Msg("webhook delivery abandoned")
+	dl := deadLetter{Webhook: h.Id, URL: h.URL, Event: e, Attempts: attempts, Error: err.Error(), FailedAt: d.now().UTC()}
+
+	d.deadMu.Lock()
+	defer d.deadMu.Unlock()
+	d.deadLetters = append(d.deadLetters, dl)
+	if len(d.deadLetters) > maxDeadLetters {
+		d.deadLetters = d.deadLetters[len(d.deadLetters)-maxDeadLetters:]
+	}
+	if d.deadLetterPath != "" {
+		if err := appendJSONLine(d.deadLetterPath, dl); err != nil {
+			log.Error().Err(err).Str("path", d.deadLetterPath).Msg("unable to write webhook dead letter")
+		}
+	}
+}
+
+func appendJSONLine(path string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return errors.Wrap(err, "could not encode the line")
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Wrap(err, "could not open the file")
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return errors.Wrap(err, "could not write the file")
+	}
+	return errors.Wrap(f.Close(), "could not write the file")
+}
+
+// Close waits for the deliveries in progress until the context is done,
+// the ones left are then abandoned to the dead letters.
+func (d *webhookDispatcher) Close(ctx context.Context) {
+	d.mu.Lock()
+	d.closed = true
+	d.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		d.cancel()
+		<-done
+	}
+	d.cancel()
+}
+
+func webhookErrorCode(err error) int {
+	switch errors.Cause(err) {
+	case ErrWebhookNotFound:
+		return http.StatusNotFound
+	case ErrWebhookExists:
+		return http.StatusConflict
+	case ErrInvalidWebhook:
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+func listWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, webhooks.List())
+}
+
+// registerWebhookHandler adds the subscriber given as JSON until the next
+// restart, the configured ones are kept.
+func registerWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	l := hlog.FromRequest(r)
+	var h Webhook
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&h); err != nil {
+		renderError(l, r, w, errors.Wrap(err, "could not parse the webhook"), http.StatusBadRequest)
+		return
+	}
+	h, err := webhooks.Register(h)
+	if err != nil {
+		renderError(l, r, w, err, webhookErrorCode(err))
+		return
+	}
+	l.Info().Str("webhook", h.Id).Str("url", h.URL).Strs("events", h.Events).Str("admin", adminUser(r)).Msg("webhook registered")
+	render.Status(r, http.StatusCreated)
+	render.JSON(w, r, h.redacted())
+}
+
+func unregisterWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	l := hlog.FromRequest(r)
+	id := chi.URLParam(r, "id")
+	if err := webhooks.Unregister(id); err != nil {
+		renderError(l, r, w, err, webhookErrorCode(err))
+		return
+	}
+	l.Info().Str("webhook", id).Str("admin", adminUser(r)).Msg("webhook unregistered")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func deadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, webhooks.DeadLetters())
+}
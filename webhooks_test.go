@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const testWebhookSecret = "0123456789abcdef"
+
+// webhookReceiver is a subscriber answering with the codes in turn, the
+// last one for the remaining requests. It verifies the signatures.
+type webhookReceiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	codes    []int
+	received []*http.Request
+	events   []WebhookEvent
+	bad      int
+}
+
+func newWebhookReceiver(t *testing.T, codes ...int) *webhookReceiver {
+	rcv := &webhookReceiver{codes: codes}
+	rcv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		rcv.mu.Lock()
+		defer rcv.mu.Unlock()
+		if err := verifyWebhook(testWebhookSecret, r.Header.Get(headerWebhookSignature), body, time.Now(), webhookTolerance); err != nil {
+			rcv.bad++
+		}
+		var e WebhookEvent
+		json.Unmarshal(body, &e)
+		rcv.received, rcv.events = append(rcv.received, r), append(rcv.events, e)
+		code := rcv.codes[len(rcv.codes)-1]
+		if len(rcv.received) <= len(rcv.codes) {
+			code = rcv.codes[len(rcv.received)-1]
+		}
+		w.WriteHeader(code)
+	}))
+	t.Cleanup(rcv.Close)
+	return rcv
+}
+
+func (rcv *webhookReceiver) hook(id string, events ...string) Webhook {
+	return Webhook{Id: id, URL: rcv.URL, Secret: testWebhookSecret, Events: events}
+}
+
+func (rcv *webhookReceiver) got() ([]*http.Request, []WebhookEvent, int) {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	return rcv.received, rcv.events, rcv.bad
+}
+
+// newTestDispatcher returns a dispatcher retrying right away.
+func newTestDispatcher(hooks []Webhook, deadLetterPath string) *webhookDispatcher {
+	d := newWebhookDispatcher(hooks, deadLetterPath)
+	d.backoff, d.maxBackoff, d.maxAttempts = time.Millisecond, 4*time.Millisecond, 4
+	return d
+}
+
+func TestVerifyWebhook(t *testing.T) {
+	now := time.Now()
+	body := []byte(`{"type":"order.placed"}`)
+	sig := signWebhook(testWebhookSecret, now, body)
+	tests := []struct {
+		name           string
+		secret, header string
+		body           []byte
+		wantErr        bool
+	}{
+		{"valid", testWebhookSecret, sig, body, false},
+		{"other secret", "fedcba9876543210", sig, body, true},
+		{"tampered body", testWebhookSecret, sig, []byte(`{"type":"order.shipped"}`), true},
+		{"too old", testWebhookSecret, signWebhook(testWebhookSecret, now.Add(-10*time.Minute), body), body, true},
+		{"no signature", testWebhookSecret, "t=" + sig[2:12], body, true},
+		{"malformed", testWebhookSecret, "v1=abc", body, true},
+	}
+	for _, tt := range tests {
+		err := verifyWebhook(tt.secret, tt.header, tt.body, now, webhookTolerance)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: verifyWebhook() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+		if err != nil && errors.Cause(err) != ErrInvalidSignature {
+			t.Errorf("%s: verifyWebhook() error = %v, want ErrInvalidSignature", tt.name, err)
+		}
+	}
+}
+
+func TestValidateWebhooks(t *testing.T) {
+	valid := Webhook{Id: "fulfilment", URL: "https://example.com/hooks", Secret: testWebhookSecret, Events: []string{EventOrderPlaced}}
+	tests := []struct {
+		name    string
+		hooks   func(h Webhook) []Webhook
+		wantErr error
+	}{
+		{"valid", func(h Webhook) []Webhook { return []Webhook{h} }, nil},
+		{"all events", func(h Webhook) []Webhook { h.Events = nil; return []Webhook{h} }, nil},
+		{"no id", func(h Webhook) []Webhook { h.Id = ""; return []Webhook{h} }, ErrInvalidWebhook},
+		{"duplicate id", func(h Webhook) []Webhook { return []Webhook{h, h} }, ErrWebhookExists},
+		{"not HTTP", func(h Webhook) []Webhook { h.URL = "ftp://example.com"; return []Webhook{h} }, ErrInvalidWebhook},
+		{"short secret", func(h Webhook) []Webhook { h.Secret = "s3cret"; return []Webhook{h} }, ErrInvalidWebhook},
+		{"unknown event", func(h Webhook) []Webhook { h.Events = []string{"order.lost"}; return []Webhook{h} }, ErrInvalidWebhook},
+	}
+	for _, tt := range tests {
+		if err := validateWebhooks(tt.hooks(valid)); errors.Cause(err) != tt.wantErr {
+			t.Errorf("%s: validateWebhooks() error = %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	d := newWebhookDispatcher(nil, "")
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second}
+	for i, w := range want {
+		if got := d.backoffFor(i + 1); got != w {
+			t.Errorf("backoffFor(%d) = %v, want %v", i+1, got, w)
+		}
+	}
+	if got := d.backoffFor(20); got != webhookMaxBackoff {
+		t.Errorf("backoffFor(20) = %v, want the maximum %v", got, webhookMaxBackoff)
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	flaky := newWebhookReceiver(t, http.StatusServiceUnavailable, http.StatusInternalServerError, http.StatusNoContent)
+	down := newWebhookReceiver(t, http.StatusBadGateway)
+	gone := newWebhookReceiver(t, http.StatusGone)
+	other := newWebhookReceiver(t, http.StatusOK)
+	deadLetterPath := filepath.Join(t.TempDir(), "dead-letters.jsonl")
+	d := newTestDispatcher([]Webhook{
+		flaky.hook("flaky", EventOrderPlaced),
+		down.hook("down"),
+		gone.hook("gone", EventOrderPlaced),
+		other.hook("other", EventProductUpdated),
+	}, deadLetterPath)
+
+	d.Publish(EventOrderPlaced, map[string]string{"orderId": "42"})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	d.Close(ctx)
+
+	tests := []struct {
+		name         string
+		rcv          *webhookReceiver
+		wantAttempts int
+	}{
+		{"retried until delivered", flaky, 3},
+		{"retried until out of attempts", down, 4},
+		{"client error not retried", gone, 1},
+		{"not subscribed", other, 0},
+	}
+	for _, tt := range tests {
+		reqs, events, bad := tt.rcv.got()
+		if len(reqs) != tt.wantAttempts {
+			t.Errorf("%s: %d attempts, want %d", tt.name, len(reqs), tt.wantAttempts)
+		}
+		if bad > 0 {
+			t.Errorf("%s: %d requests with an invalid signature", tt.name, bad)
+		}
+		for i, r := range reqs {
+			if got := r.Header.Get(headerWebhookAttempt); got != strconv.Itoa(i+1) {
+				t.Errorf("%s: attempt header = %s, want %d", tt.name, got, i+1)
+			}
+			if e := events[i]; e.Type != EventOrderPlaced || string(e.Data) != `{"orderId":"42"}` || r.Header.Get(headerWebhookID) != e.Id {
+				t.Errorf("%s: received %+v with ID header %s", tt.name, e, r.Header.Get(headerWebhookID))
+			}
+		}
+	}
+
+	dead := d.DeadLetters()
+	if len(dead) != 2 {
+		t.Fatalf("%d dead letters, want 2: %+v", len(dead), dead)
+	}
+	f, err := os.Open(deadLetterPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	attempts := map[string]int{}
+	for sc := bufio.NewScanner(f); sc.Scan(); {
+		var dl deadLetter
+		if err := json.Unmarshal(sc.Bytes(), &dl); err != nil {
+			t.Fatalf("dead letter line %q: %v", sc.Text(), err)
+		}
+		attempts[dl.Webhook] = dl.Attempts
+		if dl.Event.Type != EventOrderPlaced || dl.Error == "" {
+			t.Errorf("dead letter %+v misses the event or the error", dl)
+		}
+	}
+	if attempts["down"] != 4 || attempts["gone"] != 1 || len(attempts) != 2 {
+		t.Errorf("dead letter attempts = %v, want down after 4 and gone after 1", attempts)
+	}
+}
+
+func TestWebhookCloseAbandonsRetries(t *testing.T) {
+	down := newWebhookReceiver(t, http.StatusServiceUnavailable)
+	d := newWebhookDispatcher([]Webhook{down.hook("down")}, "")
+	d.Publish(EventRatesRefreshed, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	d.Close(ctx)
+	if dead := d.DeadLetters(); len(dead) != 1 || !strings.Contains(dead[0].Error, "shutdown") {
+		t.Errorf("dead letters = %+v, want the delivery abandoned on shutdown", dead)
+	}
+
+	before := testutil.ToFloat64(webhookDeliveries.WithLabelValues(EventRatesRefreshed, "dropped"))
+	d.Publish(EventRatesRefreshed, nil)
+	d.wg.Wait()
+	if dead := d.DeadLetters(); len(dead) != 1 {
+		t.Errorf("%d dead letters after publishing on a closed dispatcher, want 1", len(dead))
+	}
+	if got := testutil.ToFloat64(webhookDeliveries.WithLabelValues(EventRatesRefreshed, "dropped")); got != before+1 {
+		t.Errorf("dropped events = %v, want %v", got, before+1)
+	}
+}
+
+func TestWebhookEvents(t *testing.T) {
+	rcv := newWebhookReceiver(t, http.StatusOK)
+	saved := webhooks
+	defer func() { webhooks = saved }()
+	webhooks = newTestDispatcher(nil, "")
+
+	cfg := defaultConfig()
+	cfg.AdminPassword = "s3cret"
+	router := RegisterRouter(cfg)
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.SetBasicAuth("admin", "s3cret")
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	hook := `{"id":"fulfilment","url":"` + rcv.URL + `","secret":"` + testWebhookSecret + `","events":["order.shipped","order.delivered","order.refunded"]}`
+	steps := []struct {
+		name, method, target, body string
+		wantCode                   int
+	}{
+		{"register", http.MethodPost, "/admin/webhooks", hook, http.StatusCreated},
+		{"register twice", http.MethodPost, "/admin/webhooks", hook, http.StatusConflict},
+		{"register invalid", http.MethodPost, "/admin/webhooks", `{"url":"` + rcv.URL + `","secret":"short"}`, http.StatusBadRequest},
+		{"register unknown field", http.MethodPost, "/admin/webhooks", `{"uri":"` + rcv.URL + `"}`, http.StatusBadRequest},
+		{"unregister missing", http.MethodDelete, "/admin/webhooks/nope", "", http.StatusNotFound},
+	}
+	for _, s := range steps {
+		if w := do(s.method, s.target, s.body); w.Code != s.wantCode {
+			t.Errorf("%s: code = %d, want %d: %s", s.name, w.Code, s.wantCode, w.Body.String())
+		}
+	}
+	var listed []Webhook
+	if err := json.Unmarshal(do(http.MethodGet, "/admin/webhooks", "").Body.Bytes(), &listed); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 1 || listed[0].Secret != redacted {
+		t.Errorf("listed webhooks = %+v, want the one with its secret redacted", listed)
+	}
+
+	o := NewOrder("webhooks-test", Money{CurrencyCode: "USD", Units: 10})
+	if err := o.Pay(o.Total); err != nil {
+		t.Fatal(err)
+	}
+	orders.Add(o)
+	if w := do(http.MethodPost, "/admin/orders/"+o.OrderId+"/ship", ""); w.Code != http.StatusOK {
+		t.Fatalf("ship code = %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	if w := do(http.MethodPost, "/admin/orders/"+o.OrderId+"/ship", ""); w.Code != http.StatusConflict {
+		t.Errorf("ship twice code = %d, want %d", w.Code, http.StatusConflict)
+	}
+	if w := do(http.MethodPost, "/admin/orders/"+o.OrderId+"/deliver", ""); w.Code != http.StatusOK {
+		t.Fatalf("deliver code = %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	if w := do(http.MethodPost, "/admin/orders/"+o.OrderId+"/refund", `{"amount":"4.00"}`); w.Code != http.StatusOK {
+		t.Fatalf("refund code = %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	webhooks.Publish(EventProductUpdated, nil)
+	if w := do(http.MethodDelete, "/admin/webhooks/fulfilment", ""); w.Code != http.StatusNoContent {
+		t.Errorf("unregister code = %d, want %d", w.Code, http.StatusNoContent)
+	}
+	webhooks.Publish(EventOrderShipped, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	webhooks.Close(ctx)
+	_, events, _ := rcv.got()
+	if len(events) != 3 {
+		t.Fatalf("received %+v, want the order.shipped, order.delivered and order.refunded events", events)
+	}
+	// the events are delivered concurrently
+	byType := map[string]Order{}
+	for _, e := range events {
+		var eo Order
+		if err := json.Unmarshal(e.Data, &eo); err != nil {
+			t.Fatal(err)
+		}
+		byType[e.Type] = eo
+	}
+	if shipped := byType[EventOrderShipped]; shipped.OrderId != o.OrderId || shipped.Status != OrderShipped || shipped.ShippingTrackingId == "" {
+		t.Errorf("shipped order = %+v, want %s shipped with a tracking ID", shipped, o.OrderId)
+	}
+	if delivered := byType[EventOrderDelivered]; delivered.OrderId != o.OrderId || delivered.Status != OrderDelivered {
+		t.Errorf("delivered order = %+v, want %s delivered", delivered, o.OrderId)
+	}
+	if refunded := byType[EventOrderRefunded]; refunded.OrderId != o.OrderId || refunded.Refunded != (Money{CurrencyCode: "USD", Units: 4}) {
+		t.Errorf("refunded order = %+v, want %s with USD 4.00 refunded", refunded, o.OrderId)
+	}
+}
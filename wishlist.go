@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-chi/render"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/hlog"
+)
+
+const (
+	maxWishlist       = 50
+	maxRecentlyViewed = 8
+
+	// productListIdleTTL is how long the list of a session is kept after
+	// its last use, the session cookie expires by then.
+	productListIdleTTL = cookieMaxAge * time.Second
+)
+
+var ErrListFull = errors.New("list is full")
+
+// productListStore keeps lists of product IDs per session in memory, the
+// most recently added product first.
+type productListStore struct {
+	mu    sync.Mutex
+	lists map[string]*productList
+	max   int
+	// evict drops the oldest products of a full list, else adding to it
+	// fails.
+	evict   bool
+	now     func() time.Time
+	sweptAt time.Time
+}
+
+type productList struct {
+	ids      []string
+	lastSeen time.Time
+}
+
+var (
+	wishlists      = newProductListStore(maxWishlist, false)
+	recentlyViewed = newProductListStore(maxRecentlyViewed, true)
+)
+
+func newProductListStore(max int, evict bool) *productListStore {
+	return &productListStore{lists: map[string]*productList{}, max: max, evict: evict, now: time.Now}
+}
+
+// list returns the session list, which is used now, and forgets the lists
+// which were idle for a while. Must be called with the lock held.
+func (s *productListStore) list(sessionID string) *productList {
+	now := s.now()
+	if now.Sub(s.sweptAt) >= productListIdleTTL {
+		for id, l := range s.lists {
+			if now.Sub(l.lastSeen) >= productListIdleTTL {
+				delete(s.lists, id)
+			}
+		}
+		s.sweptAt = now
+	}
+	l, ok := s.lists[sessionID]
+	if !ok {
+		return &productList{lastSeen: now}
+	}
+	l.lastSeen = now
+	return l
+}
+
+// Add puts the product first in the session list, moving it there when it
+// is already in the list.
+func (s *productListStore) Add(sessionID, productID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l := s.list(sessionID)
+	list := make([]string, 1, len(l.ids)+1)
+	list[0] = productID
+	for _, id := range l.ids {
+		if id != productID {
+			list = append(list, id)
+		}
+	}
+	if len(list) > s.max {
+		if !s.evict {
+			return errors.Wrapf(ErrListFull, "at most %d products", s.max)
+		}
+		list = list[:s.max]
+	}
+	l.ids = list
+	s.lists[sessionID] = l
+	return nil
+}
+
+// Remove takes the product out of the session list.
+func (s *productListStore) Remove(sessionID, productID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l := s.list(sessionID)
+	for i, id := range l.ids {
+		if id == productID {
+			l.ids = append(l.ids[:i:i], l.ids[i+1:]...)
+			break
+		}
+	}
+	if len(l.ids) == 0 {
+		delete(s.lists, sessionID)
+	}
+}
+
+// Get returns a copy of the session list.
+func (s *productListStore) Get(sessionID string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.list(sessionID).ids...)
+}
+
+// Contains reports whether the product is in the session list.
+func (s *productListStore) Contains(sessionID, productID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range s.list(sessionID).ids {
+		if id == productID {
+			return true
+		}
+	}
+	return false
+}
+
+// productStrip is a titled row of product cards rendered by the
+// recommendations template, the title is a message key.
+type productStrip struct {
+	Title    string
+	Products []Product
+}
+
+// newProductStrip returns nil when there are no products, so that pages
+// leave the strip out.
+func newProductStrip(title string, ps []Product) *productStrip {
+	if len(ps) == 0 {
+		return nil
+	}
+	return &productStrip{title, ps}
+}
+
+// listedProducts returns the localized products of the list, except the
+// ones deleted from the catalog since and the excluded one.
+func listedProducts(ctx context.Context, ids []string, exclude string) []Product {
+	ps := make([]Product, 0, len(ids))
+	for _, id := range ids {
+		if id == exclude {
+			continue
+		}
+		if p, err := GetProduct(ctx, id); err == nil {
+			ps = append(ps, *p)
+		}
+	}
+	return localizeProducts(ctx, ps)
+}
+
+// wishlistProductID returns the product_id of the form or the productId of
+// the JSON body.
+func wishlistProductID(r *http.Request) (string, error) {
+	if !isJSONBody(r) {
+		return r.FormValue("product_id"), nil
+	}
+	var body struct {
+		ProductId string `json:"productId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return "", errors.Wrap(err, "could not parse the wishlist item")
+	}
+	return body.ProductId, nil
+}
+
+func wishlistHandler(w http.ResponseWriter, r *http.Request) {
+	l := hlog.FromRequest(r)
+	products := listedProducts(r.Context(), wishlists.Get(sessionID(r)), "")
+	if wantsJSON(r) {
+		render.JSON(w, r, products)
+		return
+	}
+	rid, _ := hlog.IDFromRequest(r)
+	if err := executeTemplate(r.Context(), w, "wishlist", map[string]interface{}{
+		"request_id":      rid.String(),
+		"user_currency":   currentCurrency(r),
+		"currencies":      Currencies(),
+		"wishlist":        newProductStrip("wishlist.title", products),
+		"recently_viewed": newProductStrip("recently_viewed.title", listedProducts(r.Context(), recentlyViewed.Get(sessionID(r)), "")),
+		"cart_size":       cartSizeFromCookie(r),
+	}); err != nil {
+		l.Info().Err(err).Msg("unable to parse wishlist template")
+	}
+}
+
+// addToWishlistHandler saves the product to the session wishlist and goes
+// back to the product page.
+func addToWishlistHandler(w http.ResponseWriter, r *http.Request) {
+	l := hlog.FromRequest(r)
+	pid, err := wishlistProductID(r)
+	if err == nil {
+		_, err = GetProduct(r.Context(), pid)
+	}
+	if err != nil {
+		renderError(l, r, w, errors.Wrap(err, "could not retrieve product"), http.StatusBadRequest)
+		return
+	}
+	if err := wishlists.Add(sessionID(r), pid); err != nil {
+		renderError(l, r, w, errors.Wrap(err, "could not add to the wishlist"), http.StatusConflict)
+		return
+	}
+	l.Debug().Str("product", pid).Msg("added to wishlist")
+	if wantsJSON(r) {
+		render.JSON(w, r, listedProducts(r.Context(), wishlists.Get(sessionID(r)), ""))
+		return
+	}
+	http.Redirect(w, r, "/product/"+pid, http.StatusFound)
+}
+
+// removeFromWishlistHandler takes the product out of the session wishlist
+// and goes back to the product page.
+func removeFromWishlistHandler(w http.ResponseWriter, r *http.Request) {
+	l := hlog.FromRequest(r)
+	pid, err := wishlistProductID(r)
+	if err != nil {
+		renderError(l, r, w, err, http.StatusBadRequest)
+		return
+	}
+	wishlists.Remove(sessionID(r), pid)
+	l.Debug().Str("product", pid).Msg("removed from wishlist")
+	if wantsJSON(r) {
+		render.JSON(w, r, listedProducts(r.Context(), wishlists.Get(sessionID(r)), ""))
+		return
+	}
+	http.Redirect(w, r, "/product/"+pid, http.StatusFound)
+}
+
+// recentlyViewedHandler returns the products last viewed in the session at
+// JSON format.
+func recentlyViewedHandler(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, listedProducts(r.Context(), recentlyViewed.Get(sessionID(r)), ""))
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestProductListStore(t *testing.T) {
+	recent := newProductListStore(3, true)
+	for _, id := range []string{"a", "b", "c", "a", "d"} {
+		if err := recent.Add("s", id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := recent.Get("s"), []string{"d", "a", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("evicting list = %v, want %v", got, want)
+	}
+
+	wishlist := newProductListStore(2, false)
+	wishlist.Add("s", "a")
+	wishlist.Add("s", "b")
+	if err := wishlist.Add("s", "c"); errors.Cause(err) != ErrListFull {
+		t.Errorf("Add() to a full list error = %v, want ErrListFull", err)
+	}
+	if err := wishlist.Add("s", "a"); err != nil {
+		t.Errorf("Add() of a listed product to a full list error = %v", err)
+	}
+	wishlist.Remove("s", "b")
+	wishlist.Remove("s", "nope")
+	if got, want := wishlist.Get("s"), []string{"a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("list = %v, want %v", got, want)
+	}
+	if !wishlist.Contains("s", "a") || wishlist.Contains("s", "b") || wishlist.Contains("other", "a") {
+		t.Error("Contains() does not match the list")
+	}
+}
+
+func TestProductListStoreForgetsIdleSessions(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	s := newProductListStore(3, true)
+	s.now = func() time.Time { return now }
+
+	s.Add("idle", "a")
+	s.Add("active", "a")
+	now = now.Add(productListIdleTTL / 2)
+	s.Get("active")
+	now = now.Add(productListIdleTTL / 2)
+	s.Add("new", "b")
+
+	if len(s.lists) != 2 {
+		t.Errorf("%d lists kept, want 2", len(s.lists))
+	}
+	if got := s.Get("idle"); len(got) != 0 {
+		t.Errorf("idle list = %v, want it forgotten", got)
+	}
+	if got, want := s.Get("active"), []string{"a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("active list = %v, want %v", got, want)
+	}
+}
+
+func TestWishlistAndRecentlyViewed(t *testing.T) {
+	const session = "wishlist-test"
+	router := RegisterRouter(defaultConfig())
+	do := func(method, target, contentType, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		if contentType != "" {
+			r.Header.Set("Content-Type", contentType)
+		}
+		r.AddCookie(&http.Cookie{Name: cookieSessionID, Value: signCookie(cookieSessionID, session)})
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+	ids := func(w *httptest.ResponseRecorder) []string {
+		var ps []Product
+		if err := json.Unmarshal(w.Body.Bytes(), &ps); err != nil {
+			t.Fatalf("products JSON: %v: %s", err, w.Body.String())
+		}
+		ids := []string{}
+		for _, p := range ps {
+			ids = append(ids, p.Id)
+		}
+		return ids
+	}
+	const formType = "application/x-www-form-urlencoded"
+
+	for _, id := range []string{"OLJCESPC7Z", "66VCHSJNUP", "OLJCESPC7Z"} {
+		do(http.MethodGet, "/product/"+id, "", "")
+	}
+	if got, want := ids(do(http.MethodGet, "/recently-viewed", "", "")), []string{"OLJCESPC7Z", "66VCHSJNUP"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("recently viewed = %v, want %v", got, want)
+	}
+	body := do(http.MethodGet, "/product/OLJCESPC7Z", "", "").Body.String()
+	if !strings.Contains(body, "Recently viewed") || !strings.Contains(body, `href="/product/66VCHSJNUP"`) {
+		t.Error("product page does not show the recently viewed products")
+	}
+	if !strings.Contains(do(http.MethodGet, "/", "", "").Body.String(), "Recently viewed") {
+		t.Error("home page does not show the recently viewed products")
+	}
+
+	steps := []struct {
+		name, method, target, contentType, body string
+		wantCode                                int
+	}{
+		{"add", http.MethodPost, "/wishlist", formType, url.Values{"product_id": {"OLJCESPC7Z"}}.Encode(), http.StatusFound},
+		{"add JSON", http.MethodPost, "/wishlist", "application/json", `{"productId":"66VCHSJNUP"}`, http.StatusOK},
+		{"add unknown product", http.MethodPost, "/wishlist", formType, url.Values{"product_id": {"NOPE"}}.Encode(), http.StatusBadRequest},
+		{"add invalid JSON", http.MethodPost, "/wishlist", "application/json", `{"productId":`, http.StatusBadRequest},
+	}
+	for _, s := range steps {
+		if w := do(s.method, s.target, s.contentType, s.body); w.Code != s.wantCode {
+			t.Errorf("%s: code = %d, want %d: %s", s.name, w.Code, s.wantCode, w.Body.String())
+		}
+	}
+	if got, want := ids(do(http.MethodGet, "/wishlist?json=true", "", "")), []string{"66VCHSJNUP", "OLJCESPC7Z"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("wishlist = %v, want %v", got, want)
+	}
+	if body := do(http.MethodGet, "/product/OLJCESPC7Z", "", "").Body.String(); !strings.Contains(body, `action="/wishlist/remove"`) {
+		t.Error("product page does not offer to remove the product from the wishlist")
+	}
+	if body := do(http.MethodGet, "/wishlist", "", "").Body.String(); !strings.Contains(body, "Your Wishlist") || !strings.Contains(body, `href="/product/66VCHSJNUP"`) {
+		t.Error("wishlist page does not show the products")
+	}
+
+	do(http.MethodPost, "/wishlist/remove", formType, url.Values{"product_id": {"OLJCESPC7Z"}}.Encode())
+	if got, want := ids(do(http.MethodPost, "/wishlist/remove?json=true", "application/json", `{"productId":"66VCHSJNUP"}`)), []string{}; !reflect.DeepEqual(got, want) {
+		t.Errorf("wishlist after removing = %v, want %v", got, want)
+	}
+	if body := do(http.MethodGet, "/wishlist", "", "").Body.String(); !strings.Contains(body, "Products you save to your wishlist") {
+		t.Error("wishlist page does not say the wishlist is empty")
+	}
+}